@@ -0,0 +1,49 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Authorizer decides whether an incoming call may be handled. It can look at
+// the method, call type and arguments of req, and at ctx, which is derived
+// from the one passed to Serve and so can carry the identity of the peer.
+// Returning an error rejects the call: the caller gets a CallError starting
+// with "forbidden" and the handler is not called.
+type Authorizer func(ctx context.Context, req *Request) error
+
+// Authorize returns a Handler that passes calls on to h only if all of authz
+// allow them. Since the result is a Handler itself, it composes with other
+// handler wrappers and can be registered for some routes of a HandlerMux only.
+// Use WithAuthorizer to check all calls of a session.
+func Authorize(h Handler, authz ...Authorizer) Handler {
+	return &authorizedHandler{
+		Handler: h,
+		authz:   authz,
+	}
+}
+
+type authorizedHandler struct {
+	Handler
+
+	authz []Authorizer
+}
+
+func (h *authorizedHandler) HandleCall(ctx context.Context, req *Request) {
+	if authorize(ctx, req, h.authz) {
+		h.Handler.HandleCall(ctx, req)
+	}
+}
+
+// authorize ends req and returns false if one of authz rejects it.
+func authorize(ctx context.Context, req *Request, authz []Authorizer) bool {
+	for _, a := range authz {
+		if err := a(ctx, req); err != nil {
+			req.CloseWithError(errors.Wrap(err, "forbidden"))
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,97 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type peerKey struct{}
+
+func TestAuthorize(t *testing.T) {
+	r := require.New(t)
+
+	// only friends may call private methods
+	onlyFriends := func(ctx context.Context, req *Request) error {
+		if ctx.Value(peerKey{}) != "@friend" {
+			return errors.New("not a friend")
+		}
+		return nil
+	}
+	noSinks := func(ctx context.Context, req *Request) error {
+		if req.Type == "sink" {
+			return errors.New("sinks are disabled")
+		}
+		return nil
+	}
+
+	var mux HandlerMux
+	mux.Handle([]string{"private"}, Authorize(returnHandler(func(*Request) string { return "secret" }), onlyFriends))
+	mux.Handle([]string{"public"}, returnHandler(func(*Request) string { return "hello" }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := TestCall(ctx, &mux, &Request{Type: "async", Method: []string{"public"}})
+	r.NoError(err)
+	r.Equal([]interface{}{"hello"}, res.Values)
+
+	res, err = TestCall(ctx, &mux, &Request{Type: "async", Method: []string{"private"}})
+	r.NoError(err)
+	r.NotNil(res.Err)
+	r.Equal("forbidden: not a friend", res.Err.Message)
+
+	res, err = TestCall(context.WithValue(ctx, peerKey{}, "@friend"), &mux, &Request{Type: "async", Method: []string{"private"}})
+	r.NoError(err)
+	r.Equal([]interface{}{"secret"}, res.Values)
+
+	// session wide
+	called := make(chan string, 2)
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			called <- req.Method[0]
+			req.Return(ctx, "ok")
+		},
+		connect: noopConnect,
+	}
+	h1 := callerHandler(t)
+
+	rpc1, _, done := serveTestPair(t, h1, h2, WithAuthorizer(noSinks))
+	defer done()
+
+	v, err := rpc1.Async(ctx, "string", []string{"allowed"})
+	r.NoError(err)
+	r.Equal("ok", v)
+
+	sink, err := rpc1.Sink(ctx, []string{"denied"})
+	r.NoError(err)
+	<-sink.(StreamWaiter).RemoteClosed()
+
+	_, err = sink.(Stream).Next(ctx)
+	r.Error(err)
+	r.True(strings.HasPrefix(errors.Cause(err).Error(), "forbidden"), "unexpected error %v", err)
+
+	r.Equal("allowed", <-called)
+	r.Len(called, 0, "handler should not see denied calls")
+}
+
+func TestAuthorizerSkipsInternalCalls(t *testing.T) {
+	denyAll := func(ctx context.Context, req *Request) error {
+		return errors.Errorf("%s is not allowed", methodString(req.Method))
+	}
+
+	h := &testHandler{connect: noopConnect}
+	rpc1, _, done := serveTestPair(t, h, h, WithAuthorizer(denyAll), WithKeepalive(time.Hour, 0))
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := rpc1.(Pinger).Ping(ctx); err != nil {
+		t.Fatalf("expected ping to pass the authorizer, got %v", err)
+	}
+}
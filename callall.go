@@ -0,0 +1,55 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync"
+)
+
+// Call describes an async call for CallAll.
+type Call struct {
+	// Tipe is a value of the type the response should be unmarshaled into
+	Tipe interface{}
+
+	Method []string
+	Args   []interface{}
+}
+
+// Result holds the response of a call made by CallAll.
+type Result struct {
+	Value interface{}
+	Err   error
+}
+
+// CallAll does the async calls concurrently and returns their results in the
+// same order. Errors of individual calls are returned in the respective Result.
+// The returned error is only set if ctx is cancelled before all calls returned.
+func (r *rpc) CallAll(ctx context.Context, calls []Call) ([]Result, error) {
+	var (
+		wg      sync.WaitGroup
+		results = make([]Result, len(calls))
+		done    = make(chan struct{})
+	)
+
+	wg.Add(len(calls))
+	for i := range calls {
+		go func(i int) {
+			defer wg.Done()
+
+			c := calls[i]
+			v, err := r.Async(ctx, c.Tipe, c.Method, c.Args...)
+			results[i] = Result{Value: v, Err: err}
+		}(i)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return results, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,50 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallAll(t *testing.T) {
+	r := require.New(t)
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Method[0] == "fail" {
+				req.Stream.CloseWithError(errors.New("failed on purpose"))
+				return
+			}
+
+			err := req.Return(ctx, req.Method[0])
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	results, err := rpc1.(AsyncCaller).CallAll(context.Background(), []Call{
+		{Tipe: "string", Method: []string{"foo"}},
+		{Tipe: "string", Method: []string{"fail"}},
+		{Tipe: "string", Method: []string{"bar"}},
+	})
+	r.NoError(err)
+	r.Len(results, 3)
+
+	r.NoError(results[0].Err)
+	r.Equal("foo", results[0].Value)
+
+	r.Error(results[1].Err)
+	r.Equal("failed on purpose", errors.Cause(results[1].Err).Error())
+
+	r.NoError(results[2].Err)
+	r.Equal("bar", results[2].Value)
+}
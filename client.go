@@ -0,0 +1,153 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cryptoscope.co/go/luigi"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Client wraps an Endpoint and provides a friendlier interface for making
+// calls. It holds configuration like the default timeout for async calls, the
+// types responses are unmarshaled into and a logger in one place, and adds the
+// called method to returned errors. Use Endpoint for advanced use.
+type Client struct {
+	e Endpoint
+
+	timeout time.Duration
+	logger  log.Logger
+
+	tLock sync.RWMutex
+	types map[string]interface{}
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithCallTimeout sets the timeout of async calls whose context has no deadline.
+func WithCallTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithClientLogger sets the logger failed calls are logged to.
+func WithClientLogger(l log.Logger) ClientOption {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// WithResponseType registers the type responses of method are unmarshaled into.
+func WithResponseType(method []string, tipe interface{}) ClientOption {
+	return func(c *Client) {
+		c.types[methodKey(method)] = tipe
+	}
+}
+
+// NewClient returns a Client that makes calls on e.
+func NewClient(e Endpoint, opts ...ClientOption) *Client {
+	c := &Client{
+		e:      e,
+		logger: log.NewNopLogger(),
+		types:  make(map[string]interface{}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Endpoint returns the wrapped endpoint.
+func (c *Client) Endpoint() Endpoint {
+	return c.e
+}
+
+// RegisterType sets the type responses of method are unmarshaled into.
+func (c *Client) RegisterType(method []string, tipe interface{}) {
+	c.tLock.Lock()
+	defer c.tLock.Unlock()
+
+	c.types[methodKey(method)] = tipe
+}
+
+// Async does an async call. The response is unmarshaled into the type
+// registered for method.
+func (c *Client) Async(ctx context.Context, method []string, args ...interface{}) (interface{}, error) {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	v, err := c.e.Async(ctx, c.typeOf(method), method, args...)
+	return v, c.enrich(err, "async", method)
+}
+
+// Source does a source call. Values are unmarshaled into the type registered
+// for method.
+func (c *Client) Source(ctx context.Context, method []string, args ...interface{}) (luigi.Source, error) {
+	src, err := c.e.Source(ctx, c.typeOf(method), method, args...)
+	return src, c.enrich(err, "source", method)
+}
+
+// Sink does a sink call.
+func (c *Client) Sink(ctx context.Context, method []string, args ...interface{}) (luigi.Sink, error) {
+	sink, err := c.e.Sink(ctx, method, args...)
+	return sink, c.enrich(err, "sink", method)
+}
+
+// Duplex does a duplex call. Values are unmarshaled into the type registered
+// for method.
+func (c *Client) Duplex(ctx context.Context, method []string, args ...interface{}) (luigi.Source, luigi.Sink, error) {
+	src, sink, err := c.e.Duplex(ctx, c.typeOf(method), method, args...)
+	return src, sink, c.enrich(err, "duplex", method)
+}
+
+// typeOf returns the type registered for method, or nil.
+func (c *Client) typeOf(method []string) interface{} {
+	c.tLock.RLock()
+	defer c.tLock.RUnlock()
+
+	return c.types[methodKey(method)]
+}
+
+// enrich adds the call type and method to err and logs it.
+func (c *Client) enrich(err error, tipe CallType, method []string) error {
+	if err == nil {
+		return nil
+	}
+
+	name := methodString(method)
+	c.logger.Log("event", "call failed", "type", tipe, "method", name, "error", err)
+
+	return errors.Wrapf(err, "muxrpc: %s call %s failed", tipe, name)
+}
+
+// methodString returns the dotted form of method, e.g. "blobs.get".
+func methodString(method []string) string {
+	return strings.Join(method, ".")
+}
+
+// methodKey returns a string that identifies method, for use as a map key.
+// Other than methodString it prefixes every name with its length, so names
+// containing dots don't collide, e.g. ["a.b"] and ["a", "b"].
+func methodKey(method []string) string {
+	var buf bytes.Buffer
+	for _, name := range method {
+		buf.WriteString(strconv.Itoa(len(name)))
+		buf.WriteByte(':')
+		buf.WriteString(name)
+	}
+
+	return buf.String()
+}
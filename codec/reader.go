@@ -25,9 +25,26 @@ import (
 	"github.com/pkg/errors"
 )
 
-type Reader struct{ r io.Reader }
+// DefaultMaxBodySize is the largest packet body NewReader accepts.
+const DefaultMaxBodySize = 16 << 20
 
-func NewReader(r io.Reader) *Reader { return &Reader{r} }
+// ErrBodyTooLarge is returned by ReadPacket if a header announces a body
+// larger than the reader's limit. The rest of the stream can't be framed after
+// that, so the connection should be closed.
+var ErrBodyTooLarge = errors.New("pkt-codec: body too large")
+
+type Reader struct {
+	r   io.Reader
+	max uint32
+}
+
+// NewReader creates a new packet-stream reader that accepts bodies of up to
+// DefaultMaxBodySize bytes.
+func NewReader(r io.Reader) *Reader { return NewReaderWithLimit(r, DefaultMaxBodySize) }
+
+// NewReaderWithLimit is like NewReader but accepts bodies of up to max bytes.
+// A max of 0 disables the limit.
+func NewReaderWithLimit(r io.Reader, max uint32) *Reader { return &Reader{r: r, max: max} }
 
 // ReadPacket decodes the header from the underlying writer, and reads as many bytes as specified in it
 // TODO: pass in packet pointer as arg to reduce allocations
@@ -40,6 +57,11 @@ func (r *Reader) ReadPacket() (*Packet, error) {
 		return nil, errors.Wrapf(err, "pkt-codec: header read failed")
 	}
 
+	// check before allocating the body
+	if r.max > 0 && hdr.Len > r.max {
+		return nil, errors.Wrapf(ErrBodyTooLarge, "%d bytes exceed the limit of %d", hdr.Len, r.max)
+	}
+
 	// detect EOF pkt. TODO: not sure how to do this nicer
 	if hdr.Flag == 0 && hdr.Len == 0 && hdr.Req == 0 {
 		return nil, io.EOF
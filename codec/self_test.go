@@ -20,8 +20,11 @@ package codec
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 var testPkts = []Packet{
@@ -70,3 +73,89 @@ func TestSelf(t *testing.T) {
 	}
 	t.Logf("done. tested %d pkts", i)
 }
+
+func TestReaderLimit(t *testing.T) {
+	// a header announcing a body of 4GB, without the body
+	hdr := []byte{byte(FlagJSON), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1}
+
+	_, err := NewReader(bytes.NewReader(hdr)).ReadPacket()
+	if errors.Cause(err) != ErrBodyTooLarge {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	if err := w.WritePacket(&Packet{Flag: FlagString, Req: 1, Body: []byte("four")}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewReaderWithLimit(bytes.NewReader(b.Bytes()), 3).ReadPacket()
+	if errors.Cause(err) != ErrBodyTooLarge {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+
+	pkt, err := NewReaderWithLimit(bytes.NewReader(b.Bytes()), 4).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pkt.Body) != "four" {
+		t.Errorf("expected body %q, got %q", "four", pkt.Body)
+	}
+}
+
+func BenchmarkWritePacket(b *testing.B) {
+	w := NewWriter(ioutil.Discard)
+	pkt := &Packet{
+		Flag: FlagJSON | FlagStream,
+		Req:  23,
+		Body: []byte(`{"name":["whoami"],"args":[],"type":"async"}`),
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(headerLength + len(pkt.Body)))
+
+	for i := 0; i < b.N; i++ {
+		if err := w.WritePacket(pkt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// writeCounter counts the calls to Write, which stand for syscalls.
+type writeCounter int
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	*c++
+	return len(p), nil
+}
+
+func BenchmarkWriteCoalescing(b *testing.B) {
+	pkt := &Packet{Flag: FlagString | FlagStream, Req: 23, Body: []byte("chatty")}
+
+	for _, size := range []int{0, 4096} {
+		name := "direct"
+		if size > 0 {
+			name = "buffered"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var writes writeCounter
+			w := NewWriter(&writes)
+			if size > 0 {
+				w = NewBufferedWriter(&writes, size)
+			}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := w.WritePacket(pkt); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.Logf("%.3f writes/op", float64(writes)/float64(b.N))
+		})
+	}
+}
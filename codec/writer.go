@@ -18,39 +18,111 @@ along with go-muxrpc.  If not, see <http://www.gnu.org/licenses/>.
 package codec
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
 	"io"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
-type Writer struct{ w io.Writer }
+// headerLength is the size of an encoded Header.
+const headerLength = 9
+
+// headerPool holds scratch buffers for encoding headers, so writing a packet
+// doesn't allocate.
+var headerPool = sync.Pool{
+	New: func() interface{} { return new([headerLength]byte) },
+}
+
+type Writer struct {
+	w io.Writer
+
+	// buf coalesces packets before they are written to w. nil unless the
+	// writer was created by NewBufferedWriter.
+	buf *bufio.Writer
+}
 
 // NewWriter creates a new packet-stream writer
-func NewWriter(w io.Writer) *Writer { return &Writer{w} }
+func NewWriter(w io.Writer) *Writer { return &Writer{w: w} }
+
+// NewBufferedWriter creates a packet-stream writer that collects packets in a
+// buffer of size bytes and only writes them to w once the buffer is full or
+// Flush is called. This saves a write call per packet when sending many small
+// packets, at the cost of latency if nobody flushes.
+func NewBufferedWriter(w io.Writer, size int) *Writer {
+	return &Writer{w: w, buf: bufio.NewWriterSize(w, size)}
+}
+
+// out returns the writer packets are written to.
+func (w *Writer) out() io.Writer {
+	if w.buf != nil {
+		return w.buf
+	}
+
+	return w.w
+}
 
 // WritePacket creates an header for the Packet and writes it and the body to the underlying writer
 func (w *Writer) WritePacket(r *Packet) error {
-	var hdr Header
-	hdr.Flag = r.Flag
-	hdr.Len = uint32(len(r.Body))
-	hdr.Req = r.Req
-	if err := binary.Write(w.w, binary.BigEndian, hdr); err != nil {
+	hdr := headerPool.Get().(*[headerLength]byte)
+	defer headerPool.Put(hdr)
+
+	hdr[0] = byte(r.Flag)
+	binary.BigEndian.PutUint32(hdr[1:5], uint32(len(r.Body)))
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(r.Req))
+
+	out := w.out()
+	if _, err := out.Write(hdr[:]); err != nil {
 		return errors.Wrapf(err, "pkt-codec: header write failed")
 	}
-	if _, err := io.Copy(w.w, bytes.NewReader(r.Body)); err != nil {
-		return errors.Wrapf(err, "pkt-codec: body write failed")
+
+	// the body is never copied into pooled memory
+	if len(r.Body) > 0 {
+		if _, err := out.Write(r.Body); err != nil {
+			return errors.Wrapf(err, "pkt-codec: body write failed")
+		}
 	}
 	return nil
 }
 
+// Buffered returns the number of bytes waiting to be flushed by a writer
+// created by NewBufferedWriter.
+func (w *Writer) Buffered() int {
+	if w.buf == nil {
+		return 0
+	}
+
+	return w.buf.Buffered()
+}
+
+// Flush writes out the packets buffered by a writer created by
+// NewBufferedWriter. Then it flushes the underlying writer, if that has a
+// Flush method like bufio.Writer.
+func (w *Writer) Flush() error {
+	if w.buf != nil {
+		if err := w.buf.Flush(); err != nil {
+			return errors.Wrap(err, "pkt-codec: flush failed")
+		}
+	}
+
+	f, ok := w.w.(interface{ Flush() error })
+	if !ok {
+		return nil
+	}
+
+	return errors.Wrap(f.Flush(), "pkt-codec: flush failed")
+}
+
 // Close sends 9 zero bytes and also closes it's underlying writer if it is also an io.Closer
 func (w *Writer) Close() error {
-	_, err := w.w.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0})
+	_, err := w.out().Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0})
 	if err != nil {
 		return errors.Wrapf(err, "pkt-codec: failed to write Close() packet")
 	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
 	if c, ok := w.w.(io.Closer); ok {
 		return c.Close()
 	}
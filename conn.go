@@ -0,0 +1,163 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"cryptoscope.co/go/luigi"
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+)
+
+// NewDuplexConn returns an io.ReadWriteCloser that reads the bodies of the
+// binary packets received on src and sends written data as binary packets on
+// sink. Element boundaries are not preserved, the packets are treated as one
+// continuous byte stream. Closing it closes the sink.
+//
+// This allows running a nested session over a duplex call, like the
+// tunnel.connect call used by SSB rooms:
+//
+//	src, sink, err := e.Duplex(ctx, codec.Body{}, []string{"tunnel", "connect"}, args)
+//	inner := Handle(NewPacker(NewDuplexConn(ctx, src, sink)), handler)
+//
+// If the session the duplex call belongs to ends, reading returns io.EOF, so
+// the inner session shuts down with it and its Serve returns nil instead of a
+// read error.
+func NewDuplexConn(ctx context.Context, src luigi.Source, sink luigi.Sink) io.ReadWriteCloser {
+	return &duplexConn{
+		sourceReader: sourceReader{
+			ctx: ctx,
+			src: src,
+		},
+		sinkWriter: sinkWriter{
+			ctx:  ctx,
+			sink: sink,
+		},
+	}
+}
+
+// duplexConn implements the io.ReadWriteCloser returned by NewDuplexConn.
+type duplexConn struct {
+	sourceReader
+	sinkWriter
+}
+
+// Read reads data received on the source.
+func (c *duplexConn) Read(p []byte) (int, error) {
+	n, err := c.sourceReader.Read(p)
+	if errors.Cause(err) == ErrSessionTerminated {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// NewSourceReader returns an io.Reader that reads the bodies of the binary
+// packets received on src, e.g. the source of a blob transfer, as one
+// continuous byte stream. Reading returns io.EOF once the stream ended. If the
+// remote ended it with an error, that error is returned instead; its cause is
+// the *CallError.
+func NewSourceReader(src luigi.Source) io.Reader {
+	return &sourceReader{
+		ctx: context.Background(),
+		src: src,
+	}
+}
+
+// sourceReader implements the io.Reader returned by NewSourceReader.
+type sourceReader struct {
+	ctx context.Context
+
+	l   sync.Mutex
+	src luigi.Source
+	// buf holds data of the last packet that has not been read yet
+	buf []byte
+}
+
+// Read reads data received on the source.
+func (c *sourceReader) Read(p []byte) (int, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	for len(c.buf) == 0 {
+		v, err := c.src.Next(c.ctx)
+		if luigi.IsEOS(err) {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, errors.Wrap(err, "error reading from source")
+		}
+
+		switch data := v.(type) {
+		case []byte:
+			c.buf = data
+		case codec.Body:
+			c.buf = data
+		case string:
+			c.buf = []byte(data)
+		default:
+			return 0, errors.Errorf("expected binary data, got %T", v)
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+// NewSinkWriter returns an io.WriteCloser that sends written data as binary
+// packets on sink, e.g. the sink of a blob upload, so it can be the
+// destination of io.Copy. Writes are split into packets of at most chunkSize
+// bytes; a chunkSize <= 0 sends every write as a single packet. Closing it
+// closes the sink, which ends the stream.
+func NewSinkWriter(sink luigi.Sink, chunkSize int) io.WriteCloser {
+	return &sinkWriter{
+		ctx:       context.Background(),
+		sink:      sink,
+		chunkSize: chunkSize,
+	}
+}
+
+// sinkWriter implements the io.WriteCloser returned by NewSinkWriter.
+type sinkWriter struct {
+	ctx  context.Context
+	sink luigi.Sink
+
+	// chunkSize is the maximum packet size if > 0
+	chunkSize int
+}
+
+// Write sends p as binary packets of at most chunkSize bytes. If sending
+// fails, it returns the number of bytes of the packets sent before.
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		n := len(p)
+		if w.chunkSize > 0 && n > w.chunkSize {
+			n = w.chunkSize
+		}
+
+		// the caller may reuse p after we return, but the packet may still be
+		// in a buffer at that point.
+		body := make(codec.Body, n)
+		copy(body, p)
+
+		err := w.sink.Pour(w.ctx, body)
+		if err != nil {
+			return written, errors.Wrap(err, "error pouring to sink")
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close closes the sink.
+func (w *sinkWriter) Close() error {
+	return w.sink.Close()
+}
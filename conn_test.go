@@ -0,0 +1,229 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplexConnTunnel(t *testing.T) {
+	r := require.New(t)
+
+	innerHandler := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Return(ctx, "tunneled")
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	serverDone := make(chan struct{})
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			defer close(serverDone)
+
+			inner := Handle(NewPacker(NewDuplexConn(ctx, req.Stream, req.Stream)), innerHandler)
+			err := inner.(*rpc).Serve(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	src, sink, err := rpc1.Duplex(ctx, codec.Body{}, []string{"tunnel", "connect"})
+	r.NoError(err)
+
+	inner := Handle(NewPacker(NewDuplexConn(ctx, src, sink)), &testHandler{connect: noopConnect})
+	go inner.(*rpc).Serve(ctx)
+
+	v, err := inner.Async(ctx, "string", []string{"whoami"})
+	r.NoError(err)
+	r.Equal("tunneled", v)
+
+	r.NoError(inner.Terminate())
+	<-serverDone
+}
+
+func TestDuplexConnParentTerminated(t *testing.T) {
+	innerHandler := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			req.Return(ctx, "tunneled")
+		},
+		connect: noopConnect,
+	}
+
+	innerServed := make(chan error, 2)
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			inner := Handle(NewPacker(NewDuplexConn(ctx, req.Stream, req.Stream)), innerHandler)
+			innerServed <- inner.(*rpc).Serve(context.Background())
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+
+	ctx := context.Background()
+	src, sink, err := rpc1.Duplex(ctx, codec.Body{}, []string{"tunnel", "connect"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := Handle(NewPacker(NewDuplexConn(ctx, src, sink)), &testHandler{connect: noopConnect})
+	go func() {
+		innerServed <- inner.(*rpc).Serve(context.Background())
+	}()
+
+	v, err := inner.Async(ctx, "string", []string{"whoami"})
+	if err != nil || v != "tunneled" {
+		t.Fatalf("expected tunneled reply, got %v, %v", v, err)
+	}
+
+	// terminating the outer sessions ends the inner ones
+	done()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-innerServed:
+			if err != nil {
+				t.Errorf("expected inner session to end cleanly, got %+v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("inner session still running after outer session ended")
+		}
+	}
+}
+
+func TestSourceReader(t *testing.T) {
+	r := require.New(t)
+
+	payload := make([]byte, 3<<20)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	h1 := &testHandler{connect: noopConnect}
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Method[0] == "broken" {
+				req.Stream.Pour(ctx, codec.Body("partial"))
+				req.CloseWithError(errors.New("disk on fire"))
+				return
+			}
+
+			CopyToSink(ctx, req.Stream, bytes.NewReader(payload), 64<<10)
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+
+	src, err := rpc1.Source(ctx, codec.Body{}, []string{"blob"})
+	r.NoError(err)
+
+	// small reads make the reader buffer the rest of each packet
+	var (
+		got []byte
+		buf = make([]byte, 1000)
+		rd  = NewSourceReader(src)
+	)
+	for {
+		n, err := rd.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		r.NoError(err)
+	}
+	r.True(bytes.Equal(payload, got), "payload corrupted")
+
+	src, err = rpc1.Source(ctx, codec.Body{}, []string{"broken"})
+	r.NoError(err)
+
+	got, err = ioutil.ReadAll(NewSourceReader(src))
+	r.Equal("partial", string(got))
+	callErr, ok := errors.Cause(err).(*CallError)
+	r.True(ok, "expected call error, got %v", err)
+	r.Equal("disk on fire", callErr.Message)
+}
+
+func TestSinkWriter(t *testing.T) {
+	r := require.New(t)
+
+	const chunkSize = 4096
+	payload := make([]byte, 1<<20+123)
+	for i := range payload {
+		payload[i] = byte(i * 13)
+	}
+
+	received := make(chan []byte, 1)
+	h1 := &testHandler{connect: noopConnect}
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			var data []byte
+			for {
+				v, err := req.Stream.Next(ctx)
+				if err != nil {
+					break
+				}
+
+				body := v.([]byte)
+				if len(body) > chunkSize {
+					t.Errorf("packet of %d bytes exceeds chunk size", len(body))
+				}
+				data = append(data, body...)
+			}
+
+			req.Stream.Close()
+			received <- data
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	sink, err := rpc1.Sink(context.Background(), []string{"upload"})
+	r.NoError(err)
+
+	w := NewSinkWriter(sink, chunkSize)
+	n, err := io.Copy(w, bytes.NewReader(payload))
+	r.NoError(err)
+	r.Equal(int64(len(payload)), n)
+	r.NoError(w.Close())
+
+	select {
+	case data := <-received:
+		r.True(bytes.Equal(payload, data), "payload corrupted")
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload did not end")
+	}
+
+	// writing after close fails without counting anything as written
+	n2, err := w.Write([]byte("late"))
+	r.Error(err)
+	r.Equal(0, n2)
+}
@@ -0,0 +1,210 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"io"
+	"reflect"
+
+	"cryptoscope.co/go/luigi"
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+)
+
+// CopyToSink reads r in chunks of at most chunkSize bytes and pours them as
+// binary packets into sink until r returns io.EOF, then closes sink. If
+// reading fails, sink is closed with the error, so the remote gets a CallError.
+//
+// This is useful for serving blobs:
+//
+//	f, err := os.Open(path)
+//	...
+//	err = CopyToSink(ctx, req.Stream, f, 4096)
+func CopyToSink(ctx context.Context, sink luigi.Sink, r io.Reader, chunkSize int) error {
+	if chunkSize <= 0 {
+		return errors.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	for {
+		// the sink may hold on to the buffer, so we can't reuse it
+		buf := make([]byte, chunkSize)
+
+		n, rErr := r.Read(buf)
+		if n > 0 {
+			err := sink.Pour(ctx, codec.Body(buf[:n]))
+			if err != nil {
+				return errors.Wrap(err, "error pouring to sink")
+			}
+		}
+
+		if rErr == io.EOF {
+			return errors.Wrap(sink.Close(), "error closing sink")
+		} else if rErr != nil {
+			closeWithError(sink, rErr)
+			return errors.Wrap(rErr, "error reading")
+		}
+	}
+}
+
+// CopyFromSource writes the binary packets read from src to w until src
+// returns end-of-stream, and returns the number of bytes written. If the
+// stream ends with an error, that error is returned after everything that
+// arrived before was written. Non-binary packets result in an error.
+func CopyFromSource(ctx context.Context, w io.Writer, src luigi.Source) (int64, error) {
+	var written int64
+
+	for {
+		v, err := src.Next(ctx)
+		if luigi.IsEOS(err) {
+			return written, nil
+		} else if err != nil {
+			return written, errors.Wrap(err, "error reading from source")
+		}
+
+		var data []byte
+		switch body := v.(type) {
+		case []byte:
+			data = body
+		case codec.Body:
+			data = body
+		default:
+			return written, errors.Errorf("expected binary data, got %T", v)
+		}
+
+		n, err := w.Write(data)
+		written += int64(n)
+		if err == nil && n < len(data) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return written, errors.Wrap(err, "error writing")
+		}
+	}
+}
+
+// SourceFromSlice pours the values in vals into sink, e.g. the stream of a
+// source call, and closes it. Each value is encoded like in Pour. If pouring
+// fails, sink is closed with the error and it is returned.
+func SourceFromSlice(ctx context.Context, sink luigi.Sink, vals []interface{}) error {
+	for _, v := range vals {
+		err := sink.Pour(ctx, v)
+		if err != nil {
+			closeWithError(sink, err)
+			return errors.Wrap(err, "error pouring to sink")
+		}
+	}
+
+	return errors.Wrap(sink.Close(), "error closing sink")
+}
+
+// SourceFromChan pours the values received on ch into sink until ch is
+// closed, then closes sink. If pouring fails or ctx is done before, sink is
+// closed with the error and it is returned.
+func SourceFromChan(ctx context.Context, sink luigi.Sink, ch <-chan interface{}) error {
+	for {
+		select {
+		case v, ok := <-ch:
+			if !ok {
+				return errors.Wrap(sink.Close(), "error closing sink")
+			}
+
+			err := sink.Pour(ctx, v)
+			if err != nil {
+				closeWithError(sink, err)
+				return errors.Wrap(err, "error pouring to sink")
+			}
+		case <-ctx.Done():
+			closeWithError(sink, ctx.Err())
+			return ctx.Err()
+		}
+	}
+}
+
+// closeWithError closes sink with err if it supports that, and normally if not.
+func closeWithError(sink luigi.Sink, err error) {
+	if ec, ok := sink.(luigi.ErrorCloser); ok {
+		ec.CloseWithError(err)
+	} else {
+		sink.Close()
+	}
+}
+
+// SourceInto does a source call on e and sends the received values on ch,
+// which must be a channel of some type T, e.g. a chan Message. JSON values
+// are decoded into T; string and binary values are converted to T if
+// possible. ch is closed when the stream ends.
+//
+// The returned channel receives the error the stream ended with, if any, and
+// is closed after ch. If ctx is done, the call is cancelled on both sides and
+// the error of ctx is returned.
+//
+// This stands in for a generic SourceOf[T] until the module requires a Go
+// version with type parameters.
+func SourceInto(ctx context.Context, e Endpoint, ch interface{}, method []string, args ...interface{}) <-chan error {
+	errc := make(chan error, 1)
+
+	chv := reflect.ValueOf(ch)
+	if chv.Kind() != reflect.Chan || chv.Type().ChanDir()&reflect.SendDir == 0 {
+		errc <- errors.Errorf("SourceInto needs a channel to send on, got %T", ch)
+		close(errc)
+		return errc
+	}
+	elem := chv.Type().Elem()
+
+	src, err := e.Source(ctx, reflect.Zero(elem).Interface(), method, args...)
+	if err != nil {
+		chv.Close()
+		errc <- errors.Wrap(err, "error starting source call")
+		close(errc)
+		return errc
+	}
+
+	go func() {
+		defer close(errc)
+		defer chv.Close()
+
+		for {
+			v, err := src.Next(ctx)
+			if luigi.IsEOS(err) {
+				return
+			} else if err != nil {
+				errc <- err
+				return
+			}
+
+			rv, err := convertTo(v, elem)
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			chosen, _, _ := reflect.Select([]reflect.SelectCase{
+				{Dir: reflect.SelectSend, Chan: chv, Send: rv},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			})
+			if chosen == 1 {
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return errc
+}
+
+// convertTo returns v as a value of type t.
+func convertTo(v interface{}, t reflect.Type) (reflect.Value, error) {
+	if v == nil {
+		return reflect.Zero(t), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Type().AssignableTo(t):
+		return rv, nil
+	case rv.Type().ConvertibleTo(t) && rv.Kind() == t.Kind():
+		return rv.Convert(t), nil
+	}
+
+	return reflect.Value{}, errors.Errorf("can't store %T in %s", v, t)
+}
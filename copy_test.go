@@ -0,0 +1,273 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"cryptoscope.co/go/luigi"
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("disk on fire")
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestCopyToSink(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	iSrc, _ := luigi.NewPipe()
+	oSrc, oSink := luigi.NewPipe(luigi.WithBuffer(8))
+	str := NewStream(iSrc, oSink, 23, false, true)
+
+	r.NoError(CopyToSink(ctx, str, bytes.NewReader([]byte("hello world")), 4))
+
+	var got []byte
+	for {
+		v, err := oSrc.Next(ctx)
+		r.NoError(err)
+
+		pkt := v.(*codec.Packet)
+		if pkt.Flag.Get(codec.FlagEndErr) {
+			r.True(isTrue(pkt.Body), "expected okay end, got %s", pkt.Body)
+			break
+		}
+
+		r.False(pkt.Flag.Get(codec.FlagJSON) || pkt.Flag.Get(codec.FlagString), "expected binary packet")
+		r.True(len(pkt.Body) <= 4, "chunk too large")
+		got = append(got, pkt.Body...)
+	}
+	r.Equal("hello world", string(got))
+
+	// failing reader
+	iSrc, _ = luigi.NewPipe()
+	oSrc, oSink = luigi.NewPipe(luigi.WithBuffer(8))
+	str = NewStream(iSrc, oSink, 23, false, true)
+
+	err := CopyToSink(ctx, str, &failingReader{data: []byte("abc")}, 4)
+	r.Error(err)
+
+	v, err := oSrc.Next(ctx)
+	r.NoError(err)
+	r.Equal("abc", string(v.(*codec.Packet).Body))
+
+	v, err = oSrc.Next(ctx)
+	r.NoError(err)
+	pkt := v.(*codec.Packet)
+	r.True(pkt.Flag.Get(codec.FlagEndErr), "expected end packet")
+	callErr, err := parseError(pkt.Body)
+	r.NoError(err)
+	r.Equal("disk on fire", callErr.Message)
+}
+
+func TestCopyFromSource(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	mkStream := func(pkts ...*codec.Packet) Stream {
+		iSrc, iSink := luigi.NewPipe(luigi.WithBuffer(len(pkts)))
+		for _, pkt := range pkts {
+			r.NoError(iSink.Pour(ctx, pkt))
+		}
+		iSink.Close()
+
+		_, oSink := luigi.NewPipe()
+		return NewStream(iSrc, oSink, 23, true, false)
+	}
+
+	var buf bytes.Buffer
+	n, err := CopyFromSource(ctx, &buf, mkStream(
+		&codec.Packet{Req: 23, Flag: codec.FlagStream, Body: []byte("hello ")},
+		&codec.Packet{Req: 23, Flag: codec.FlagStream, Body: []byte("world")},
+	))
+	r.NoError(err)
+	r.Equal(int64(11), n)
+	r.Equal("hello world", buf.String())
+
+	// the stream ends with an error
+	iSrc, iSink := luigi.NewPipe(luigi.WithBuffer(1))
+	r.NoError(iSink.Pour(ctx, &codec.Packet{Req: 23, Flag: codec.FlagStream, Body: []byte("abc")}))
+	iSink.(luigi.ErrorCloser).CloseWithError(&CallError{Name: "Error", Message: "no such blob"})
+	_, oSink := luigi.NewPipe()
+
+	buf.Reset()
+	n, err = CopyFromSource(ctx, &buf, NewStream(iSrc, oSink, 23, true, false))
+	r.Equal(int64(3), n)
+	r.Equal("abc", buf.String())
+	callErr, ok := errors.Cause(err).(*CallError)
+	r.True(ok, "expected call error, got %v", err)
+	r.Equal("no such blob", callErr.Message)
+
+	// non-binary packets
+	buf.Reset()
+	_, err = CopyFromSource(ctx, &buf, mkStream(
+		&codec.Packet{Req: 23, Flag: codec.FlagStream | codec.FlagString, Body: []byte("text")},
+	))
+	r.Error(err)
+
+	// writers that don't take all data without an error
+	n, err = CopyFromSource(ctx, shortWriter{}, mkStream(
+		&codec.Packet{Req: 23, Flag: codec.FlagStream, Body: []byte("abc")},
+	))
+	r.Equal(int64(1), n)
+	r.Equal(io.ErrShortWrite, errors.Cause(err))
+}
+
+// shortWriter writes at most one byte and doesn't report an error.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) {
+	if len(p) > 1 {
+		return 1, nil
+	}
+
+	return len(p), nil
+}
+
+func TestSourceFromSlice(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	iSrc, _ := luigi.NewPipe()
+	oSrc, oSink := luigi.NewPipe(luigi.WithBuffer(8))
+	str := NewStream(iSrc, oSink, 23, false, true)
+
+	r.NoError(SourceFromSlice(ctx, str, []interface{}{"a", map[string]int{"b": 1}}))
+
+	v, err := oSrc.Next(ctx)
+	r.NoError(err)
+	r.Equal("a", string(v.(*codec.Packet).Body))
+
+	v, err = oSrc.Next(ctx)
+	r.NoError(err)
+	r.True(v.(*codec.Packet).Flag.Get(codec.FlagJSON), "expected JSON packet")
+	r.Equal(`{"b":1}`, string(v.(*codec.Packet).Body))
+
+	v, err = oSrc.Next(ctx)
+	r.NoError(err)
+	r.True(v.(*codec.Packet).Flag.Get(codec.FlagEndErr), "expected end packet")
+	r.True(isTrue(v.(*codec.Packet).Body), "expected okay end")
+
+	// values that can't be encoded end the stream with an error
+	iSrc, _ = luigi.NewPipe()
+	oSrc, oSink = luigi.NewPipe(luigi.WithBuffer(8))
+	str = NewStream(iSrc, oSink, 23, false, true)
+
+	r.Error(SourceFromSlice(ctx, str, []interface{}{"a", func() {}}))
+
+	_, err = oSrc.Next(ctx)
+	r.NoError(err)
+
+	v, err = oSrc.Next(ctx)
+	r.NoError(err)
+	r.True(v.(*codec.Packet).Flag.Get(codec.FlagEndErr), "expected end packet")
+	r.False(isTrue(v.(*codec.Packet).Body), "expected error end")
+}
+
+func TestSourceFromChan(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	iSrc, _ := luigi.NewPipe()
+	oSrc, oSink := luigi.NewPipe(luigi.WithBuffer(8))
+	str := NewStream(iSrc, oSink, 23, false, true)
+
+	ch := make(chan interface{}, 2)
+	ch <- "a"
+	ch <- "b"
+	close(ch)
+	r.NoError(SourceFromChan(ctx, str, ch))
+
+	for _, exp := range []string{"a", "b"} {
+		v, err := oSrc.Next(ctx)
+		r.NoError(err)
+		r.Equal(exp, string(v.(*codec.Packet).Body))
+	}
+
+	v, err := oSrc.Next(ctx)
+	r.NoError(err)
+	r.True(isTrue(v.(*codec.Packet).Body), "expected okay end")
+
+	// a cancelled context ends the stream with its error
+	iSrc, _ = luigi.NewPipe()
+	oSrc, oSink = luigi.NewPipe(luigi.WithBuffer(8))
+	str = NewStream(iSrc, oSink, 23, false, true)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	r.Equal(context.Canceled, SourceFromChan(cctx, str, make(chan interface{})))
+
+	v, err = oSrc.Next(ctx)
+	r.NoError(err)
+	callErr, err := parseError(v.(*codec.Packet).Body)
+	r.NoError(err)
+	r.Equal(context.Canceled.Error(), callErr.Message)
+}
+
+func TestSourceInto(t *testing.T) {
+	r := require.New(t)
+
+	type item struct {
+		N int `json:"n"`
+	}
+
+	h1 := &testHandler{connect: noopConnect}
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Method[0] == "forever" {
+				for i := 0; req.Stream.Pour(ctx, item{i}) == nil; i++ {
+					select {
+					case <-req.Stream.(StreamWaiter).RemoteClosed():
+						return
+					default:
+					}
+				}
+				return
+			}
+
+			SourceFromSlice(ctx, req.Stream, []interface{}{item{1}, item{2}, item{3}})
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ch := make(chan item)
+	errc := SourceInto(context.Background(), rpc1, ch, []string{"items"})
+
+	var got []item
+	for it := range ch {
+		got = append(got, it)
+	}
+	r.Equal([]item{{1}, {2}, {3}}, got)
+	r.NoError(<-errc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch = make(chan item)
+	errc = SourceInto(ctx, rpc1, ch, []string{"forever"})
+
+	<-ch
+	cancel()
+	for range ch {
+	}
+	r.Equal(context.Canceled, errors.Cause(<-errc))
+
+	errc = SourceInto(context.Background(), rpc1, make(<-chan item), []string{"items"})
+	r.Error(<-errc, "expected receive-only channel to be rejected")
+}
@@ -0,0 +1,50 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"encoding/json"
+
+	"cryptoscope.co/go/muxrpc/codec"
+)
+
+// Codec encodes the values sent in a session: requests including their
+// arguments, and the values sent on streams and as replies. Strings and
+// codec.Body values are sent as they are, and end and error packets are
+// always JSON, as the protocol requires. Both peers must use the same codec.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+
+	// Flag returns the type flag of the packets the codec encodes:
+	// codec.FlagJSON, or zero for binary encodings. Packets of binary
+	// encodings are sent with both codec.FlagString and codec.FlagJSON set,
+	// so they are not mistaken for raw codec.Body values.
+	Flag() codec.Flag
+}
+
+// JSONCodec encodes values as JSON. It is the default and the only codec
+// other muxrpc implementations understand.
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Flag() codec.Flag                           { return codec.FlagJSON }
+
+// flagBinaryCodec marks packets encoded by a codec whose Flag is zero. No
+// other packet has both the string and the JSON flag set.
+const flagBinaryCodec = codec.FlagString | codec.FlagJSON
+
+// codecFlag returns the type flag of the packets encoded by enc.
+func codecFlag(enc Codec) codec.Flag {
+	if f := enc.Flag(); f != 0 {
+		return f
+	}
+
+	return flagBinaryCodec
+}
+
+// typeFlag returns the flags of f that tell how the body is encoded.
+func typeFlag(f codec.Flag) codec.Flag {
+	return f & (codec.FlagString | codec.FlagJSON)
+}
@@ -0,0 +1,91 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// prefixCodec is a binary codec that prepends an x to JSON, so values only
+// decode if both sides use it.
+type prefixCodec struct {
+	marshaled, unmarshaled int32
+}
+
+func (c *prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt32(&c.marshaled, 1)
+
+	data, err := json.Marshal(v)
+	return append([]byte{'x'}, data...), err
+}
+
+func (c *prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	atomic.AddInt32(&c.unmarshaled, 1)
+
+	if len(data) == 0 || data[0] != 'x' {
+		return errors.New("missing prefix")
+	}
+
+	return json.Unmarshal(data[1:], v)
+}
+
+func (c *prefixCodec) Flag() codec.Flag { return 0 }
+
+func TestCodec(t *testing.T) {
+	r := require.New(t)
+
+	type point struct{ X, Y int }
+
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			arg, ok := req.Args[0].(map[string]interface{})
+			if !ok {
+				req.CloseWithError(errors.Errorf("expected object argument, got %T", req.Args[0]))
+				return
+			}
+			p := point{int(arg["X"].(float64)), int(arg["Y"].(float64))}
+
+			if req.Type == Source {
+				req.Stream.Pour(ctx, point{p.Y, p.X})
+				req.Stream.Pour(ctx, codec.Body("raw"))
+				req.Stream.Close()
+				return
+			}
+
+			req.Return(ctx, point{p.X + 1, p.Y + 1})
+		},
+		connect: noopConnect,
+	}
+
+	enc := &prefixCodec{}
+	rpc1, _, done := serveTestPair(t, &testHandler{connect: noopConnect}, h, WithCodec(enc))
+	defer done()
+
+	ctx := context.Background()
+
+	var p point
+	err := rpc1.(AsyncCaller).AsyncInto(ctx, &p, []string{"inc"}, point{1, 2})
+	r.NoError(err)
+	r.Equal(point{2, 3}, p)
+
+	src, err := rpc1.Source(ctx, point{}, []string{"swap"}, point{1, 2})
+	r.NoError(err)
+
+	v, err := src.Next(ctx)
+	r.NoError(err)
+	r.Equal(point{2, 1}, v)
+
+	// raw bodies are not mistaken for values of the binary codec
+	v, err = src.Next(ctx)
+	r.NoError(err)
+	r.Equal([]byte("raw"), v)
+
+	r.True(atomic.LoadInt32(&enc.marshaled) >= 4, "expected requests and replies to be marshaled by the codec")
+	r.True(atomic.LoadInt32(&enc.unmarshaled) >= 4, "expected requests and replies to be unmarshaled by the codec")
+}
@@ -2,11 +2,18 @@ package muxrpc // import "cryptoscope.co/go/muxrpc"
 
 import (
 	"context"
+	"net"
+	"time"
 
 	"cryptoscope.co/go/luigi"
 )
 
 // Endpoint allows calling functions on the RPC peer.
+// Its methods are safe for concurrent use, so one Endpoint can be shared by
+// many goroutines making calls at the same time.
+//
+// The endpoints returned by Handle implement the optional interfaces below
+// as well. Use a type assertion to reach them.
 type Endpoint interface {
 	// The different call types:
 	Async(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (interface{}, error)
@@ -20,3 +27,93 @@ type Endpoint interface {
 	// Terminate wraps up the RPC session
 	Terminate() error
 }
+
+// Caller is implemented by endpoints that can make a call of any type.
+type Caller interface {
+	// Call does a call of type typ and returns the request to use its stream
+	Call(ctx context.Context, typ CallType, tipe interface{}, method []string, args ...interface{}) (*Request, error)
+}
+
+// AsyncCaller is implemented by endpoints that offer variants of Async.
+type AsyncCaller interface {
+	// AsyncWithMeta is like Async but also returns information about the reply
+	AsyncWithMeta(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (interface{}, *ResponseMeta, error)
+
+	// AsyncInto is like Async but unmarshals the reply into dst
+	AsyncInto(ctx context.Context, dst interface{}, method []string, args ...interface{}) error
+
+	// AsyncBytes is like Async but returns the reply body without decoding it
+	AsyncBytes(ctx context.Context, method []string, args ...interface{}) ([]byte, error)
+
+	// CallAll does several async calls concurrently
+	CallAll(ctx context.Context, calls []Call) ([]Result, error)
+}
+
+// Shutdowner is implemented by endpoints that can wind down a session
+// instead of cutting it off.
+type Shutdowner interface {
+	// CancelMethod ends all pending requests for method with err
+	CancelMethod(method []string, err error) int
+
+	// Goodbye tells the peer why the session ends and terminates it
+	Goodbye(ctx context.Context, reason string) error
+
+	// TerminateGracefully waits for pending requests, then terminates
+	TerminateGracefully(ctx context.Context) error
+}
+
+// SessionLifetime is implemented by endpoints that can tell whether and for
+// how long their session is running.
+type SessionLifetime interface {
+	// Done returns a channel that is closed once the session is over
+	Done() <-chan struct{}
+
+	// Err returns the error the session ended with, if any
+	Err() error
+
+	// StartedAt returns the time the session was started
+	StartedAt() time.Time
+
+	// Uptime returns for how long the session has been running
+	Uptime() time.Duration
+}
+
+// Pinger is implemented by endpoints that can measure the round trip time
+// to the peer.
+type Pinger interface {
+	// Ping measures the round trip time to the peer
+	Ping(ctx context.Context) (time.Duration, error)
+}
+
+// ConnInspector is implemented by endpoints that report on the connection
+// of their session.
+type ConnInspector interface {
+	// RemoteAddr returns the address of the peer, or nil if it is unknown
+	RemoteAddr() net.Addr
+
+	// ConnInfo returns the features negotiated for the session
+	ConnInfo() ConnInfo
+
+	// Stats returns how full the receive buffers of the session are
+	Stats() Stats
+}
+
+// EventSource is implemented by endpoints that report events of their
+// session.
+type EventSource interface {
+	// Events returns the channel the events of the session are sent on
+	Events() <-chan Event
+
+	// DroppedEvents returns how many events were dropped because nobody read them
+	DroppedEvents() uint64
+}
+
+var (
+	_ Caller          = (*rpc)(nil)
+	_ AsyncCaller     = (*rpc)(nil)
+	_ Shutdowner      = (*rpc)(nil)
+	_ SessionLifetime = (*rpc)(nil)
+	_ Pinger          = (*rpc)(nil)
+	_ ConnInspector   = (*rpc)(nil)
+	_ EventSource     = (*rpc)(nil)
+)
@@ -0,0 +1,46 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+)
+
+// ErrorHandler is like Handler, but HandleCall can fail by returning an
+// error instead of ending the call with it. Use HandleErrors to serve it.
+type ErrorHandler interface {
+	HandleCall(ctx context.Context, req *Request) error
+	HandleConnect(ctx context.Context, e Endpoint)
+}
+
+// ErrorHandlerFunc is an ErrorHandler that calls the function for every
+// call. Its HandleConnect does nothing.
+type ErrorHandlerFunc func(context.Context, *Request) error
+
+// HandleCall returns f(ctx, req).
+func (f ErrorHandlerFunc) HandleCall(ctx context.Context, req *Request) error {
+	return f(ctx, req)
+}
+
+// HandleConnect does nothing.
+func (f ErrorHandlerFunc) HandleConnect(ctx context.Context, e Endpoint) {}
+
+// HandleErrors returns a Handler that passes calls on to h. If h returns an
+// error, the call is ended with it, so the caller gets a CallError with its
+// message, both for async calls and for streams that already sent values.
+// Errors returned after the call was ended, e.g. using Return, are dropped.
+func HandleErrors(h ErrorHandler) Handler {
+	return &errorHandler{h: h}
+}
+
+type errorHandler struct {
+	h ErrorHandler
+}
+
+func (h *errorHandler) HandleCall(ctx context.Context, req *Request) {
+	if err := h.h.HandleCall(ctx, req); err != nil {
+		req.CloseWithError(err)
+	}
+}
+
+func (h *errorHandler) HandleConnect(ctx context.Context, e Endpoint) {
+	h.h.HandleConnect(ctx, e)
+}
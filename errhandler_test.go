@@ -0,0 +1,54 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleErrors(t *testing.T) {
+	r := require.New(t)
+
+	h := HandleErrors(ErrorHandlerFunc(func(ctx context.Context, req *Request) error {
+		switch req.Method[0] {
+		case "fail":
+			return errors.New("no can do")
+		case "partial":
+			req.Stream.Pour(ctx, "a")
+			req.Stream.Pour(ctx, "b")
+			return errors.New("ran dry")
+		default:
+			return req.Return(ctx, "ok")
+		}
+	}))
+
+	rpc1, _, done := serveTestPair(t, &testHandler{connect: noopConnect}, h)
+	defer done()
+
+	ctx := context.Background()
+
+	v, err := rpc1.Async(ctx, "string", []string{"fine"})
+	r.NoError(err)
+	r.Equal("ok", v)
+
+	_, err = rpc1.Async(ctx, "string", []string{"fail"})
+	callErr, ok := errors.Cause(err).(*CallError)
+	r.True(ok, "expected call error, got %v", err)
+	r.Equal("no can do", callErr.Message)
+
+	src, err := rpc1.Source(ctx, "string", []string{"partial"})
+	r.NoError(err)
+
+	for _, exp := range []string{"a", "b"} {
+		v, err := src.Next(ctx)
+		r.NoError(err)
+		r.Equal(exp, v)
+	}
+
+	_, err = src.Next(ctx)
+	callErr, ok = errors.Cause(err).(*CallError)
+	r.True(ok, "expected call error, got %v", err)
+	r.Equal("ran dry", callErr.Message)
+}
@@ -0,0 +1,92 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// eventBufSize is the number of events buffered for a slow consumer of Events.
+const eventBufSize = 64
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventConnect is emitted when Serve calls the handler's HandleConnect.
+	EventConnect EventType = iota
+	// EventCallStart is emitted when a call was sent or received.
+	EventCallStart
+	// EventCallEnd is emitted when the remote ended a call.
+	EventCallEnd
+	// EventError is emitted when a request is rejected or Serve fails.
+	EventError
+	// EventTerminate is emitted when Serve returns.
+	EventTerminate
+	// EventGoodbye is emitted when a goodbye was sent or received, see
+	// Endpoint.Goodbye.
+	EventGoodbye
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnect:
+		return "connect"
+	case EventCallStart:
+		return "call-start"
+	case EventCallEnd:
+		return "call-end"
+	case EventError:
+		return "error"
+	case EventTerminate:
+		return "terminate"
+	case EventGoodbye:
+		return "goodbye"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event describes something that happened in an RPC session.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Req and Method identify the call of call events and rejected requests.
+	// Outbound is set for calls we made.
+	Req      int32
+	Method   []string
+	Outbound bool
+
+	// Reason is the reason given in goodbye events.
+	Reason string
+
+	// Err is set for error events, for call-end events if the call ended
+	// with an error and for outbound goodbye events if the peer didn't
+	// acknowledge.
+	Err error
+}
+
+// Events returns the channel the session's events are sent on. It is
+// buffered; if the consumer does not keep up, events are dropped instead of
+// blocking the session. See DroppedEvents.
+func (r *rpc) Events() <-chan Event {
+	return r.events
+}
+
+// DroppedEvents returns the number of events that were dropped because the
+// events channel was full.
+func (r *rpc) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&r.droppedEvents)
+}
+
+// emit sends ev on the events channel without blocking.
+func (r *rpc) emit(ev Event) {
+	ev.Time = r.now()
+
+	select {
+	case r.events <- ev:
+	default:
+		atomic.AddUint64(&r.droppedEvents, 1)
+	}
+}
@@ -0,0 +1,144 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// nextEvent returns the next event of type tipe, skipping the others.
+func nextEvent(t *testing.T, e Endpoint, tipe EventType) Event {
+	for {
+		select {
+		case ev := <-e.(EventSource).Events():
+			if ev.Type == tipe {
+				return ev
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s event", tipe)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	r := require.New(t)
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Return(ctx, "ok")
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, rpc2, done := serveTestPair(t, h1, h2)
+
+	_, err := rpc1.Async(context.Background(), "string", []string{"whoami"})
+	r.NoError(err)
+
+	nextEvent(t, rpc2, EventConnect)
+
+	ev := nextEvent(t, rpc1, EventCallStart)
+	r.True(ev.Outbound)
+	r.Equal([]string{"whoami"}, ev.Method)
+
+	ev = nextEvent(t, rpc2, EventCallStart)
+	r.False(ev.Outbound)
+	r.Equal([]string{"whoami"}, ev.Method)
+
+	done()
+	nextEvent(t, rpc1, EventTerminate)
+	nextEvent(t, rpc2, EventTerminate)
+}
+
+func TestEventsDropped(t *testing.T) {
+	c1, _ := net.Pipe()
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect}).(*rpc)
+
+	for i := 0; i < eventBufSize+10; i++ {
+		e.emit(Event{Type: EventError})
+	}
+
+	if n := e.DroppedEvents(); n != 10 {
+		t.Errorf("expected 10 dropped events, got %d", n)
+	}
+}
+
+func TestEventsClock(t *testing.T) {
+	at := time.Date(2018, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	c1, _ := net.Pipe()
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect},
+		WithClock(func() time.Time { return at })).(*rpc)
+
+	e.emit(Event{Type: EventError})
+	if ev := <-e.Events(); !ev.Time.Equal(at) {
+		t.Errorf("expected event at %v, got %v", at, ev.Time)
+	}
+}
+
+func TestGoodbye(t *testing.T) {
+	r := require.New(t)
+
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			t.Errorf("unexpected call: %#v", req)
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, rpc2, done := serveTestPair(t, h, h)
+	defer done()
+
+	r.NoError(rpc1.(Shutdowner).Goodbye(context.Background(), "maintenance"))
+
+	ev := nextEvent(t, rpc2, EventGoodbye)
+	r.False(ev.Outbound)
+	r.Equal("maintenance", ev.Reason)
+
+	ev = nextEvent(t, rpc1, EventGoodbye)
+	r.True(ev.Outbound)
+	r.Nil(ev.Err)
+}
+
+func TestGoodbyeTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// a peer that reads everything but never answers
+	go func() {
+		r := codec.NewReader(c2)
+		for {
+			_, err := r.ReadPacket()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect})
+	errc := ServeBackground(context.Background(), e.(Server))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := e.(Shutdowner).Goodbye(ctx, "bye"); err == nil {
+		t.Error("expected error without acknowledgement")
+	}
+
+	select {
+	case <-errc:
+	case <-time.After(time.Second):
+		t.Fatal("session was not terminated")
+	}
+}
@@ -0,0 +1,177 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync"
+
+	"cryptoscope.co/go/luigi"
+
+	"github.com/pkg/errors"
+)
+
+// ErrFanInSealed is returned when adding an input to a fan-in sink after done
+// was called.
+var ErrFanInSealed = errors.New("muxrpc: fan-in sink already sealed")
+
+// NewFanInSink combines several producers into dst. add returns a new input
+// sink. Pours on the inputs block until the value has been poured into dst, and
+// concurrent pours are forwarded in the order they arrive, so no input is
+// starved.
+//
+// dst is closed once done has been called and all inputs are closed, so
+// inputs can finish at different times. After that, add returns
+// ErrFanInSealed. If pouring into dst fails, the error is returned by all
+// following pours on any input.
+func NewFanInSink(dst luigi.Sink) (add func() (luigi.Sink, error), done func()) {
+	f := &fanIn{
+		dst:    dst,
+		turn:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	f.turn <- struct{}{}
+
+	add = func() (luigi.Sink, error) {
+		f.l.Lock()
+		defer f.l.Unlock()
+
+		if f.sealed {
+			return nil, ErrFanInSealed
+		}
+
+		f.open++
+		return &fanInSink{f: f}, nil
+	}
+
+	done = func() {
+		f.l.Lock()
+		f.sealed = true
+		last := f.maybeClose()
+		f.l.Unlock()
+
+		if last {
+			f.closeDst()
+		}
+	}
+
+	return add, done
+}
+
+// fanIn holds the state shared by the inputs of a fan-in sink.
+type fanIn struct {
+	dst luigi.Sink
+
+	// turn holds a token while no input pours into dst. Inputs waiting for
+	// it are served in the order they arrived.
+	turn chan struct{}
+
+	// closed is closed once all inputs are closed and no more can be added
+	closed chan struct{}
+
+	l      sync.Mutex
+	open   int
+	sealed bool
+	err    error
+}
+
+// pour pours v into dst once it is the caller's turn.
+func (f *fanIn) pour(ctx context.Context, v interface{}) error {
+	select {
+	case <-f.turn:
+	case <-f.closed:
+		return errors.New("pour to closed fan-in sink")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { f.turn <- struct{}{} }()
+
+	// both may have been ready above
+	select {
+	case <-f.closed:
+		return errors.New("pour to closed fan-in sink")
+	default:
+	}
+
+	f.l.Lock()
+	err := f.err
+	f.l.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = f.dst.Pour(ctx, v)
+	if err != nil {
+		err = errors.Wrap(err, "error pouring to fan-in destination")
+
+		f.l.Lock()
+		f.err = err
+		f.l.Unlock()
+	}
+
+	return err
+}
+
+// maybeClose marks the sink closed once all inputs are closed and no more
+// inputs are added, and reports whether the caller needs to close dst. Must be
+// called with f.l held.
+func (f *fanIn) maybeClose() bool {
+	if !f.sealed || f.open > 0 {
+		return false
+	}
+
+	select {
+	case <-f.closed:
+		return false
+	default:
+	}
+
+	close(f.closed)
+	return true
+}
+
+// closeDst waits for a pour in progress to finish and closes dst. The token is
+// not handed back, so no input pours after that.
+func (f *fanIn) closeDst() error {
+	<-f.turn
+	return f.dst.Close()
+}
+
+// fanInSink is an input of a fan-in sink.
+type fanInSink struct {
+	f *fanIn
+
+	// closed is guarded by f.l
+	closed bool
+}
+
+// Pour forwards v to the destination sink.
+func (s *fanInSink) Pour(ctx context.Context, v interface{}) error {
+	s.f.l.Lock()
+	closed := s.closed
+	s.f.l.Unlock()
+
+	if closed {
+		return errors.New("pour to closed fan-in input")
+	}
+
+	return s.f.pour(ctx, v)
+}
+
+// Close closes the input. The destination is closed once all inputs are closed.
+func (s *fanInSink) Close() error {
+	s.f.l.Lock()
+	if s.closed {
+		s.f.l.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	s.f.open--
+	last := s.f.maybeClose()
+	s.f.l.Unlock()
+
+	if last {
+		return errors.Wrap(s.f.closeDst(), "error closing fan-in destination")
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"cryptoscope.co/go/luigi"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanInSink(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	src, sink := luigi.NewPipe()
+	add, done := NewFanInSink(sink)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		in, err := add()
+		r.NoError(err)
+		wg.Add(1)
+
+		go func(i int, in luigi.Sink) {
+			defer wg.Done()
+
+			// inputs finish at different times
+			for j := 0; j <= i; j++ {
+				err := in.Pour(ctx, i)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+
+			in.Close()
+		}(i, in)
+	}
+	done()
+
+	counts := make(map[interface{}]int)
+	for {
+		v, err := src.Next(ctx)
+		if luigi.IsEOS(err) {
+			break
+		}
+		r.NoError(err)
+
+		counts[v]++
+	}
+
+	r.Equal(map[interface{}]int{0: 1, 1: 2, 2: 3}, counts)
+	wg.Wait()
+}
+
+func TestFanInSinkError(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	_, sink := luigi.NewPipe(luigi.WithBuffer(1))
+	sink.Close()
+
+	add, done := NewFanInSink(sink)
+	in1, err := add()
+	r.NoError(err)
+	in2, err := add()
+	r.NoError(err)
+	done()
+
+	r.Error(in1.Pour(ctx, 1))
+	r.Error(in2.Pour(ctx, 2))
+
+	in1.Close()
+	in2.Close()
+
+	r.Error(in1.Pour(ctx, 3), "expected error pouring to closed input")
+}
+
+func TestFanInSinkSealed(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	src, sink := luigi.NewPipe(luigi.WithBuffer(10))
+	add, done := NewFanInSink(sink)
+
+	in, err := add()
+	r.NoError(err)
+	done()
+
+	_, err = add()
+	r.Equal(ErrFanInSealed, err)
+
+	// pours racing the close must fail, not panic
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			in.Pour(ctx, i)
+		}(i)
+	}
+	r.NoError(in.Close())
+	wg.Wait()
+
+	r.Error(in.Pour(ctx, 42))
+
+	for {
+		_, err := src.Next(ctx)
+		if luigi.IsEOS(err) {
+			break
+		}
+		r.NoError(err)
+	}
+}
@@ -0,0 +1,51 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// goodbyeMethod is called by Goodbye. It is answered by the session, not the
+// handler.
+var goodbyeMethod = []string{"muxrpc", "goodbye"}
+
+// goodbyeTimeout is how long Goodbye waits for the acknowledgement if the
+// context has no deadline.
+const goodbyeTimeout = time.Second
+
+// Goodbye tells the peer that the session is about to be terminated and why,
+// waits until the peer acknowledged that and terminates the session. This
+// lets both sides tell a clean shutdown from a lost connection: both emit an
+// EventGoodbye. If the peer doesn't acknowledge before ctx is done or, if ctx
+// has no deadline, within a second, the session is terminated anyway and an
+// error is returned.
+func (r *rpc) Goodbye(ctx context.Context, reason string) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, goodbyeTimeout)
+		defer cancel()
+	}
+
+	_, err := r.Async(ctx, "string", goodbyeMethod, reason)
+	r.emit(Event{Type: EventGoodbye, Outbound: true, Reason: reason, Err: err})
+
+	tErr := r.Terminate()
+	if err != nil {
+		return errors.Wrap(err, "peer did not acknowledge goodbye")
+	}
+
+	return tErr
+}
+
+// replyGoodbye acknowledges the goodbye of the peer.
+func (r *rpc) replyGoodbye(ctx context.Context, req *Request) {
+	var reason string
+	if len(req.Args) > 0 {
+		reason, _ = req.Args[0].(string)
+	}
+
+	r.emit(Event{Type: EventGoodbye, Req: req.pkt.Req, Reason: reason})
+	req.Return(ctx, "bye")
+}
@@ -0,0 +1,106 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// HealthMethod is the conventional name of the health check method. Mount a
+// HealthHandler under it, e.g. using HandlerMux, and call it using Health.
+var HealthMethod = []string{"health"}
+
+// The values of HealthStatus.Status.
+const (
+	HealthOK       = "ok"
+	HealthNotReady = "not ready"
+)
+
+// HealthStatus is the reply to a health check. On the wire it is a JSON
+// object like
+//
+//	{"status":"ok","version":"1.2.0","uptime":12.5,"pending":3}
+//
+// where status is "ok" or "not ready", error explains the latter, version is
+// set by the server if it wants to, uptime is the age of the session in
+// seconds and pending is the number of requests the session is handling,
+// including the health check itself.
+type HealthStatus struct {
+	Status  string  `json:"status"`
+	Error   string  `json:"error,omitempty"`
+	Version string  `json:"version,omitempty"`
+	Uptime  float64 `json:"uptime"`
+	Pending int     `json:"pending"`
+}
+
+// OK returns whether the peer reported being ready.
+func (st *HealthStatus) OK() bool {
+	return st.Status == HealthOK
+}
+
+// HealthHandler answers health checks. A peer that is reachable but not
+// ready, as decided by Ready, replies with status "not ready" instead of
+// failing the call, so callers can tell the two cases apart.
+type HealthHandler struct {
+	// Version is reported to the caller if it is not empty.
+	Version string
+
+	// Ready is called on every check. If it returns an error, the status is
+	// "not ready". If it is nil, the handler is always ready.
+	Ready func(context.Context) error
+}
+
+// HandleCall answers async calls with a HealthStatus.
+func (h *HealthHandler) HandleCall(ctx context.Context, req *Request) {
+	if req.Type != Async {
+		req.CloseWithError(errors.Errorf("health: unsupported call type %q", req.Type))
+		return
+	}
+
+	st := HealthStatus{
+		Status:  HealthOK,
+		Version: h.Version,
+	}
+
+	if r := sessionFromContext(ctx); r != nil {
+		st.Uptime = r.Uptime().Seconds()
+		st.Pending = r.reqs.Len()
+	}
+
+	if h.Ready != nil {
+		if err := h.Ready(ctx); err != nil {
+			st.Status = HealthNotReady
+			st.Error = err.Error()
+		}
+	}
+
+	req.Return(ctx, st)
+}
+
+// HandleConnect does nothing.
+func (h *HealthHandler) HandleConnect(ctx context.Context, e Endpoint) {}
+
+// Health calls the health check method of the peer. A peer that is not ready
+// is not an error, check the returned status for that.
+func Health(ctx context.Context, e Endpoint) (*HealthStatus, error) {
+	v, err := e.Async(ctx, &HealthStatus{}, HealthMethod)
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling health")
+	}
+
+	st, ok := v.(*HealthStatus)
+	if !ok {
+		return nil, errors.Errorf("unexpected health reply of type %T", v)
+	}
+
+	return st, nil
+}
+
+type sessionKey struct{}
+
+// sessionFromContext returns the session that passed ctx to a handler, or
+// nil if ctx didn't come from Serve.
+func sessionFromContext(ctx context.Context) *rpc {
+	r, _ := ctx.Value(sessionKey{}).(*rpc)
+	return r
+}
@@ -0,0 +1,48 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	r := require.New(t)
+
+	ready := errors.New("warming up")
+	health := &HealthHandler{
+		Version: "1.2.0",
+		Ready: func(context.Context) error {
+			return ready
+		},
+	}
+
+	var mux HandlerMux
+	mux.Handle(HealthMethod, health)
+
+	h1 := callerHandler(t)
+
+	rpc1, _, done := serveTestPair(t, h1, &mux)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	st, err := Health(ctx, rpc1)
+	r.NoError(err)
+	r.False(st.OK())
+	r.Equal(HealthNotReady, st.Status)
+	r.Equal("warming up", st.Error)
+	r.Equal("1.2.0", st.Version)
+	r.Equal(1, st.Pending, "expected the health check to be the only request")
+
+	ready = nil
+	st, err = Health(ctx, rpc1)
+	r.NoError(err)
+	r.True(st.OK())
+	r.Equal("", st.Error)
+	r.True(st.Uptime > 0, "expected uptime to be set")
+}
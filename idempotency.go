@@ -0,0 +1,115 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyField is the metadata field that holds the idempotency key.
+const idempotencyKeyField = "idempotencyKey"
+
+// WithIdempotencyKey returns a context that makes calls done with it send key
+// as idempotency key in the request metadata, in addition to the metadata
+// set using WithMeta. Retrying a call with the same key allows the server to
+// recognize it and return the earlier result instead of running it again.
+//
+// This only works if the server cooperates, e.g. by using an
+// IdempotencyCache. Other servers ignore the key.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	old := metaFromContext(ctx)
+
+	meta := make(map[string]interface{}, len(old)+1)
+	for k, v := range old {
+		meta[k] = v
+	}
+	meta[idempotencyKeyField] = key
+
+	return WithMeta(ctx, meta)
+}
+
+// IdempotencyKey returns the idempotency key the caller sent along with the
+// call, or "" if there is none.
+func (req *Request) IdempotencyKey() string {
+	key, _ := req.Metadata[idempotencyKeyField].(string)
+	return key
+}
+
+// IdempotencyCache remembers the results of calls by their idempotency key
+// for a limited time. Handlers use it to answer retried calls without
+// running them again:
+//
+//	if v, ok := cache.Get(req.IdempotencyKey()); ok {
+//		req.Return(ctx, v)
+//		return
+//	}
+//	v := doTheThing()
+//	cache.Put(req.IdempotencyKey(), v)
+//	req.Return(ctx, v)
+type IdempotencyCache struct {
+	l       sync.Mutex
+	ttl     time.Duration
+	entries map[string]idempotencyEntry
+
+	// nextSweep is when Put removes expired results next. Sweeping at most
+	// once per ttl keeps Put cheap while bounding the cache to the results
+	// of about two ttls.
+	nextSweep time.Time
+}
+
+type idempotencyEntry struct {
+	v       interface{}
+	expires time.Time
+}
+
+// NewIdempotencyCache returns an IdempotencyCache that keeps results for ttl.
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{
+		ttl:     ttl,
+		entries: make(map[string]idempotencyEntry),
+	}
+}
+
+// Get returns the result stored for key, if it didn't expire yet.
+// The empty key is never found.
+func (c *IdempotencyCache) Get(key string) (interface{}, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+
+	return e.v, true
+}
+
+// Put stores v as the result for key. Results for the empty key are not
+// stored. Expired results are removed from time to time.
+func (c *IdempotencyCache) Put(key string, v interface{}) {
+	if key == "" {
+		return
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(c.ttl)
+	}
+
+	c.entries[key] = idempotencyEntry{
+		v:       v,
+		expires: now.Add(c.ttl),
+	}
+}
@@ -0,0 +1,86 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	r := require.New(t)
+
+	var runs int32
+	cache := NewIdempotencyCache(time.Minute)
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			v, ok := cache.Get(req.IdempotencyKey())
+			if !ok {
+				v = fmt.Sprint("run ", atomic.AddInt32(&runs, 1))
+				cache.Put(req.IdempotencyKey(), v)
+			}
+
+			err := req.Return(ctx, v)
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := WithMeta(context.Background(), map[string]interface{}{"trace": "abc"})
+	keyCtx := WithIdempotencyKey(ctx, "publish-1")
+	r.Equal(map[string]interface{}{"trace": "abc"}, metaFromContext(ctx), "existing metadata must not be changed")
+
+	for i := 0; i < 2; i++ {
+		v, err := rpc1.Async(keyCtx, "string", []string{"publish"})
+		r.NoError(err)
+		r.Equal("run 1", v)
+	}
+
+	v, err := rpc1.Async(ctx, "string", []string{"publish"})
+	r.NoError(err)
+	r.Equal("run 2", v, "calls without key must run")
+}
+
+func TestIdempotencyCacheExpiry(t *testing.T) {
+	cache := NewIdempotencyCache(time.Millisecond)
+	cache.Put("k", 1)
+
+	if _, ok := cache.Get("k"); !ok {
+		t.Error("expected fresh entry")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if _, ok := cache.Get("k"); ok {
+		t.Error("expected entry to be expired")
+	}
+}
+
+func TestIdempotencyCacheSweep(t *testing.T) {
+	cache := NewIdempotencyCache(10 * time.Millisecond)
+	cache.Put("a", 1)
+	cache.Put("b", 2)
+
+	// the first put after a ttl removes the expired results
+	time.Sleep(15 * time.Millisecond)
+	cache.Put("c", 3)
+	if n := len(cache.entries); n != 1 {
+		t.Errorf("expected expired entries to be swept, got %d entries", n)
+	}
+
+	// the next sweep is only due a ttl later
+	if d := cache.nextSweep.Sub(time.Now()); d <= 0 || d > 10*time.Millisecond {
+		t.Errorf("unexpected time to next sweep %v", d)
+	}
+}
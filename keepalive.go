@@ -0,0 +1,130 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrKeepaliveTimeout is returned by Serve if the peer didn't reply to a
+// keepalive ping within the timeout set using WithKeepalive.
+var ErrKeepaliveTimeout = errors.New("muxrpc: keepalive timed out")
+
+// keepaliveMethod is called by sessions using WithKeepalive, with the
+// current time in milliseconds since the epoch as the only argument. It is
+// named after the ping method of the gossip plugin of JS muxrpc peers, but
+// is called as an async method. Sessions using WithKeepalive answer async
+// calls to it themselves, not the handler, with the current time in the same
+// format; other sessions pass them to the handler like any call. Peers that
+// only know the duplex variant reply with an error, which shows that they are
+// alive just as well.
+var keepaliveMethod = []string{"gossip", "ping"}
+
+// keepalive pings the peer every keepalive interval until done is closed or
+// a ping fails.
+func (r *rpc) keepalive(ctx context.Context, done <-chan struct{}) {
+	t := time.NewTicker(r.keepaliveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		if !r.ping(ctx) {
+			return
+		}
+	}
+}
+
+// Ping calls keepaliveMethod on the peer and returns the round trip time. A
+// reply with an error counts as well, since it shows the peer is alive: JS
+// peers that only have the duplex variant of the method reply with one. If the
+// session ends while waiting, ErrSessionTerminated is returned right away.
+func (r *rpc) Ping(ctx context.Context) (time.Duration, error) {
+	select {
+	case <-r.done:
+		return 0, ErrSessionTerminated
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, errors.Wrap(err, "ping failed")
+	}
+
+	// calls don't notice that the session ended if they were sent after that
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	start := r.now()
+	_, err := r.AsyncBytes(ctx, keepaliveMethod, unixMillis(start))
+	rtt := r.now().Sub(start)
+
+	if err != nil {
+		select {
+		case <-r.done:
+			return 0, ErrSessionTerminated
+		default:
+		}
+
+		// the peer may have answered the cancellation with an error
+		if ctx.Err() != nil {
+			return 0, errors.Wrap(ctx.Err(), "ping failed")
+		}
+
+		if _, ok := errors.Cause(err).(*CallError); !ok {
+			return 0, errors.Wrap(err, "ping failed")
+		}
+	}
+
+	return rtt, nil
+}
+
+// ping pings the peer and terminates the session if it doesn't reply in time.
+// It returns false if the session was terminated.
+func (r *rpc) ping(ctx context.Context) bool {
+	callCtx, cancel := context.WithTimeout(ctx, r.keepaliveTimeout)
+	defer cancel()
+
+	_, err := r.Ping(callCtx)
+	if err == nil {
+		return true
+	}
+
+	if callCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		r.logger.Log("event", "keepalive timed out", "timeout", r.keepaliveTimeout)
+
+		r.tLock.Lock()
+		defer r.tLock.Unlock()
+
+		if r.abortErr == nil {
+			r.abortErr = ErrKeepaliveTimeout
+		}
+		r.terminate()
+
+		return false
+	}
+
+	return true
+}
+
+// replyKeepalive answers a keepalive ping of the peer.
+func (r *rpc) replyKeepalive(ctx context.Context, req *Request) {
+	req.Return(ctx, unixMillis(r.now()))
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
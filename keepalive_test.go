@@ -0,0 +1,118 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+)
+
+func TestKeepaliveTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	// a peer that reads everything but stopped answering
+	go func() {
+		r := codec.NewReader(c2)
+		for {
+			_, err := r.ReadPacket()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect},
+		WithKeepalive(10*time.Millisecond, 20*time.Millisecond))
+
+	select {
+	case err := <-ServeBackground(context.Background(), e.(Server)):
+		if errors.Cause(err) != ErrKeepaliveTimeout {
+			t.Errorf("expected keepalive timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session was not terminated")
+	}
+}
+
+func TestKeepaliveAlive(t *testing.T) {
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			t.Errorf("keepalive ping reached the handler: %v", req.Method)
+		},
+		connect: noopConnect,
+	}
+
+	e1, _, stop := serveTestPair(t, h, h, WithKeepalive(5*time.Millisecond, 100*time.Millisecond))
+	defer stop()
+
+	// several pings are answered in this time
+	time.Sleep(50 * time.Millisecond)
+
+	select {
+	case <-e1.(SessionLifetime).Done():
+		t.Fatalf("session ended although the peer is alive: %v", e1.(SessionLifetime).Err())
+	default:
+	}
+}
+
+func TestPing(t *testing.T) {
+	pkr1, pkr2 := NewLoopbackPackers()
+	e1 := Handle(pkr1, &testHandler{connect: noopConnect})
+	// e2 answers pings itself
+	e2 := Handle(pkr2, &testHandler{connect: noopConnect}, WithKeepalive(time.Hour, 0))
+
+	serve1 := ServeBackground(context.Background(), e1.(Server))
+	ServeBackground(context.Background(), e2.(Server))
+	defer e1.Terminate()
+
+	rtt, err := e1.(Pinger).Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < 0 || rtt > time.Second {
+		t.Errorf("unexpected round trip time %v", rtt)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := e1.(Pinger).Ping(ctx); errors.Cause(err) != context.Canceled {
+		t.Errorf("expected cancelled ping to fail, got %v", err)
+	}
+
+	// a dead connection fails right away
+	e2.Terminate()
+	<-serve1
+
+	start := time.Now()
+	if _, err := e1.(Pinger).Ping(context.Background()); err != ErrSessionTerminated {
+		t.Errorf("expected ErrSessionTerminated, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("ping on dead session took too long")
+	}
+}
+
+func TestPingReachesHandlerWithoutKeepalive(t *testing.T) {
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if !methodEqual(req.Method, keepaliveMethod) {
+				req.CloseWithError(errors.Errorf("unexpected call %v", req.Method))
+				return
+			}
+			req.Return(ctx, "pong")
+		},
+		connect: noopConnect,
+	}
+
+	e1, _, stop := serveTestPair(t, callerHandler(t), h2)
+	defer stop()
+
+	v, err := e1.Async(context.Background(), "string", keepaliveMethod)
+	if err != nil || v != "pong" {
+		t.Errorf("expected the handler to answer, got %v, %v", v, err)
+	}
+}
@@ -0,0 +1,163 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestMethod is the conventional name of the method that returns the
+// manifest of a peer. Register it using HandlerMux.HandleManifest and call it
+// using FetchManifest.
+var ManifestMethod = []string{"manifest"}
+
+// Manifest describes the methods a peer offers and their call types. The
+// keys are the dotted method names, e.g. "blobs.get". On the wire it is the
+// nested JSON object JS peers use, like
+//
+//	{"whoami":"async","blobs":{"get":"source","add":"sink"}}
+type Manifest map[string]CallType
+
+// Add adds method with call type typ to the manifest.
+func (m Manifest) Add(method []string, typ CallType) {
+	m[methodString(method)] = typ
+}
+
+// Type returns the call type of method and whether it is in the manifest.
+func (m Manifest) Type(method []string) (CallType, bool) {
+	typ, ok := m[methodString(method)]
+	return typ, ok
+}
+
+// Check returns an error if method is not in the manifest or if it can't be
+// called using typ. Async and sync are interchangeable, since both are
+// answered with a single value.
+func (m Manifest) Check(method []string, typ CallType) error {
+	have, ok := m.Type(method)
+	if !ok {
+		return errors.Errorf("method %s is not in the manifest", methodString(method))
+	}
+
+	single := func(t CallType) bool { return t == Async || t == Sync }
+	if have != typ && !(single(have) && single(typ)) {
+		return errors.Errorf("method %s is %s, not %s", methodString(method), have, typ)
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes the manifest as nested object. A method can't be both
+// a method and the prefix of others, since JSON can't express that.
+func (m Manifest) MarshalJSON() ([]byte, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	root := make(map[string]interface{})
+	for _, name := range names {
+		path := strings.Split(name, ".")
+
+		obj := root
+		for _, elem := range path[:len(path)-1] {
+			switch v := obj[elem].(type) {
+			case nil:
+				sub := make(map[string]interface{})
+				obj[elem] = sub
+				obj = sub
+			case map[string]interface{}:
+				obj = v
+			default:
+				return nil, errors.Errorf("manifest: %s is a method and a prefix of %s", elem, name)
+			}
+		}
+
+		last := path[len(path)-1]
+		if _, ok := obj[last]; ok {
+			return nil, errors.Errorf("manifest: %s is a method and a prefix of other methods", name)
+		}
+		obj[last] = m[name]
+	}
+
+	return json.Marshal(root)
+}
+
+// UnmarshalJSON decodes a nested manifest object as sent by JS peers.
+func (m *Manifest) UnmarshalJSON(data []byte) error {
+	if *m == nil {
+		*m = make(Manifest)
+	}
+
+	return m.unmarshal(nil, data)
+}
+
+// unmarshal adds the methods in the object data to m, prefixing their names
+// with prefix.
+func (m Manifest) unmarshal(prefix []string, data []byte) error {
+	var obj map[string]json.RawMessage
+
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return errors.Wrap(err, "error decoding manifest")
+	}
+
+	for name, v := range obj {
+		method := append(prefix[:len(prefix):len(prefix)], name)
+
+		if len(v) > 0 && v[0] == '{' {
+			err = m.unmarshal(method, v)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var typ CallType
+		err = json.Unmarshal(v, &typ)
+		if err != nil {
+			return errors.Wrapf(err, "error decoding manifest entry %s", methodString(method))
+		}
+
+		m.Add(method, typ)
+	}
+
+	return nil
+}
+
+// internalMethods are the methods the session calls by itself.
+var internalMethods = [][]string{goodbyeMethod, keepaliveMethod, capsMethod}
+
+// checkManifest returns an error if the session has a manifest that req
+// doesn't match.
+func (r *rpc) checkManifest(req *Request) error {
+	if r.manifest == nil {
+		return nil
+	}
+
+	for _, method := range internalMethods {
+		if methodEqual(req.Method, method) {
+			return nil
+		}
+	}
+
+	return errors.Wrap(r.manifest.Check(req.Method, req.Type), "call rejected by manifest")
+}
+
+// FetchManifest calls the manifest method of the peer.
+func FetchManifest(ctx context.Context, e Endpoint) (Manifest, error) {
+	v, err := e.Async(ctx, Manifest{}, ManifestMethod)
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling manifest")
+	}
+
+	m, ok := v.(Manifest)
+	if !ok {
+		return nil, errors.Errorf("unexpected manifest reply of type %T", v)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,147 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// jsManifest is the shape of the manifest of an ssb-server.
+const jsManifest = `{
+	"auth": "async",
+	"address": "sync",
+	"manifest": "sync",
+	"get": "async",
+	"createHistoryStream": "source",
+	"blobs": {
+		"get": "source",
+		"add": "sink",
+		"has": "async",
+		"createWants": "source"
+	},
+	"gossip": {
+		"ping": "duplex",
+		"peers": "sync"
+	},
+	"tunnel": {
+		"connect": "duplex"
+	}
+}`
+
+func TestManifestJSON(t *testing.T) {
+	r := require.New(t)
+
+	var m Manifest
+	r.NoError(json.Unmarshal([]byte(jsManifest), &m))
+
+	r.Len(m, 12)
+	r.Equal(Sync, m["address"])
+	r.Equal(Sink, m["blobs.add"])
+	r.Equal(Duplex, m["gossip.ping"])
+
+	typ, ok := m.Type([]string{"blobs", "createWants"})
+	r.True(ok)
+	r.Equal(Source, typ)
+
+	r.NoError(m.Check([]string{"get"}, Async))
+	r.NoError(m.Check([]string{"address"}, Async), "sync methods can be called async")
+	r.Error(m.Check([]string{"blobs", "add"}, Source), "expected wrong type to fail")
+	r.Error(m.Check([]string{"blobs", "rm"}, Async), "expected unknown method to fail")
+
+	// round trip
+	data, err := json.Marshal(m)
+	r.NoError(err)
+
+	var got, exp interface{}
+	r.NoError(json.Unmarshal(data, &got))
+	r.NoError(json.Unmarshal([]byte(jsManifest), &exp))
+	r.True(reflect.DeepEqual(exp, got), "round trip changed the manifest: %s", data)
+
+	// JSON can't have blobs both as method and as object
+	m.Add([]string{"blobs"}, Async)
+	_, err = json.Marshal(m)
+	r.Error(err)
+
+	err = json.Unmarshal([]byte(`{"foo":"stream"}`), &m)
+	r.Error(err, "expected unknown call type to fail")
+}
+
+func TestHandlerMuxManifest(t *testing.T) {
+	r := require.New(t)
+
+	noop := HandlerFunc(func(ctx context.Context, req *Request) {})
+
+	var blobs HandlerMux
+	blobs.HandleTyped([]string{"blobs", "get"}, Source, noop)
+	blobs.HandleTyped([]string{"blobs", "add"}, Sink, noop)
+
+	var mux HandlerMux
+	mux.HandleTyped([]string{"whoami"}, Async, noop)
+	mux.Handle([]string{"blobs"}, &blobs)
+	mux.Handle([]string{"untyped"}, noop)
+	mux.HandleManifest()
+
+	rpc1, _, done := serveTestPair(t, &testHandler{connect: noopConnect}, &mux)
+	defer done()
+
+	m, err := FetchManifest(context.Background(), rpc1)
+	r.NoError(err)
+	r.Equal(Manifest{
+		"whoami":    Async,
+		"blobs.get": Source,
+		"blobs.add": Sink,
+		"manifest":  Sync,
+	}, m)
+}
+
+func TestWithManifest(t *testing.T) {
+	r := require.New(t)
+
+	var m Manifest
+	r.NoError(json.Unmarshal([]byte(jsManifest), &m))
+
+	var calls int32
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			atomic.AddInt32(&calls, 1)
+			req.Return(ctx, "ok")
+		},
+		connect: noopConnect,
+	}
+
+	pkr1, pkr2 := NewLoopbackPackers()
+	rpc1 := Handle(pkr1, &testHandler{connect: noopConnect}, WithManifest(m), WithKeepalive(time.Millisecond, time.Second))
+	rpc2 := Handle(pkr2, h)
+
+	go rpc1.(Server).Serve(context.Background())
+	go rpc2.(Server).Serve(context.Background())
+	defer rpc2.Terminate()
+	defer rpc1.Terminate()
+
+	ctx := context.Background()
+
+	v, err := rpc1.Async(ctx, "string", []string{"address"})
+	r.NoError(err)
+	r.Equal("ok", v)
+
+	_, err = rpc1.Async(ctx, "string", []string{"blobs", "get"})
+	r.Error(err, "expected async call to source method to fail")
+
+	_, err = rpc1.Source(ctx, "string", []string{"nope"})
+	r.Error(err, "expected call to unknown method to fail")
+
+	r.Equal(int32(1), atomic.LoadInt32(&calls), "expected rejected calls not to be sent")
+
+	// keepalive pings use gossip.ping, which the manifest lists as duplex
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-rpc1.(SessionLifetime).Done():
+		t.Fatalf("expected keepalive to work, session ended with %v", rpc1.(SessionLifetime).Err())
+	default:
+	}
+}
@@ -0,0 +1,66 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"encoding/binary"
+	"time"
+
+	"cryptoscope.co/go/muxrpc/codec"
+)
+
+// Direction tells whether bytes were sent or received.
+type Direction int
+
+const (
+	// Received is the direction of bytes read from the connection.
+	Received Direction = iota
+
+	// Sent is the direction of bytes written to the connection.
+	Sent
+)
+
+func (d Direction) String() string {
+	if d == Sent {
+		return "sent"
+	}
+
+	return "received"
+}
+
+// Metrics is told about the activity of a session, e.g. to export it to a
+// monitoring system. Its methods are called from several goroutines and
+// should return quickly. Set it using WithMetrics.
+type Metrics interface {
+	// IncRequests is called for every call sent or received.
+	IncRequests(typ CallType)
+
+	// IncErrors is called for every call that ended with an error and for
+	// every request that was rejected.
+	IncErrors()
+
+	// ObserveRequestDuration is called when a call ended with the time
+	// since it was started.
+	ObserveRequestDuration(typ CallType, d time.Duration)
+
+	// AddBytes is called for every packet with its size on the wire.
+	AddBytes(dir Direction, n int)
+}
+
+// packetHeaderSize is the size of an encoded codec.Header.
+var packetHeaderSize = binary.Size(codec.Header{})
+
+// wireSize returns the number of bytes pkt takes up on the wire.
+func wireSize(pkt *codec.Packet) int {
+	return packetHeaderSize + len(pkt.Body)
+}
+
+// observeEnd reports that req ended with err, if metrics are enabled.
+func (r *rpc) observeEnd(req *Request, err error) {
+	if r.metrics == nil {
+		return
+	}
+
+	if err != nil {
+		r.metrics.IncErrors()
+	}
+	r.metrics.ObserveRequestDuration(req.Type, r.now().Sub(req.started))
+}
@@ -0,0 +1,102 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type testMetrics struct {
+	l         sync.Mutex
+	requests  map[CallType]int
+	errors    int
+	durations int
+	bytes     map[Direction]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		requests: make(map[CallType]int),
+		bytes:    make(map[Direction]int),
+	}
+}
+
+func (m *testMetrics) IncRequests(typ CallType) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.requests[typ]++
+}
+
+func (m *testMetrics) IncErrors() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.errors++
+}
+
+func (m *testMetrics) ObserveRequestDuration(typ CallType, d time.Duration) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.durations++
+}
+
+func (m *testMetrics) AddBytes(dir Direction, n int) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.bytes[dir] += n
+}
+
+func TestMetrics(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	m := newTestMetrics()
+	pkr1, pkr2 := NewLoopbackPackers()
+
+	rpc1 := Handle(pkr1, &testHandler{connect: noopConnect}, WithMetrics(m))
+	rpc2 := Handle(pkr2, HandlerFunc(func(ctx context.Context, req *Request) {
+		if req.Method[0] == "fail" {
+			req.CloseWithError(errors.New("test error"))
+			return
+		}
+		req.Return(ctx, "ok")
+	}))
+
+	serve1 := ServeBackground(ctx, rpc1.(Server))
+	serve2 := ServeBackground(ctx, rpc2.(Server))
+
+	_, err := rpc1.Async(ctx, "string", []string{"ok"})
+	r.NoError(err)
+
+	_, err = rpc1.Async(ctx, "string", []string{"fail"})
+	r.Error(err)
+
+	// the calls end once the end packets following the replies arrived
+	for i := 0; ; i++ {
+		m.l.Lock()
+		n := m.durations
+		m.l.Unlock()
+
+		if n == 2 {
+			break
+		} else if i > 100 {
+			t.Fatalf("expected both calls to be timed, got %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	r.NoError(rpc1.Terminate())
+	<-serve1
+	<-serve2
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	r.Equal(map[CallType]int{"async": 2}, m.requests)
+	r.Equal(1, m.errors, "expected the failed call to be counted")
+	r.True(m.bytes[Sent] > 0, "expected sent bytes to be counted")
+	r.True(m.bytes[Received] > 0, "expected received bytes to be counted")
+}
@@ -0,0 +1,196 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// HandlerMux is a Handler that passes calls on to the handler registered for
+// the called method. It is safe to register handlers concurrently.
+//
+// A route matches calls to its method and to all methods it is a prefix of,
+// so a handler registered for ["blobs"] gets calls to ["blobs","get"] as well,
+// unless there is a route for ["blobs","get"]: the longest match wins.
+// Calls that don't match any route go to the wildcard handler, if one was set
+// using HandleWildcard. Other calls are ended with a method not found error,
+// see IsMethodNotFound.
+type HandlerMux struct {
+	l        sync.RWMutex
+	routes   map[string]Handler
+	types    map[string]CallType
+	wildcard Handler
+}
+
+// Handle registers h for calls to method.
+func (m *HandlerMux) Handle(method []string, h Handler) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	if m.routes == nil {
+		m.routes = make(map[string]Handler)
+	}
+
+	m.routes[methodKey(method)] = h
+}
+
+// HandleTyped registers h for calls to method like Handle and lists method
+// with call type typ in the manifest returned by Manifest.
+func (m *HandlerMux) HandleTyped(method []string, typ CallType, h Handler) {
+	m.Handle(method, h)
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	if m.types == nil {
+		m.types = make(map[string]CallType)
+	}
+
+	m.types[methodString(method)] = typ
+}
+
+// HandleManifest registers a handler for ManifestMethod that replies with the
+// manifest of m. Like JS peers, the manifest lists the method itself as sync.
+func (m *HandlerMux) HandleManifest() {
+	m.HandleTyped(ManifestMethod, Sync, HandlerFunc(func(ctx context.Context, req *Request) {
+		if req.Type != Async && req.Type != Sync {
+			req.CloseWithError(errors.Errorf("manifest: unsupported call type %q", req.Type))
+			return
+		}
+
+		req.Return(ctx, m.Manifest())
+	}))
+}
+
+// Manifest returns the methods registered using HandleTyped. Handlers of
+// routes that have a Manifest method as well, like a nested HandlerMux, add
+// theirs. Since the full method is passed on to them, their manifest must
+// contain full method names as well.
+func (m *HandlerMux) Manifest() Manifest {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	man := make(Manifest)
+	for _, h := range m.routes {
+		if sub, ok := h.(interface{ Manifest() Manifest }); ok {
+			for name, typ := range sub.Manifest() {
+				man[name] = typ
+			}
+		}
+	}
+
+	for name, typ := range m.types {
+		man[name] = typ
+	}
+
+	return man
+}
+
+// HandleFunc registers fn for calls to method.
+func (m *HandlerMux) HandleFunc(method []string, fn func(context.Context, *Request)) {
+	m.Handle(method, HandlerFunc(fn))
+}
+
+// HandleWildcard registers h for all calls that don't match a route. It sees
+// the full method in req.Method, so it can e.g. forward the call upstream.
+func (m *HandlerMux) HandleWildcard(h Handler) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	m.wildcard = h
+}
+
+// HandleCall passes req to the handler registered for its method.
+func (m *HandlerMux) HandleCall(ctx context.Context, req *Request) {
+	h := m.route(req.Method)
+	if h == nil {
+		req.CloseWithError(errMethodNotFound(req.Method))
+		return
+	}
+
+	h.HandleCall(ctx, req)
+}
+
+// route returns the handler for the longest route matching method, the
+// wildcard handler or nil.
+func (m *HandlerMux) route(method []string) Handler {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	for i := len(method); i > 0; i-- {
+		if h, ok := m.routes[methodKey(method[:i])]; ok {
+			return h
+		}
+	}
+
+	return m.wildcard
+}
+
+// HandleConnect calls HandleConnect of all registered handlers concurrently
+// and returns when they all returned.
+func (m *HandlerMux) HandleConnect(ctx context.Context, e Endpoint) {
+	m.l.RLock()
+	var (
+		hs   = make([]Handler, 0, len(m.routes)+1)
+		seen = make(map[Handler]struct{}, len(m.routes)+1)
+	)
+	add := func(h Handler) {
+		// only pointers are deduplicated: other handlers, like HandlerFunc
+		// or structs holding funcs, may panic when compared, so they are
+		// called every time
+		if reflect.ValueOf(h).Kind() == reflect.Ptr {
+			if _, ok := seen[h]; ok {
+				return
+			}
+			seen[h] = struct{}{}
+		}
+		hs = append(hs, h)
+	}
+	for _, h := range m.routes {
+		add(h)
+	}
+	if m.wildcard != nil {
+		add(m.wildcard)
+	}
+	m.l.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, h := range hs {
+		wg.Add(1)
+		go func(h Handler) {
+			defer wg.Done()
+			h.HandleConnect(ctx, e)
+		}(h)
+	}
+
+	wg.Wait()
+}
+
+// HandlerFunc is a Handler that calls the function for every call. Its
+// HandleConnect does nothing.
+type HandlerFunc func(context.Context, *Request)
+
+// HandleCall calls f(ctx, req).
+func (f HandlerFunc) HandleCall(ctx context.Context, req *Request) {
+	f(ctx, req)
+}
+
+// HandleConnect does nothing.
+func (f HandlerFunc) HandleConnect(ctx context.Context, e Endpoint) {}
+
+const methodNotFoundPrefix = "method not found: "
+
+// errMethodNotFound returns the error calls to unknown methods are ended with.
+func errMethodNotFound(method []string) error {
+	return errors.New(methodNotFoundPrefix + methodString(method))
+}
+
+// IsMethodNotFound returns whether err is the error a peer using HandlerMux
+// replies with when the called method has no handler.
+func IsMethodNotFound(err error) bool {
+	callErr, ok := errors.Cause(err).(*CallError)
+	return ok && strings.HasPrefix(callErr.Message, methodNotFoundPrefix)
+}
@@ -0,0 +1,175 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// returnHandler returns a handler that replies to async calls with v.
+func returnHandler(v func(*Request) string) Handler {
+	return &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			req.Return(ctx, v(req))
+		},
+		connect: noopConnect,
+	}
+}
+
+func TestHandlerMuxWildcard(t *testing.T) {
+	r := require.New(t)
+
+	var mux HandlerMux
+	mux.Handle([]string{"whoami"}, returnHandler(func(*Request) string { return "route" }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// without wildcard, unknown methods fail
+	res, err := TestCall(ctx, &mux, &Request{Type: "async", Method: []string{"unknown"}})
+	r.NoError(err)
+	r.NotNil(res.Err)
+
+	mux.HandleWildcard(returnHandler(func(req *Request) string {
+		return "wildcard " + strings.Join(req.Method, ".")
+	}))
+
+	res, err = TestCall(ctx, &mux, &Request{Type: "async", Method: []string{"whoami"}})
+	r.NoError(err)
+	r.Equal([]interface{}{"route"}, res.Values, "specific routes win")
+
+	res, err = TestCall(ctx, &mux, &Request{Type: "async", Method: []string{"blobs", "get"}})
+	r.NoError(err)
+	r.Equal([]interface{}{"wildcard blobs.get"}, res.Values)
+}
+
+func TestHandlerMuxPrefix(t *testing.T) {
+	r := require.New(t)
+
+	var (
+		mux HandlerMux
+		wg  sync.WaitGroup
+	)
+	for _, route := range [][]string{{"blobs"}, {"blobs", "get"}} {
+		wg.Add(1)
+		go func(route []string) {
+			defer wg.Done()
+			name := strings.Join(route, ".")
+			mux.HandleFunc(route, func(ctx context.Context, req *Request) {
+				req.Return(ctx, name)
+			})
+		}(route)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for method, exp := range map[string]string{
+		"blobs.get":     "blobs.get",
+		"blobs.get.raw": "blobs.get",
+		"blobs.has":     "blobs",
+		"blobs":         "blobs",
+	} {
+		res, err := TestCall(ctx, &mux, &Request{Type: "async", Method: strings.Split(method, ".")})
+		r.NoError(err)
+		r.Equal([]interface{}{exp}, res.Values, "routing %s", method)
+	}
+
+	res, err := TestCall(ctx, &mux, &Request{Type: "async", Method: []string{"blob"}})
+	r.NoError(err)
+	r.NotNil(res.Err)
+	r.True(IsMethodNotFound(res.Err), "expected method not found, got %v", res.Err)
+	r.False(IsMethodNotFound(errors.New("method not found: blob")), "expected only call errors to match")
+}
+
+func TestHandlerMuxMethodNotFound(t *testing.T) {
+	var mux HandlerMux
+	mux.HandleFunc([]string{"whoami"}, func(ctx context.Context, req *Request) {
+		req.Return(ctx, "foo")
+	})
+
+	h1 := callerHandler(t)
+
+	rpc1, _, done := serveTestPair(t, h1, &mux)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := rpc1.Async(ctx, "string", []string{"unknown"})
+	if !IsMethodNotFound(err) {
+		t.Errorf("expected method not found from async call, got %v", err)
+	}
+
+	src, err := rpc1.Source(ctx, "string", []string{"unknown", "stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = src.Next(ctx)
+	if !IsMethodNotFound(err) {
+		t.Errorf("expected method not found from source call, got %v", err)
+	}
+}
+
+func TestHandlerMuxDottedNames(t *testing.T) {
+	r := require.New(t)
+
+	var mux HandlerMux
+	mux.Handle([]string{"a.b"}, returnHandler(func(*Request) string { return "dotted" }))
+	mux.Handle([]string{"a", "b"}, returnHandler(func(*Request) string { return "nested" }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := TestCall(ctx, &mux, &Request{Type: "async", Method: []string{"a.b"}})
+	r.NoError(err)
+	r.Equal([]interface{}{"dotted"}, res.Values)
+
+	res, err = TestCall(ctx, &mux, &Request{Type: "async", Method: []string{"a", "b"}})
+	r.NoError(err)
+	r.Equal([]interface{}{"nested"}, res.Values)
+}
+
+// funcHolder is a comparable type whose values may hold a func, which makes
+// comparing them panic.
+type funcHolder struct {
+	connect interface{}
+}
+
+func (h funcHolder) HandleCall(ctx context.Context, req *Request) {}
+
+func (h funcHolder) HandleConnect(ctx context.Context, e Endpoint) {
+	h.connect.(func())()
+}
+
+func TestHandlerMuxConnect(t *testing.T) {
+	r := require.New(t)
+
+	var ptrCalls, valCalls int32
+	ptr := &testHandler{
+		call: func(context.Context, *Request) {},
+		connect: func(context.Context, Endpoint) {
+			atomic.AddInt32(&ptrCalls, 1)
+		},
+	}
+	val := funcHolder{connect: func() { atomic.AddInt32(&valCalls, 1) }}
+
+	var mux HandlerMux
+	mux.Handle([]string{"a"}, ptr)
+	mux.Handle([]string{"b"}, ptr)
+	mux.Handle([]string{"c"}, val)
+	mux.Handle([]string{"d"}, val)
+
+	mux.HandleConnect(context.Background(), nil)
+
+	r.Equal(int32(1), atomic.LoadInt32(&ptrCalls), "the same handler should connect once")
+	r.Equal(int32(2), atomic.LoadInt32(&valCalls), "values are not deduplicated")
+}
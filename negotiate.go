@@ -0,0 +1,94 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStreamLimit is returned when opening a stream would exceed the number
+// of concurrent streams the peer advertised.
+var ErrStreamLimit = errors.New("muxrpc: peer's concurrent stream limit reached")
+
+// ErrHandshakeTimeout is returned by Serve if the peer didn't answer the
+// capability exchange within the time set using WithHandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("muxrpc: handshake timed out")
+
+// capsMethod is called by sessions using WithStreamNegotiation to learn the
+// limits of the peer. Such sessions answer it themselves, others pass it to
+// the handler like any other call.
+var capsMethod = []string{"muxrpc", "capabilities"}
+
+// capabilities is the reply to capsMethod.
+type capabilities struct {
+	// MaxStreams is the number of concurrent streams the peer accepts.
+	// Zero means unlimited.
+	MaxStreams int `json:"maxStreams"`
+}
+
+// negotiate asks the peer for its capabilities and stores its stream limit.
+// Peers that don't know capsMethod reply with an error and are not limited.
+// If the peer doesn't answer within the handshake timeout, the session is
+// terminated.
+func (r *rpc) negotiate(ctx context.Context) {
+	callCtx := ctx
+	if r.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, r.handshakeTimeout)
+		defer cancel()
+	}
+
+	v, err := r.Async(callCtx, capabilities{}, capsMethod)
+	if err != nil {
+		if callCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			r.tLock.Lock()
+			defer r.tLock.Unlock()
+
+			r.abortErr = ErrHandshakeTimeout
+			r.terminate()
+		}
+
+		return
+	}
+
+	caps, ok := v.(capabilities)
+	if !ok {
+		return
+	}
+
+	if caps.MaxStreams > 0 {
+		atomic.StoreInt32(&r.peerMaxStreams, int32(caps.MaxStreams))
+	}
+	atomic.StoreInt32(&r.peerNegotiated, 1)
+}
+
+// ConnInfo is a snapshot of the features negotiated for a session.
+type ConnInfo struct {
+	// StreamNegotiation reports whether the session exchanges stream limits
+	// with the peer, see WithStreamNegotiation.
+	StreamNegotiation bool
+
+	// PeerNegotiated reports whether the peer answered the exchange.
+	PeerNegotiated bool
+
+	// MaxStreams is the number of concurrent streams we accept and
+	// PeerMaxStreams the number the peer accepts. Zero means unlimited.
+	MaxStreams     int
+	PeerMaxStreams int
+}
+
+// ConnInfo returns the features negotiated for the session so far.
+func (r *rpc) ConnInfo() ConnInfo {
+	return ConnInfo{
+		StreamNegotiation: r.negotiateStreams,
+		PeerNegotiated:    atomic.LoadInt32(&r.peerNegotiated) == 1,
+		MaxStreams:        r.maxStreams,
+		PeerMaxStreams:    int(atomic.LoadInt32(&r.peerMaxStreams)),
+	}
+}
+
+// replyCapabilities answers a capsMethod call of the peer.
+func (r *rpc) replyCapabilities(ctx context.Context, req *Request) {
+	req.Return(ctx, capabilities{MaxStreams: r.maxStreams})
+}
@@ -0,0 +1,253 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// HandleOption configures the session created by Handle.
+type HandleOption func(*rpc)
+
+// WithConnectTimeout sets a deadline on the context passed to the handler's
+// HandleConnect, so it doesn't run forever.
+func WithConnectTimeout(d time.Duration) HandleOption {
+	return func(r *rpc) {
+		r.connectTimeout = d
+	}
+}
+
+// WithShardedRequests makes the session track pending requests in n maps with
+// their own locks instead of a single one. This reduces lock contention at
+// very high request rates.
+func WithShardedRequests(n int) HandleOption {
+	return func(r *rpc) {
+		if n > 1 {
+			r.reqs = newShardedTable(n)
+		}
+	}
+}
+
+// WithMaxMethodLength limits the method names of incoming requests to elems
+// elements and chars characters in total. Requests exceeding the limits are
+// answered with an error. A limit of zero disables the check.
+func WithMaxMethodLength(elems, chars int) HandleOption {
+	return func(r *rpc) {
+		r.maxMethodElems = elems
+		r.maxMethodChars = chars
+	}
+}
+
+// WithDefaultArgs sets arguments that are used for every outgoing call to
+// method. Arguments passed by the caller take precedence: the defaults only
+// fill the positions after the last argument the caller passed.
+func WithDefaultArgs(method []string, args ...interface{}) HandleOption {
+	return func(r *rpc) {
+		if r.defaultArgs == nil {
+			r.defaultArgs = make(map[string][]interface{})
+		}
+
+		r.defaultArgs[methodKey(method)] = args
+	}
+}
+
+// withDefaultArgs returns args extended by the default arguments of method.
+func (r *rpc) withDefaultArgs(method []string, args []interface{}) []interface{} {
+	defaults := r.defaultArgs[methodKey(method)]
+	if len(defaults) <= len(args) {
+		return args
+	}
+
+	merged := make([]interface{}, len(defaults))
+	copy(merged, defaults)
+	copy(merged, args)
+
+	return merged
+}
+
+// WithStreamNegotiation makes the session exchange stream limits with the
+// peer when Serve is called. The session advertises that it accepts at most
+// max concurrent streams, zero meaning no limit, and rejects streams beyond
+// that. Outbound streams that would exceed the limit of the peer fail with
+// ErrStreamLimit. Until the peer answered, and with peers that don't support
+// the exchange, outbound streams are not limited.
+func WithStreamNegotiation(max int) HandleOption {
+	return func(r *rpc) {
+		r.negotiateStreams = true
+		r.maxStreams = max
+	}
+}
+
+// WithRequestTTL ends requests on which nothing was sent or received for
+// longer than d with ErrRequestTimeout, on both sides. This frees the
+// resources of streams the peer abandoned without ending them. Note that
+// calls whose handler takes longer than d to answer are ended as well.
+// Requests are checked every d/2.
+func WithRequestTTL(d time.Duration) HandleOption {
+	return func(r *rpc) {
+		r.requestTTL = d
+	}
+}
+
+// WithMaxConcurrentRequests limits the number of pending requests the peer
+// may have started to n. Further requests are refused with a "too many
+// requests" error until some of them ended. Requests we started don't count.
+// This bounds the memory a misbehaving peer can make the session use.
+func WithMaxConcurrentRequests(n int) HandleOption {
+	return func(r *rpc) {
+		r.maxRequests = n
+	}
+}
+
+// WithHandshakeTimeout terminates the session if the peer doesn't answer the
+// capability exchange enabled by WithStreamNegotiation within d. Serve then
+// returns ErrHandshakeTimeout. Peers that answer with an error because they
+// don't support the exchange are not affected.
+func WithHandshakeTimeout(d time.Duration) HandleOption {
+	return func(r *rpc) {
+		r.handshakeTimeout = d
+	}
+}
+
+// WithSequenceNumbers numbers the packets sent and read on each stream, so
+// logs can show their order and reveal drops. The numbers are kept by the
+// streams, see StreamSeq, and are not sent to the peer. This is meant for
+// debugging and off by default.
+func WithSequenceNumbers() HandleOption {
+	return func(r *rpc) {
+		r.seqNumbers = true
+	}
+}
+
+// WithReceiveOverflowPolicy sets what happens with incoming packets of a
+// request whose reader doesn't keep up. See ReceiveOverflowPolicy for the
+// choices and how they lose data. The default is ReceiveCloseRequest.
+func WithReceiveOverflowPolicy(p ReceiveOverflowPolicy) HandleOption {
+	return func(r *rpc) {
+		r.rxPolicy = p
+	}
+}
+
+// WithBufferSize sets the number of received packets that are buffered for
+// every request until it is read, 5 by default. Larger buffers make fast
+// streams block less often at the cost of memory: every pending request can
+// hold up to n packets. Values below 1 are ignored. Request.BufferSize
+// overrides it for single calls.
+func WithBufferSize(n int) HandleOption {
+	return func(r *rpc) {
+		if n > 0 {
+			r.bufSize = n
+		}
+	}
+}
+
+// WithManifest makes the session check outgoing calls against m, usually the
+// manifest of the peer fetched earlier. Calls to methods that are not in m or
+// that use another call type fail without being sent. The calls the session
+// makes by itself, like keepalive pings, are not checked.
+func WithManifest(m Manifest) HandleOption {
+	return func(r *rpc) {
+		r.manifest = m
+	}
+}
+
+// WithCodec makes the session encode requests and values using c instead of
+// JSON. Only use it if the peer uses the same codec, see Codec.
+func WithCodec(c Codec) HandleOption {
+	return func(r *rpc) {
+		if c != nil {
+			r.enc = c
+		}
+	}
+}
+
+// WithReceiveTimeout sets how long Serve waits for a slow reader to make room
+// in its receive buffer before the receive overflow policy applies. While it
+// waits, packets of all other requests of the session are held back, so this
+// trades latency of the whole session for fewer overflows. A d <= 0 waits
+// indefinitely, which is the same as ReceiveBlock. The default is 1s.
+func WithReceiveTimeout(d time.Duration) HandleOption {
+	return func(r *rpc) {
+		r.rxTimeout = d
+	}
+}
+
+// WithKeepalive makes the session ping the peer every interval and
+// terminate if it doesn't reply within timeout. Serve then returns
+// ErrKeepaliveTimeout. This detects connections that died silently, which
+// would otherwise leave callers waiting forever. See keepaliveMethod for
+// what is sent. The session also answers the pings of the peer itself, so
+// async calls to gossip.ping don't reach the handler. A timeout <= 0 uses the
+// interval.
+func WithKeepalive(interval, timeout time.Duration) HandleOption {
+	return func(r *rpc) {
+		if timeout <= 0 {
+			timeout = interval
+		}
+
+		r.keepaliveInterval = interval
+		r.keepaliveTimeout = timeout
+	}
+}
+
+// WithClock makes the session use now instead of time.Now to get the current
+// time, e.g. for StartedAt, call timing and event timestamps. This allows
+// deterministic tests.
+func WithClock(now func() time.Time) HandleOption {
+	return func(r *rpc) {
+		r.now = now
+	}
+}
+
+// WithCallTiming makes AsyncWithMeta measure how long sending the request,
+// receiving the first reply packet and completing the call took. The result
+// is in the Timing field of the ResponseMeta.
+func WithCallTiming() HandleOption {
+	return func(r *rpc) {
+		r.callTiming = true
+	}
+}
+
+// WithLogger sets the logger the session reports problems to that are not
+// returned to a caller: panicking handlers, malformed packets, requests that
+// were rejected, e.g. because they couldn't be parsed, readers that didn't
+// keep up within the receive timeout and the end of Serve. By default
+// nothing is logged.
+func WithLogger(l log.Logger) HandleOption {
+	return func(r *rpc) {
+		r.logger = l
+	}
+}
+
+// WithMetrics makes the session report the calls it sends and receives, how
+// long they took and which failed to m. If the packer was created by this
+// package, it also reports the bytes it transfers, see WithPackerMetrics.
+// Without metrics, none of this is measured.
+func WithMetrics(m Metrics) HandleOption {
+	return func(r *rpc) {
+		r.metrics = m
+	}
+}
+
+// WithPanicStackTraces makes the error sent to the caller of a panicking
+// handler include the stack trace. This helps debugging, but reveals
+// internals to the peer, so it is off by default.
+func WithPanicStackTraces() HandleOption {
+	return func(r *rpc) {
+		r.panicStacks = true
+	}
+}
+
+// WithAuthorizer makes the session check incoming calls with the authorizer
+// a before passing them to the handler. If it is used several times, all
+// authorizers have to allow a call. See Authorize for checking only some
+// methods.
+//
+// The calls the session answers itself, i.e. capability negotiation, goodbye
+// and, with WithKeepalive, keepalive pings, never reach the handler and are
+// not checked.
+func WithAuthorizer(a Authorizer) HandleOption {
+	return func(r *rpc) {
+		r.authz = append(r.authz, a)
+	}
+}
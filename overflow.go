@@ -0,0 +1,131 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync/atomic"
+
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReceiveOverflow is the error requests are ended with if their handler
+// doesn't keep up reading and the ReceiveCloseRequest policy is used.
+var ErrReceiveOverflow = errors.New("muxrpc: receive buffer overflow")
+
+// ReceiveOverflowPolicy decides what happens with incoming packets for a
+// request whose receive buffer is full because the reader doesn't keep up.
+type ReceiveOverflowPolicy int
+
+const (
+	// ReceiveCloseRequest ends the request with ErrReceiveOverflow on both
+	// sides. The remaining packets of the request are lost, other requests
+	// are not affected. This is the default.
+	ReceiveCloseRequest ReceiveOverflowPolicy = iota
+
+	// ReceiveBlock waits until there is room in the buffer. No data is lost,
+	// but all requests of the session stall until the reader catches up.
+	ReceiveBlock
+
+	// ReceiveDropOldest discards the oldest buffered packet to make room.
+	// The reader misses packets, but sees the most recent ones.
+	ReceiveDropOldest
+
+	// ReceiveDropNewest discards the incoming packet. The reader misses
+	// packets, but sees them in the order they arrived up to the gap.
+	ReceiveDropNewest
+)
+
+// deliver passes pkt to the handler or caller reading req, following the
+// receive overflow policy if they don't keep up.
+func (r *rpc) deliver(ctx context.Context, req *Request, pkt *codec.Packet) error {
+	// only wait with a timeout if the buffer is full, so a late timer
+	// can't win over a free slot
+	if r.rxPolicy == ReceiveBlock || r.rxTimeout <= 0 || hasRoom(req) {
+		err := r.pourIn(ctx, req, pkt)
+		if err != nil && ctx.Err() == nil {
+			if _, ok := r.reqs.Get(pkt.Req); !ok {
+				// the request was cancelled while we waited
+				return nil
+			}
+		}
+		return errors.Wrap(err, "error pouring data to handler")
+	}
+
+	err := r.pourTimeout(ctx, req, pkt)
+	if err == nil {
+		return nil
+	} else if ctx.Err() != nil {
+		return errors.Wrap(err, "error pouring data to handler")
+	} else if hasRoom(req) {
+		// the reader made room just as the timeout passed
+		return errors.Wrap(r.pourIn(ctx, req, pkt), "error pouring data to handler")
+	}
+
+	r.logger.Log("event", "receive timeout", "req", pkt.Req, "method", methodString(req.Method), "timeout", r.rxTimeout)
+
+	switch r.rxPolicy {
+	case ReceiveDropOldest:
+		if str, ok := req.Stream.(*stream); ok {
+			dropCtx, cancel := context.WithTimeout(ctx, r.rxTimeout)
+			str.dropOldest(dropCtx)
+			cancel()
+		}
+
+		// either way one packet is lost: if there still is no room, the new one
+		r.pourTimeout(ctx, req, pkt)
+		r.emit(Event{Type: EventError, Req: pkt.Req, Method: req.Method, Err: ErrReceiveOverflow})
+	case ReceiveDropNewest:
+		r.emit(Event{Type: EventError, Req: pkt.Req, Method: req.Method, Err: ErrReceiveOverflow})
+	default:
+		r.rLock.Lock()
+		defer r.rLock.Unlock()
+
+		r.cancelRequest(pkt.Req, req, ErrReceiveOverflow)
+	}
+
+	return nil
+}
+
+// hasRoom tells whether the receive buffer of req can take a packet without
+// waiting. If that is not known, it returns false.
+func hasRoom(req *Request) bool {
+	str, ok := req.Stream.(*stream)
+	return ok && atomic.LoadInt32(&str.buffered) < str.bufSize
+}
+
+// pourTimeout pours pkt into req.in, waiting at most r.rxTimeout.
+func (r *rpc) pourTimeout(ctx context.Context, req *Request, pkt *codec.Packet) error {
+	ctx, cancel := context.WithTimeout(ctx, r.rxTimeout)
+	defer cancel()
+
+	return r.pourIn(ctx, req, pkt)
+}
+
+// pourIn pours pkt into req.in and keeps track of the buffer occupancy.
+func (r *rpc) pourIn(ctx context.Context, req *Request, pkt *codec.Packet) error {
+	str, ok := req.Stream.(*stream)
+	if !ok {
+		return req.in.Pour(ctx, pkt)
+	}
+
+	storeMax(&r.highWater, str.addBuffered())
+
+	err := req.in.Pour(ctx, pkt)
+	if err != nil {
+		str.unbuffer()
+	}
+
+	return err
+}
+
+// dropOldest discards the oldest packet in the receive buffer of the stream.
+// It holds the stream's lock like Next, so it doesn't race a reader.
+func (str *stream) dropOldest(ctx context.Context) {
+	str.l.Lock()
+	defer str.l.Unlock()
+
+	if _, err := str.pktSrc.Next(ctx); err == nil {
+		str.unbuffer()
+	}
+}
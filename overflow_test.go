@@ -0,0 +1,226 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestReceiveOverflowPolicy(t *testing.T) {
+	const n = defaultBufSize * 2
+
+	type testcase struct {
+		policy ReceiveOverflowPolicy
+		exp    []string
+	}
+
+	var first, last []string
+	for i := 0; i < n; i++ {
+		if i < defaultBufSize {
+			first = append(first, fmt.Sprint(i))
+		} else {
+			last = append(last, fmt.Sprint(i))
+		}
+	}
+
+	for _, tc := range []testcase{
+		{ReceiveDropNewest, first},
+		{ReceiveDropOldest, last},
+	} {
+		release := make(chan struct{})
+		got := make(chan []string, 1)
+
+		h1 := &testHandler{
+			call: func(ctx context.Context, req *Request) {
+				t.Errorf("unexpected call to rpc1: %#v", req)
+			},
+			connect: noopConnect,
+		}
+
+		h2 := &testHandler{
+			call: func(ctx context.Context, req *Request) {
+				<-release
+
+				var vs []string
+				for i := 0; i < defaultBufSize; i++ {
+					v, err := req.Stream.Next(ctx)
+					if err != nil {
+						t.Error(err)
+						break
+					}
+					vs = append(vs, v.(string))
+				}
+				got <- vs
+			},
+			connect: noopConnect,
+		}
+
+		rpc1, rpc2, done := serveTestPair(t, h1, h2,
+			WithReceiveOverflowPolicy(tc.policy), WithReceiveTimeout(time.Millisecond))
+
+		ctx := context.Background()
+		sink, err := rpc1.Sink(ctx, []string{"upload"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			err := sink.Pour(ctx, fmt.Sprint(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// wait until the excess packets were dropped
+		for i := 0; i < n-defaultBufSize; i++ {
+			ev := nextEvent(t, rpc2, EventError)
+			if ev.Err != ErrReceiveOverflow {
+				t.Errorf("unexpected error event %+v", ev)
+			}
+		}
+		close(release)
+
+		if vs := <-got; strings.Join(vs, ",") != strings.Join(tc.exp, ",") {
+			t.Errorf("policy %d: expected %v, got %v", tc.policy, tc.exp, vs)
+		}
+
+		// every dropped packet is reported once
+	events:
+		for {
+			select {
+			case ev := <-rpc2.(EventSource).Events():
+				if ev.Type == EventError {
+					t.Errorf("policy %d: unexpected extra event %+v", tc.policy, ev)
+				}
+			default:
+				break events
+			}
+		}
+
+		sink.Close()
+		done()
+	}
+}
+
+func TestReceiveOverflowCloseRequest(t *testing.T) {
+	release := make(chan struct{})
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Type == "async" {
+				req.Return(ctx, "still here")
+				return
+			}
+
+			<-release
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+	defer close(release)
+
+	ctx := context.Background()
+	src, sink, err := rpc1.Duplex(ctx, "string", []string{"upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < defaultBufSize*2; i++ {
+		err := sink.Pour(ctx, fmt.Sprint(i))
+		if err != nil {
+			break
+		}
+	}
+
+	_, err = src.Next(ctx)
+	if err == nil || !strings.Contains(err.Error(), ErrReceiveOverflow.Error()) {
+		t.Errorf("expected overflow error, got %v", err)
+	}
+
+	v, err := rpc1.Async(ctx, "string", []string{"ping"})
+	if err != nil || v != "still here" {
+		t.Errorf("expected session to survive, got %v, %v", v, errors.Cause(err))
+	}
+}
+
+func TestReceiveTimeout(t *testing.T) {
+	const n = defaultBufSize * 3
+	got := make(chan []string, 1)
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Type == "async" {
+				req.Return(ctx, "still here")
+				return
+			}
+
+			var vs []string
+			for {
+				time.Sleep(5 * time.Millisecond)
+				v, err := req.Stream.Next(ctx)
+				if err != nil {
+					break
+				}
+				vs = append(vs, v.(string))
+			}
+			got <- vs
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	sink, err := rpc1.Sink(ctx, []string{"upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		err := sink.Pour(ctx, fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v, err := rpc1.Async(ctx, "string", []string{"ping"})
+	if err != nil || v != "still here" {
+		t.Errorf("expected second request to complete, got %v, %v", v, errors.Cause(err))
+	}
+
+	sink.Close()
+	if vs := <-got; len(vs) != n {
+		t.Errorf("expected slow consumer to get all %d values, got %v", n, vs)
+	}
+}
+
+func TestReceiveTimeoutWithRoom(t *testing.T) {
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			req.Return(ctx, "ok")
+		},
+		connect: noopConnect,
+	}
+
+	// the timeout passes before the pour even starts, which must not
+	// matter while the buffer has room
+	rpc1, _, done := serveTestPair(t, callerHandler(t), h2, WithReceiveTimeout(time.Nanosecond))
+	defer done()
+
+	for i := 0; i < 50; i++ {
+		if _, err := rpc1.Async(context.Background(), "string", []string{"whoami"}); err != nil {
+			t.Fatalf("call %d failed: %v", i, err)
+		}
+	}
+}
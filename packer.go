@@ -3,7 +3,10 @@ package muxrpc // import "cryptoscope.co/go/muxrpc"
 import (
 	"context"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"cryptoscope.co/go/luigi"
 	"cryptoscope.co/go/muxrpc/codec"
@@ -18,27 +21,239 @@ type Packer interface {
 	luigi.Sink
 }
 
+// Flusher is implemented by packers that can flush buffered packets, like
+// those created by NewPacker. Packers write every packet right away unless
+// WithWriteCoalescing is used, but if the writer they wrap buffers, like a
+// bufio.Writer, the packets stay in that buffer until Flush is called.
+// Sessions on such a writer need to flush after sending, otherwise the peer
+// may wait for requests and replies forever.
+type Flusher interface {
+	Flush() error
+}
+
+// ErrOutboundQueueFull is returned by Pour if the outbound queue is full and
+// the QueueError policy is used.
+var ErrOutboundQueueFull = errors.New("muxrpc: outbound queue full")
+
+// QueuePolicy decides what Pour does when the outbound queue is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock makes Pour wait until there is room in the queue or the
+	// context is cancelled.
+	QueueBlock QueuePolicy = iota
+
+	// QueueError makes Pour return ErrOutboundQueueFull immediately.
+	QueueError
+)
+
+// PackerOption configures a packer created by NewPacker.
+type PackerOption func(*packer)
+
+// WithMaxOutboundQueue limits the number of packets that are waiting to be
+// written to n. This bounds the memory used if a producer outpaces the network.
+// policy decides what happens when the queue is full.
+func WithMaxOutboundQueue(n int, policy QueuePolicy) PackerOption {
+	return func(pkr *packer) {
+		pkr.queue = make(chan struct{}, n)
+		pkr.queuePolicy = policy
+	}
+}
+
+// ErrWriteTimeout is returned by Pour if writing a packet took longer than
+// the timeout set using WithWriteTimeout.
+var ErrWriteTimeout = errors.New("muxrpc: write timed out")
+
+// WithPackerMetrics makes the packer report the number of bytes it sends and
+// receives to m. Handle does that for packers created by this package if
+// WithMetrics is used.
+func WithPackerMetrics(m Metrics) PackerOption {
+	return func(pkr *packer) {
+		pkr.metrics = m
+	}
+}
+
+// WithMaxPacketSize makes Next fail with an error whose cause is
+// codec.ErrBodyTooLarge if the peer announces a packet body larger than n
+// bytes. This is checked before the body is allocated. The default is
+// codec.DefaultMaxBodySize, zero disables the check.
+func WithMaxPacketSize(n uint32) PackerOption {
+	return func(pkr *packer) {
+		pkr.maxBodySize = n
+	}
+}
+
+// WithWriteCoalescing makes the packer collect outgoing stream packets in a
+// buffer of size bytes, so many small packets are sent using few writes. The
+// buffer is written out when it is full, at most delay after the first
+// packet was put in it, or when Flush is called. This also delays requests
+// that open streams. Packets that are not part of a stream and those that
+// end a stream are sent right away, along with what was buffered before, so
+// async calls and the ends of streams aren't held back. A delay <= 0 uses 1ms.
+func WithWriteCoalescing(size int, delay time.Duration) PackerOption {
+	return func(pkr *packer) {
+		if delay <= 0 {
+			delay = time.Millisecond
+		}
+
+		pkr.coalesce = true
+		pkr.bufSize = size
+		pkr.flushDelay = delay
+	}
+}
+
+// WithWriteTimeout makes every Pour fail with ErrWriteTimeout if the packet
+// could not be written within d, independent of the context passed to Pour.
+// This protects against peers that never drain the connection.
+// Since the packet may have been written partially, the underlying connection
+// is closed after a timeout, unless it supports write deadlines and nothing
+// was written yet.
+func WithWriteTimeout(d time.Duration) PackerOption {
+	return func(pkr *packer) {
+		pkr.writeTimeout = d
+	}
+}
+
 // NewPacker takes an io.ReadWriteCloser and returns a Packer.
-func NewPacker(rwc io.ReadWriteCloser) Packer {
-	return &packer{
-		r: codec.NewReader(rwc),
-		w: codec.NewWriter(rwc),
-		c: rwc,
+// The request ids of received packets are negated, so requests started by the
+// remote have negative ids and replies to our requests have positive ids.
+func NewPacker(rwc io.ReadWriteCloser, opts ...PackerOption) Packer {
+	return NewPackerReadWriter(rwc, rwc, rwc, opts...)
+}
+
+// NewPackerReadWriter is like NewPacker but reads packets from r and writes
+// them to w. Closing the packer closes c. Use it for transports that come in
+// two halves, like stdin and stdout.
+func NewPackerReadWriter(r io.Reader, w io.Writer, c io.Closer, opts ...PackerOption) Packer {
+	pkr := newPacker(r, w, c, opts...)
+	pkr.invert = true
+
+	return pkr
+}
+
+// NewRawPacker is like NewPacker but returns received packets with the
+// request ids as they were sent, leaving id handling to the caller. This is
+// meant for bridges and custom multiplexers.
+//
+// Note that Handle relies on the inversion done by NewPacker: ParseRequest
+// expects the ids of incoming requests to be negative, so a raw packer can't be
+// used with Handle directly.
+func NewRawPacker(rwc io.ReadWriteCloser, opts ...PackerOption) Packer {
+	return newPacker(rwc, rwc, rwc, opts...)
+}
+
+// NewLoopbackPackers returns two packers that are connected in memory: a
+// packet poured into one arrives at the other. Both invert request ids like
+// NewPacker, so each can be passed to Handle. Closing one makes Next on the
+// other return luigi.EOS. This is mostly useful for testing handlers.
+func NewLoopbackPackers(opts ...PackerOption) (Packer, Packer) {
+	c1, c2 := net.Pipe()
+	return NewPacker(c1, opts...), NewPacker(c2, opts...)
+}
+
+func newPacker(r io.Reader, w io.Writer, c io.Closer, opts ...PackerOption) *packer {
+	cw := &countWriter{w: w}
+	pkr := &packer{
+		c:  c,
+		cw: cw,
+
+		maxBodySize: codec.DefaultMaxBodySize,
 
 		closing: make(chan struct{}),
+
+		watch:   make(chan (<-chan struct{})),
+		written: make(chan struct{}),
+		ops:     make(chan func() error),
+		opErr:   make(chan error, 1),
+	}
+
+	if dl, ok := c.(deadliner); ok && dl.SetWriteDeadline(time.Time{}) == nil {
+		pkr.dl = dl
+	}
+
+	for _, opt := range opts {
+		opt(pkr)
+	}
+
+	pkr.r = codec.NewReaderWithLimit(r, pkr.maxBodySize)
+	if pkr.coalesce {
+		pkr.w = codec.NewBufferedWriter(cw, pkr.bufSize)
+	} else {
+		pkr.w = codec.NewWriter(cw)
 	}
+
+	return pkr
 }
 
-// packer wraps an io.ReadWriteCloser and implements Packer.
+// packer wraps a reader, a writer and a closer and implements Packer.
 type packer struct {
 	rl sync.Mutex
 	wl sync.Mutex
 
-	r *codec.Reader
-	w *codec.Writer
-	c io.Closer
+	r  *codec.Reader
+	w  *codec.Writer
+	c  io.Closer
+	cw *countWriter
 
 	closing chan struct{}
+
+	// closeOnce makes Close idempotent. closeErr is what the first Close
+	// returned.
+	closeOnce sync.Once
+	closeErr  error
+
+	// queue holds one element for every packet that is waiting to be written.
+	// nil if the queue is unbounded.
+	queue       chan struct{}
+	queuePolicy QueuePolicy
+
+	// space is closed when a slot in the queue frees up. It is created on
+	// demand by Writable and guarded by spaceL.
+	spaceL sync.Mutex
+	space  chan struct{}
+
+	// maxBodySize is the largest body Next accepts, zero means unlimited
+	maxBodySize uint32
+
+	// coalesce is set if w buffers packets. Those that may wait are flushed
+	// flushDelay after the first of them was written, flushPending tells
+	// whether that is scheduled already. Guarded by wl.
+	coalesce     bool
+	bufSize      int
+	flushDelay   time.Duration
+	flushPending bool
+
+	// writeTimeout bounds the duration of a write if non-zero
+	writeTimeout time.Duration
+
+	// dl is set if the connection supports write deadlines. Its writes are
+	// interrupted by watchWrites, which gets them on watch and is told on
+	// written that they finished. interrupted is set by watchWrites before
+	// that if it interrupted the write.
+	dl          deadliner
+	watchOnce   sync.Once
+	watch       chan (<-chan struct{})
+	written     chan struct{}
+	interrupted bool
+
+	// Other connections are written to by runWrites, which gets the writes
+	// on ops and sends their results on opErr. pending is set while a write
+	// that was given up on still runs. Guarded by wl.
+	writerOnce sync.Once
+	ops        chan func() error
+	opErr      chan error
+	pending    bool
+
+	// abandoned is the error of a write that was given up on after a part of
+	// its packet went out. The packer is closed then and all later writes
+	// fail with it. Guarded by wl.
+	abandoned error
+
+	// invert makes Next negate the request ids of received packets
+	invert bool
+
+	// metrics is told the number of bytes sent and received if not nil
+	metrics Metrics
 }
 
 // Next returns the next packet from the underlying stream.
@@ -61,13 +276,41 @@ func (pkr *packer) Next(ctx context.Context) (interface{}, error) {
 		return nil, errors.Wrap(err, "ReadPacket failed.")
 	}
 
-	pkt.Req = -pkt.Req
+	if pkr.invert {
+		pkt.Req = -pkt.Req
+	}
+
+	if pkr.metrics != nil {
+		pkr.metrics.AddBytes(Received, wireSize(pkt))
+	}
 
 	return pkt, nil
 }
 
-// Pour sends a packet to the underlying stream.
+// Pour sends a packet to the underlying stream. If ctx is cancelled while
+// the packet is being written, Pour gives up and returns the context's error.
+// A packet that was written partially would corrupt the framing, so in that
+// case the underlying connection is closed. If the connection doesn't support
+// write deadlines, the abandoned write can't be stopped. It keeps running
+// and its packet may still go out before the next one.
 func (pkr *packer) Pour(ctx context.Context, v interface{}) error {
+	if pkr.queue != nil {
+		select {
+		case pkr.queue <- struct{}{}:
+		default:
+			if pkr.queuePolicy == QueueError {
+				return ErrOutboundQueueFull
+			}
+
+			select {
+			case pkr.queue <- struct{}{}:
+			case <-ctx.Done():
+				return errors.Wrap(ctx.Err(), "error waiting for room in outbound queue")
+			}
+		}
+		defer pkr.release()
+	}
+
 	pkr.wl.Lock()
 	defer pkr.wl.Unlock()
 
@@ -76,7 +319,19 @@ func (pkr *packer) Pour(ctx context.Context, v interface{}) error {
 		return errors.Errorf("packer sink expected type *codec.Packet, got %T", v)
 	}
 
-	err := pkr.w.WritePacket(pkt)
+	if pkr.abandoned != nil {
+		return errors.Wrap(pkr.abandoned, "packer closed after abandoned write")
+	}
+
+	err := pkr.write(ctx, func() error { return pkr.writePacket(pkt) })
+	if err != nil && (err == ErrWriteTimeout || ctx.Err() != nil) {
+		return err
+	}
+
+	if err == nil && pkr.metrics != nil {
+		pkr.metrics.AddBytes(Sent, wireSize(pkt))
+	}
+
 	select {
 	case <-pkr.closing:
 		return nil
@@ -86,9 +341,331 @@ func (pkr *packer) Pour(ctx context.Context, v interface{}) error {
 
 }
 
-// Close closes the packer.
+// writePacket writes pkt. If writes are coalesced, stream packets that don't
+// end the stream may wait in the buffer for up to flushDelay, all others are
+// flushed right away so calls and their ends don't hang. Must be called with
+// pkr.wl held.
+func (pkr *packer) writePacket(pkt *codec.Packet) error {
+	err := pkr.w.WritePacket(pkt)
+	if err != nil || !pkr.coalesce {
+		return err
+	}
+
+	if !pkt.Flag.Get(codec.FlagStream) || pkt.Flag.Get(codec.FlagEndErr) {
+		return pkr.w.Flush()
+	}
+
+	if !pkr.flushPending && pkr.w.Buffered() > 0 {
+		pkr.flushPending = true
+		time.AfterFunc(pkr.flushDelay, pkr.delayedFlush)
+	}
+
+	return nil
+}
+
+// delayedFlush flushes the packets that waited in the write buffer for
+// flushDelay.
+func (pkr *packer) delayedFlush() {
+	pkr.wl.Lock()
+	defer pkr.wl.Unlock()
+
+	pkr.flushPending = false
+	if pkr.w.Buffered() > 0 {
+		pkr.write(context.Background(), pkr.w.Flush)
+	}
+}
+
+// Flush flushes the underlying writer if it buffers, see Flusher.
+func (pkr *packer) Flush() error {
+	pkr.wl.Lock()
+	defer pkr.wl.Unlock()
+
+	return pkr.write(context.Background(), pkr.w.Flush)
+}
+
+// release frees a slot in the outbound queue and wakes up those waiting in
+// Writable.
+func (pkr *packer) release() {
+	<-pkr.queue
+
+	pkr.spaceL.Lock()
+	defer pkr.spaceL.Unlock()
+
+	if pkr.space != nil {
+		close(pkr.space)
+		pkr.space = nil
+	}
+}
+
+// Writable returns a channel that is closed once there is room in the
+// outbound queue. If the queue is unbounded, the channel is closed already.
+func (pkr *packer) Writable() <-chan struct{} {
+	if pkr.queue == nil {
+		return closedCh
+	}
+
+	pkr.spaceL.Lock()
+	defer pkr.spaceL.Unlock()
+
+	if len(pkr.queue) < cap(pkr.queue) {
+		return closedCh
+	}
+
+	if pkr.space == nil {
+		pkr.space = make(chan struct{})
+	}
+
+	return pkr.space
+}
+
+// closedCh is a closed channel, returned by Writable if there is room.
+var closedCh = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// deadliner is implemented by connections that support write deadlines, like net.Conn.
+type deadliner interface {
+	SetWriteDeadline(time.Time) error
+}
+
+// write calls op, which writes to the connection, giving up if ctx is done or
+// the write timeout passed. If nothing can end the write early, op is called
+// right away. Must be called with pkr.wl held.
+func (pkr *packer) write(ctx context.Context, op func() error) error {
+	if pkr.abandoned != nil {
+		return errors.Wrap(pkr.abandoned, "packer closed after abandoned write")
+	}
+
+	if ctx.Done() == nil && pkr.writeTimeout <= 0 && !pkr.pending {
+		return op()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "write cancelled")
+	}
+
+	if pkr.dl != nil {
+		return pkr.writeDeadline(ctx, op)
+	}
+
+	return pkr.writeAsync(ctx, op)
+}
+
+// writeDeadline calls op on a connection that supports write deadlines.
+// watchWrites moves the deadline into the past if ctx is done or the write
+// timeout passes, which interrupts the write. The connection is only closed
+// if a part of the packet went out.
+func (pkr *packer) writeDeadline(ctx context.Context, op func() error) error {
+	pkr.watchOnce.Do(func() { go pkr.watchWrites() })
+
+	select {
+	case pkr.watch <- ctx.Done():
+	case <-pkr.closing:
+		// the connection is closed, so op fails right away
+		return op()
+	}
+
+	start := pkr.cw.count()
+	err := op()
+	pkr.written <- struct{}{}
+
+	if !pkr.interrupted {
+		return err
+	}
+
+	pkr.interrupted = false
+	pkr.dl.SetWriteDeadline(time.Time{})
+
+	if te, ok := errors.Cause(err).(interface{ Timeout() bool }); !ok || !te.Timeout() {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		err = errors.Wrap(ctx.Err(), "write cancelled")
+	} else {
+		err = ErrWriteTimeout
+	}
+
+	if pkr.cw.count() != start || pkr.coalesce {
+		// the packet was written partially, so the stream is broken. the
+		// write buffer doesn't recover from errors either.
+		pkr.abandon(err)
+	}
+
+	return err
+}
+
+// watchWrites interrupts the writes of writeDeadline. For every write it
+// receives the done channel of its context on pkr.watch and waits for it,
+// the write timeout or pkr.written. It runs until the packer is closed.
+func (pkr *packer) watchWrites() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		var done <-chan struct{}
+		select {
+		case done = <-pkr.watch:
+		case <-pkr.closing:
+			return
+		}
+
+		var timeout <-chan time.Time
+		if pkr.writeTimeout > 0 {
+			timer.Reset(pkr.writeTimeout)
+			timeout = timer.C
+		}
+
+		select {
+		case <-pkr.written:
+		case <-done:
+			pkr.interrupt()
+		case <-timeout:
+			timeout = nil
+			pkr.interrupt()
+		}
+
+		if timeout != nil && !timer.Stop() {
+			<-timer.C
+		}
+	}
+}
+
+// interrupt makes the current write of writeDeadline fail and waits for it.
+func (pkr *packer) interrupt() {
+	pkr.interrupted = true
+	pkr.dl.SetWriteDeadline(time.Unix(1, 0))
+	<-pkr.written
+}
+
+// writeAsync hands op to runWrites for connections that don't support write
+// deadlines. A write that is given up on can't be stopped, so it keeps
+// running and the next one waits for it. Its packet may still go out, unless
+// a part of it already did, in which case the connection is closed.
+func (pkr *packer) writeAsync(ctx context.Context, op func() error) error {
+	pkr.writerOnce.Do(func() { go pkr.runWrites() })
+
+	var timeout <-chan time.Time
+	if pkr.writeTimeout > 0 {
+		t := time.NewTimer(pkr.writeTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	if pkr.pending {
+		select {
+		case err := <-pkr.opErr:
+			pkr.pending = false
+			if err != nil {
+				return errors.Wrap(err, "earlier write failed")
+			}
+		case <-timeout:
+			return ErrWriteTimeout
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "write cancelled")
+		case <-pkr.closing:
+			return io.ErrClosedPipe
+		}
+	}
+
+	start := pkr.cw.count()
+	select {
+	case pkr.ops <- op:
+	case <-pkr.closing:
+		// the connection is closed, so op fails right away
+		return op()
+	}
+
+	var err error
+	select {
+	case err = <-pkr.opErr:
+		return err
+	case <-timeout:
+		err = ErrWriteTimeout
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "write cancelled")
+	}
+
+	pkr.pending = true
+	if pkr.cw.count() != start || pkr.coalesce {
+		// the packet was written partially, so the stream is broken
+		pkr.abandon(err)
+	}
+
+	return err
+}
+
+// runWrites calls the writes it receives on pkr.ops one after the other and
+// sends their results on pkr.opErr. It runs until the packer is closed.
+func (pkr *packer) runWrites() {
+	for {
+		select {
+		case op := <-pkr.ops:
+			pkr.opErr <- op()
+		case <-pkr.closing:
+			return
+		}
+	}
+}
+
+// abandon closes the packer after a packet was written partially. All later
+// writes fail with err. Must be called with pkr.wl held.
+func (pkr *packer) abandon(err error) {
+	pkr.abandoned = err
+	pkr.Close()
+}
+
+// countWriter counts the bytes written to w, so an interrupted write can tell
+// whether it left a partial packet behind.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(&cw.n, int64(n))
+	return n, err
+}
+
+// Flush flushes w if it has a Flush method.
+func (cw *countWriter) Flush() error {
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+func (cw *countWriter) count() int64 {
+	return atomic.LoadInt64(&cw.n)
+}
+
+// remoteAddrer is implemented by connections that know the address of the
+// peer, like net.Conn.
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
+// RemoteAddr returns the address of the peer if the underlying connection
+// has one, and nil otherwise, e.g. for pipes.
+func (pkr *packer) RemoteAddr() net.Addr {
+	if conn, ok := pkr.c.(remoteAddrer); ok {
+		return conn.RemoteAddr()
+	}
+
+	return nil
+}
+
+// Close closes the packer. Closing it again does nothing and returns the
+// same error as the first time.
 func (pkr *packer) Close() error {
-	close(pkr.closing)
+	pkr.closeOnce.Do(func() {
+		close(pkr.closing)
+		pkr.closeErr = pkr.c.Close()
+	})
 
-	return pkr.c.Close()
+	return pkr.closeErr
 }
@@ -0,0 +1,393 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/luigi"
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackerMaxOutboundQueue(t *testing.T) {
+	r := require.New(t)
+
+	for _, policy := range []QueuePolicy{QueueError, QueueBlock} {
+		c1, _ := net.Pipe()
+		pkr := NewPacker(c1, WithMaxOutboundQueue(1, policy)).(*packer)
+
+		// nobody reads from the other end, so this blocks and fills the queue
+		go pkr.Pour(context.Background(), newEndOkayPacket(1))
+		for len(pkr.queue) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := pkr.Pour(ctx, &codec.Packet{Req: 2, Body: []byte("foo")})
+		cancel()
+
+		if policy == QueueError {
+			r.Equal(ErrOutboundQueueFull, err)
+		} else {
+			r.Equal(context.DeadlineExceeded, errors.Cause(err))
+		}
+
+		r.NoError(pkr.Close())
+	}
+}
+
+func TestPackerWriteTimeout(t *testing.T) {
+	r := require.New(t)
+
+	// net.Pipe supports write deadlines
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// an io.Pipe based connection doesn't
+	pr, pw := io.Pipe()
+	pipeConn := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{pr, pw, pw}
+
+	for _, conn := range []io.ReadWriteCloser{c1, pipeConn} {
+		// nobody reads from the other end
+		pkr := NewPacker(conn, WithWriteTimeout(10*time.Millisecond))
+
+		start := time.Now()
+		err := pkr.Pour(context.Background(), newEndOkayPacket(1))
+		r.Equal(ErrWriteTimeout, err)
+		r.True(time.Since(start) < time.Second, "write took too long")
+
+		if conn == pipeConn {
+			// the abandoned write is still running, so later writes
+			// wait for it
+			err = pkr.Pour(context.Background(), newEndOkayPacket(2))
+			r.Equal(ErrWriteTimeout, errors.Cause(err))
+		}
+
+		pkr.Close()
+	}
+}
+
+func TestPackerPourContext(t *testing.T) {
+	r := require.New(t)
+
+	// net.Pipe supports write deadlines, so an interrupted write that didn't
+	// send anything leaves the packer usable
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	pkr := NewPacker(c1)
+	defer pkr.(*packer).Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// nobody reads from the other end
+	err := pkr.Pour(ctx, newEndOkayPacket(1))
+	r.Error(err)
+	r.Equal(context.DeadlineExceeded, errors.Cause(err))
+
+	go pkr.Pour(context.Background(), newEndOkayPacket(2))
+	pkt, err := codec.NewReader(c2).ReadPacket()
+	r.NoError(err, "error reading packet after cancelled write")
+	r.Equal(int32(2), pkt.Req)
+
+	// an io.Pipe based connection doesn't, so the write keeps running and
+	// its packet still goes out once the peer reads
+	pr, pw := io.Pipe()
+	pkr = NewPacker(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{pr, pw, pw})
+	defer pkr.(*packer).Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	err = pkr.Pour(ctx, newEndOkayPacket(1))
+	r.Equal(context.Canceled, errors.Cause(err))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = pkr.Pour(ctx, newEndOkayPacket(2))
+	r.Equal(context.DeadlineExceeded, errors.Cause(err))
+
+	go pkr.Pour(context.Background(), newEndOkayPacket(3))
+	rd := codec.NewReader(pr)
+	for _, req := range []int32{2, 3} {
+		pkt, err := rd.ReadPacket()
+		r.NoError(err, "error reading packet after cancelled write")
+		r.Equal(req, pkt.Req)
+	}
+
+	// if a part of the packet went out, the connection is closed
+	pr, pw = io.Pipe()
+	pkr = NewPacker(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{pr, pw, pw})
+
+	// only read the header, so writing the body blocks
+	go io.ReadFull(pr, make([]byte, 9))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = pkr.Pour(ctx, &codec.Packet{Req: 1, Body: []byte("foo")})
+	r.Equal(context.DeadlineExceeded, errors.Cause(err))
+
+	err = pkr.Pour(context.Background(), newEndOkayPacket(2))
+	r.Error(err, "expected connection to be closed")
+}
+
+func TestPackerInvertsRequestID(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	pkr := NewPacker(c1)
+	defer pkr.Close()
+
+	go codec.NewWriter(c2).WritePacket(&codec.Packet{Flag: codec.FlagString, Req: 5, Body: []byte("x")})
+
+	v, err := pkr.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req := v.(*codec.Packet).Req; req != -5 {
+		t.Errorf("expected request id -5, got %d", req)
+	}
+}
+
+func TestRawPackerKeepsRequestID(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	pkr := NewRawPacker(c1)
+	defer pkr.Close()
+
+	go codec.NewWriter(c2).WritePacket(&codec.Packet{Flag: codec.FlagString, Req: 5, Body: []byte("x")})
+
+	v, err := pkr.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req := v.(*codec.Packet).Req; req != 5 {
+		t.Errorf("expected request id 5, got %d", req)
+	}
+}
+
+func TestPackerCloseTwice(t *testing.T) {
+	r := require.New(t)
+
+	c1, _ := net.Pipe()
+	pkr := NewPacker(c1).(*packer)
+
+	r.NoError(pkr.Close())
+	r.NoError(pkr.Close(), "closing again should not fail or panic")
+}
+
+func TestPackerReadWriter(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	pkr := NewPackerReadWriter(inR, outW, outW)
+	peer := NewRawPacker(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{outR, inW, inW})
+	defer peer.Close()
+
+	go peer.Pour(ctx, &codec.Packet{Flag: codec.FlagString, Req: 5, Body: []byte("in")})
+	v, err := pkr.Next(ctx)
+	r.NoError(err, "error reading packet")
+	r.Equal(int32(-5), v.(*codec.Packet).Req, "expected request id to be inverted")
+	r.Equal("in", string(v.(*codec.Packet).Body))
+
+	go pkr.Pour(ctx, &codec.Packet{Flag: codec.FlagString, Req: 5, Body: []byte("out")})
+	v, err = peer.Next(ctx)
+	r.NoError(err, "error reading packet")
+	r.Equal("out", string(v.(*codec.Packet).Body))
+
+	r.NoError(pkr.Close())
+	_, err = peer.Next(ctx)
+	r.True(luigi.IsEOS(err), "expected end of stream after close, got %v", err)
+}
+
+func TestLoopbackPackers(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	pkr1, pkr2 := NewLoopbackPackers()
+
+	rpc1 := Handle(pkr1, HandlerFunc(func(ctx context.Context, req *Request) {}))
+	rpc2 := Handle(pkr2, HandlerFunc(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "pong")
+	}))
+
+	serve2 := make(chan error, 1)
+	go rpc1.(Server).Serve(ctx)
+	go func() { serve2 <- rpc2.(Server).Serve(ctx) }()
+
+	v, err := rpc1.Async(ctx, "string", []string{"ping"})
+	r.NoError(err, "error calling over loopback")
+	r.Equal("pong", v)
+
+	r.NoError(pkr1.Close())
+	select {
+	case err := <-serve2:
+		r.NoError(err, "expected peer to see a clean end of stream")
+	case <-time.After(time.Second):
+		t.Fatal("peer did not notice the closed packer")
+	}
+}
+
+func TestServeBodyTooLarge(t *testing.T) {
+	r := require.New(t)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	rpc1 := Handle(NewPacker(c1, WithMaxPacketSize(8)), HandlerFunc(func(ctx context.Context, req *Request) {}))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rpc1.(*rpc).Serve(context.Background())
+	}()
+
+	// announce a body of 4GB
+	_, err := c2.Write([]byte{byte(codec.FlagJSON), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1})
+	r.NoError(err)
+
+	select {
+	case err := <-errCh:
+		r.Equal(codec.ErrBodyTooLarge, errors.Cause(err))
+	case <-time.After(time.Second):
+		t.Fatal("expected Serve to return")
+	}
+
+	// the connection was closed
+	_, err = c2.Read(make([]byte, 1))
+	r.Equal(io.EOF, err)
+}
+
+func TestRemoteAddr(t *testing.T) {
+	r := require.New(t)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	e := Handle(NewPacker(c1), HandlerFunc(func(ctx context.Context, req *Request) {}))
+	defer e.Terminate()
+
+	addr := e.(ConnInspector).RemoteAddr()
+	r.NotNil(addr, "expected address of net.Conn")
+	r.Equal(c1.RemoteAddr(), addr)
+
+	// an io.Pipe based connection has no address
+	pr, pw := io.Pipe()
+	e = Handle(NewPacker(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{pr, pw, pw}), HandlerFunc(func(ctx context.Context, req *Request) {}))
+	defer e.Terminate()
+
+	r.Nil(e.(ConnInspector).RemoteAddr())
+}
+
+func TestPackerFlush(t *testing.T) {
+	r := require.New(t)
+
+	var out bytes.Buffer
+	bw := bufio.NewWriter(&out)
+
+	pkr := NewPackerReadWriter(&bytes.Buffer{}, bw, ioutil.NopCloser(nil))
+
+	r.NoError(pkr.Pour(context.Background(), newEndOkayPacket(1)))
+	r.Equal(0, out.Len(), "expected packet to be buffered")
+
+	f, ok := pkr.(Flusher)
+	r.True(ok, "expected packer to implement Flusher")
+	r.NoError(f.Flush())
+
+	pkt, err := codec.NewReader(&out).ReadPacket()
+	r.NoError(err)
+	r.Equal(int32(1), pkt.Req)
+}
+
+// countingWriter counts the calls to Write, which stand for syscalls.
+type countingWriter struct {
+	l      sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) stats() (writes, n int) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	return w.writes, w.buf.Len()
+}
+
+func TestPackerWriteCoalescing(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	w := &countingWriter{}
+	pkr := NewPackerReadWriter(&bytes.Buffer{}, w, ioutil.NopCloser(nil), WithWriteCoalescing(4096, 10*time.Millisecond))
+
+	for i := 0; i < 10; i++ {
+		pkt := newStringPacket(true, 1, "chatty")
+		r.NoError(pkr.Pour(ctx, pkt))
+	}
+
+	writes, _ := w.stats()
+	r.Equal(0, writes, "expected stream packets to be buffered")
+
+	deadline := time.Now().Add(time.Second)
+	for writes == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		writes, _ = w.stats()
+	}
+	r.Equal(1, writes, "expected buffered packets to be flushed in one write")
+
+	// ends and async packets go out right away
+	r.NoError(pkr.Pour(ctx, newStringPacket(true, 1, "last")))
+	r.NoError(pkr.Pour(ctx, newEndOkayPacket(1)))
+	writes, n := w.stats()
+	r.Equal(2, writes)
+	r.Equal(12*9+10*6+4+4, n, "expected all packets to be written")
+
+	r.NoError(pkr.Pour(ctx, newStringPacket(false, 2, "async")))
+	writes, _ = w.stats()
+	r.Equal(3, writes)
+}
@@ -0,0 +1,68 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRequestTimeout is the error requests are ended with if nothing was sent
+// or received on them for longer than the TTL set using WithRequestTTL.
+var ErrRequestTimeout = errors.New("muxrpc: request timed out")
+
+// trackActivity makes the stream of req record when packets are sent or
+// received on it, if the session reaps idle requests.
+func (r *rpc) trackActivity(req *Request) {
+	if str, ok := req.Stream.(*stream); ok && r.requestTTL > 0 {
+		str.now = r.now
+		str.touch()
+	}
+}
+
+// reapIdle ends idle requests every half TTL until done is closed.
+func (r *rpc) reapIdle(ctx context.Context, done <-chan struct{}) {
+	interval := r.requestTTL / 2
+	if interval <= 0 {
+		interval = r.requestTTL
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			r.reap()
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reap ends the requests that were idle for longer than the TTL with
+// ErrRequestTimeout on both sides. Packets that arrive for them later are
+// dropped. It returns the number of reaped requests.
+func (r *rpc) reap() int {
+	r.rLock.Lock()
+	defer r.rLock.Unlock()
+
+	deadline := r.now().Add(-r.requestTTL)
+
+	var n int
+	for id, req := range r.reqs.Snapshot() {
+		str, ok := req.Stream.(*stream)
+		if !ok || str.now == nil || !str.idleSince().Before(deadline) {
+			continue
+		}
+
+		if r.cancelRequest(id, req, ErrRequestTimeout) {
+			r.logger.Log("event", "request reaped", "req", id, "method", methodString(req.Method), "ttl", r.requestTTL)
+			n++
+		}
+	}
+
+	return n
+}
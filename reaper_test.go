@@ -0,0 +1,75 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/luigi"
+)
+
+func TestRequestTTL(t *testing.T) {
+	const ttl = 30 * time.Millisecond
+
+	h1 := &testHandler{connect: noopConnect}
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Method[0] == "stalled" {
+				<-req.Stream.(StreamWaiter).RemoteClosed()
+				return
+			}
+
+			// active streams are not reaped, even if they take longer
+			for i := 0; i < 10; i++ {
+				time.Sleep(ttl / 5)
+				req.Stream.Pour(ctx, "tick")
+			}
+			req.Stream.Close()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2, WithRequestTTL(ttl))
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	src, err := rpc1.Source(ctx, "string", []string{"ticking"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	for {
+		_, err := src.Next(ctx)
+		if luigi.IsEOS(err) {
+			break
+		} else if err != nil {
+			t.Fatalf("active stream failed after %d values: %v", n, err)
+		}
+		n++
+	}
+	if n != 10 {
+		t.Errorf("expected 10 values, got %d", n)
+	}
+
+	src, err = rpc1.Source(ctx, "string", []string{"stalled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// either side may reap it first, the other one gets a CallError then
+	_, err = src.Next(ctx)
+	if err == nil || !strings.Contains(err.Error(), ErrRequestTimeout.Error()) {
+		t.Errorf("expected stalled stream to be reaped, got %v", err)
+	}
+
+	for i := 0; len(rpc1.(ConnInspector).Stats().Streams) > 0; i++ {
+		if i > 100 {
+			t.Fatalf("reaped request is still pending: %+v", rpc1.(ConnInspector).Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,287 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"cryptoscope.co/go/luigi"
+
+	"github.com/pkg/errors"
+)
+
+// ErrEndpointClosed is returned by ReconnectingEndpoint once it was closed.
+var ErrEndpointClosed = errors.New("muxrpc: endpoint closed")
+
+// Dialer opens a new connection to the peer and returns its packer.
+type Dialer func(ctx context.Context) (Packer, error)
+
+// ConnState is the state of the connection of a ReconnectingEndpoint.
+type ConnState int
+
+const (
+	// StateConnecting means the connection is being dialed, or the
+	// endpoint waits before dialing again.
+	StateConnecting ConnState = iota
+
+	// StateConnected means a session is up and calls can be made.
+	StateConnected
+
+	// StateClosed means the endpoint was closed and won't reconnect.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ReconnectOption configures a ReconnectingEndpoint.
+type ReconnectOption func(*ReconnectingEndpoint)
+
+// WithBackoff sets how long to wait before dialing again. The wait starts at
+// min, doubles after every failed dial or short lived session up to max and
+// is reset once a session stayed up for at least max. A random jitter of up to half the wait is subtracted, so
+// many clients don't dial at the same moment. The default is 100ms up to 30s.
+func WithBackoff(min, max time.Duration) ReconnectOption {
+	return func(re *ReconnectingEndpoint) {
+		re.minBackoff = min
+		re.maxBackoff = max
+	}
+}
+
+// WithReconnectHandleOptions sets the options passed to Handle for every
+// connection.
+func WithReconnectHandleOptions(opts ...HandleOption) ReconnectOption {
+	return func(re *ReconnectingEndpoint) {
+		re.handleOpts = opts
+	}
+}
+
+// ReconnectingEndpoint keeps a session to a peer up: whenever the session
+// ends, it dials a new connection and serves it using the same handler, whose
+// HandleConnect is called again for every connection. Pending calls and
+// streams fail when a connection is lost, they are not resumed; use
+// ResumableSource for that.
+type ReconnectingEndpoint struct {
+	dial       Dialer
+	h          Handler
+	handleOpts []HandleOption
+
+	minBackoff, maxBackoff time.Duration
+
+	// rnd jitters the backoff. Only used by run.
+	rnd *rand.Rand
+
+	l     sync.Mutex
+	state ConnState
+	e     Endpoint
+
+	// changed is closed and replaced when the state changes
+	changed chan struct{}
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ Endpoint = (*ReconnectingEndpoint)(nil)
+
+// NewReconnectingEndpoint returns a ReconnectingEndpoint that connects using
+// dial and serves h. It keeps reconnecting until ctx is done or Close is
+// called.
+func NewReconnectingEndpoint(ctx context.Context, dial Dialer, h Handler, opts ...ReconnectOption) *ReconnectingEndpoint {
+	re := &ReconnectingEndpoint{
+		dial: dial,
+		h:    h,
+
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(re)
+	}
+
+	ctx, re.cancel = context.WithCancel(ctx)
+	go re.run(ctx)
+
+	return re
+}
+
+// State returns the current state of the connection.
+func (re *ReconnectingEndpoint) State() ConnState {
+	re.l.Lock()
+	defer re.l.Unlock()
+
+	return re.state
+}
+
+// Endpoint returns the endpoint of the current session, waiting for a
+// connection if there is none. It returns ErrEndpointClosed if the endpoint
+// was closed.
+func (re *ReconnectingEndpoint) Endpoint(ctx context.Context) (Endpoint, error) {
+	for {
+		re.l.Lock()
+		state, e, changed := re.state, re.e, re.changed
+		re.l.Unlock()
+
+		switch state {
+		case StateConnected:
+			return e, nil
+		case StateClosed:
+			return nil, ErrEndpointClosed
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "error waiting for connection")
+		}
+	}
+}
+
+// Async does an async call on the current session.
+func (re *ReconnectingEndpoint) Async(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (interface{}, error) {
+	e, err := re.Endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Async(ctx, tipe, method, args...)
+}
+
+// Source does a source call on the current session.
+func (re *ReconnectingEndpoint) Source(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (luigi.Source, error) {
+	e, err := re.Endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Source(ctx, tipe, method, args...)
+}
+
+// Sink does a sink call on the current session.
+func (re *ReconnectingEndpoint) Sink(ctx context.Context, method []string, args ...interface{}) (luigi.Sink, error) {
+	e, err := re.Endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Sink(ctx, method, args...)
+}
+
+// Duplex does a duplex call on the current session.
+func (re *ReconnectingEndpoint) Duplex(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (luigi.Source, luigi.Sink, error) {
+	e, err := re.Endpoint(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return e.Duplex(ctx, tipe, method, args...)
+}
+
+// Do makes the call req on the current session.
+func (re *ReconnectingEndpoint) Do(ctx context.Context, req *Request) error {
+	e, err := re.Endpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	return e.Do(ctx, req)
+}
+
+// Close terminates the current session, stops reconnecting and waits until
+// that is done.
+func (re *ReconnectingEndpoint) Close() error {
+	re.cancel()
+	<-re.done
+
+	return nil
+}
+
+// Terminate is the same as Close.
+func (re *ReconnectingEndpoint) Terminate() error {
+	return re.Close()
+}
+
+// setState sets the state and the current endpoint and wakes up those
+// waiting in Endpoint.
+func (re *ReconnectingEndpoint) setState(state ConnState, e Endpoint) {
+	re.l.Lock()
+	defer re.l.Unlock()
+
+	re.state = state
+	re.e = e
+
+	close(re.changed)
+	re.changed = make(chan struct{})
+}
+
+// run dials and serves connections until ctx is done.
+func (re *ReconnectingEndpoint) run(ctx context.Context) {
+	defer close(re.done)
+	defer re.setState(StateClosed, nil)
+
+	backoff := re.minBackoff
+	for {
+		pkr, err := re.dial(ctx)
+		if err == nil {
+			e := Handle(pkr, re.h, re.handleOpts...)
+			re.setState(StateConnected, e)
+
+			// Serve calls HandleConnect and returns once the connection is lost
+			start := time.Now()
+			e.(Server).Serve(ctx)
+			e.Terminate()
+
+			re.setState(StateConnecting, nil)
+
+			// a peer that accepts and then drops us right away is not
+			// treated better than one that refuses
+			if time.Since(start) >= re.maxBackoff {
+				backoff = re.minBackoff
+			}
+		}
+
+		if !re.wait(ctx, backoff) {
+			return
+		}
+
+		backoff *= 2
+		if backoff > re.maxBackoff {
+			backoff = re.maxBackoff
+		}
+	}
+}
+
+// wait sleeps for d minus a random jitter of up to d/2. It returns false if
+// ctx is done before.
+func (re *ReconnectingEndpoint) wait(ctx context.Context, d time.Duration) bool {
+	if half := int64(d / 2); half > 0 {
+		d -= time.Duration(re.rnd.Int63n(half))
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
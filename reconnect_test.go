@@ -0,0 +1,134 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnectingEndpoint(t *testing.T) {
+	r := require.New(t)
+
+	var (
+		l       sync.Mutex
+		servers []Endpoint
+		wg      sync.WaitGroup
+		dials   int32
+	)
+	defer func() {
+		l.Lock()
+		for _, e := range servers {
+			e.Terminate()
+		}
+		l.Unlock()
+		wg.Wait()
+	}()
+
+	server := HandlerFunc(func(ctx context.Context, req *Request) {
+		req.Return(ctx, "pong")
+	})
+
+	dial := func(ctx context.Context) (Packer, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+
+		pkr1, pkr2 := NewLoopbackPackers()
+		e := Handle(pkr2, server)
+
+		l.Lock()
+		servers = append(servers, e)
+		l.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.(Server).Serve(context.Background())
+		}()
+
+		return pkr1, nil
+	}
+
+	var connects int32
+	h := &testHandler{
+		connect: func(ctx context.Context, e Endpoint) {
+			atomic.AddInt32(&connects, 1)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	re := NewReconnectingEndpoint(ctx, dial, h, WithBackoff(time.Millisecond, 10*time.Millisecond))
+
+	v, err := re.Async(ctx, "string", []string{"ping"})
+	r.NoError(err)
+	r.Equal("pong", v)
+	r.Equal(StateConnected, re.State())
+
+	// drop the connection from the other side
+	l.Lock()
+	servers[0].Terminate()
+	l.Unlock()
+
+	for atomic.LoadInt32(&dials) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	v, err = re.Async(ctx, "string", []string{"ping"})
+	r.NoError(err)
+	r.Equal("pong", v)
+
+	req := &Request{Type: Async, Method: []string{"ping"}, tipe: "string"}
+	r.NoError(re.Do(ctx, req))
+	v, err = req.Stream.Next(ctx)
+	r.NoError(err)
+	r.Equal("pong", v)
+
+	for atomic.LoadInt32(&connects) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	r.NoError(re.Terminate())
+	r.Equal(StateClosed, re.State())
+
+	_, err = re.Endpoint(ctx)
+	r.Equal(ErrEndpointClosed, err)
+}
+
+func TestReconnectBackoffShortSessions(t *testing.T) {
+	var dials int32
+	reached := make(chan struct{})
+
+	// the peer accepts and hangs up right away
+	dial := func(ctx context.Context) (Packer, error) {
+		if atomic.AddInt32(&dials, 1) == 5 {
+			close(reached)
+		}
+
+		pkr1, pkr2 := NewLoopbackPackers()
+		pkr2.Close()
+		return pkr1, nil
+	}
+
+	start := time.Now()
+	re := NewReconnectingEndpoint(context.Background(), dial, &testHandler{connect: noopConnect},
+		WithBackoff(10*time.Millisecond, time.Second))
+	defer re.Close()
+
+	select {
+	case <-reached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("endpoint stopped dialing")
+	}
+
+	// the waits double: at least 5+10+20+40ms with the jitter subtracted
+	if d := time.Since(start); d < 75*time.Millisecond {
+		t.Errorf("expected backoff to grow for short sessions, redialed 4 times in %v", d)
+	}
+}
@@ -0,0 +1,238 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"cryptoscope.co/go/muxrpc/codec"
+)
+
+// reqTable tracks the pending requests of a session by request id.
+// Implementations are safe for concurrent use.
+type reqTable interface {
+	// Get returns the request with the given id.
+	Get(id int32) (*Request, bool)
+
+	// Add stores req under id. It returns false and doesn't store req if the
+	// id is already in use.
+	Add(id int32, req *Request) bool
+
+	// Delete removes the request with the given id.
+	Delete(id int32)
+
+	// Len returns the number of requests in the table.
+	Len() int
+
+	// Drain removes all requests and returns them.
+	Drain() []*Request
+
+	// Snapshot returns a copy of the table.
+	Snapshot() map[int32]*Request
+
+	// Streams returns the number of streams in the table that were opened
+	// by us if outbound is set, otherwise of those opened by the peer.
+	Streams(outbound bool) int
+
+	// Requests returns the number of requests in the table that were
+	// started by us if outbound is set, otherwise of those started by the
+	// peer.
+	Requests(outbound bool) int
+}
+
+// newMapTable returns a reqTable that uses a single map guarded by a mutex.
+func newMapTable() *mapTable {
+	return &mapTable{
+		m: make(map[int32]*Request),
+	}
+}
+
+// mapTable is a reqTable backed by a single map.
+type mapTable struct {
+	l sync.Mutex
+	m map[int32]*Request
+
+	// inReqs and outReqs count the requests in m by direction, inStreams
+	// and outStreams only the streams. They are changed with l held and
+	// read atomically.
+	inReqs, outReqs       int32
+	inStreams, outStreams int32
+}
+
+// count adds d to the counters req is part of. Must be called with t.l held.
+func (t *mapTable) count(id int32, req *Request, d int32) {
+	stream := req.Type.Flags().Get(codec.FlagStream)
+
+	if id > 0 {
+		atomic.AddInt32(&t.outReqs, d)
+		if stream {
+			atomic.AddInt32(&t.outStreams, d)
+		}
+	} else {
+		atomic.AddInt32(&t.inReqs, d)
+		if stream {
+			atomic.AddInt32(&t.inStreams, d)
+		}
+	}
+}
+
+func (t *mapTable) Get(id int32) (*Request, bool) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	req, ok := t.m[id]
+	return req, ok
+}
+
+func (t *mapTable) Add(id int32, req *Request) bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if _, ok := t.m[id]; ok {
+		return false
+	}
+
+	t.m[id] = req
+	t.count(id, req, 1)
+	return true
+}
+
+func (t *mapTable) Delete(id int32) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if req, ok := t.m[id]; ok {
+		t.count(id, req, -1)
+		delete(t.m, id)
+	}
+}
+
+func (t *mapTable) Len() int {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	return len(t.m)
+}
+
+func (t *mapTable) Drain() []*Request {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	reqs := make([]*Request, 0, len(t.m))
+	for id, req := range t.m {
+		reqs = append(reqs, req)
+		t.count(id, req, -1)
+		delete(t.m, id)
+	}
+
+	return reqs
+}
+
+func (t *mapTable) Snapshot() map[int32]*Request {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	m := make(map[int32]*Request, len(t.m))
+	for id, req := range t.m {
+		m[id] = req
+	}
+
+	return m
+}
+
+func (t *mapTable) Streams(outbound bool) int {
+	if outbound {
+		return int(atomic.LoadInt32(&t.outStreams))
+	}
+
+	return int(atomic.LoadInt32(&t.inStreams))
+}
+
+func (t *mapTable) Requests(outbound bool) int {
+	if outbound {
+		return int(atomic.LoadInt32(&t.outReqs))
+	}
+
+	return int(atomic.LoadInt32(&t.inReqs))
+}
+
+// newShardedTable returns a reqTable that spreads the requests over n maps
+// with their own locks, to reduce lock contention at high request rates.
+func newShardedTable(n int) *shardedTable {
+	t := &shardedTable{
+		shards: make([]*mapTable, n),
+	}
+
+	for i := range t.shards {
+		t.shards[i] = newMapTable()
+	}
+
+	return t
+}
+
+// shardedTable is a reqTable backed by several maps, selected by request id.
+type shardedTable struct {
+	shards []*mapTable
+}
+
+func (t *shardedTable) shard(id int32) *mapTable {
+	return t.shards[uint32(id)%uint32(len(t.shards))]
+}
+
+func (t *shardedTable) Get(id int32) (*Request, bool) {
+	return t.shard(id).Get(id)
+}
+
+func (t *shardedTable) Add(id int32, req *Request) bool {
+	return t.shard(id).Add(id, req)
+}
+
+func (t *shardedTable) Delete(id int32) {
+	t.shard(id).Delete(id)
+}
+
+func (t *shardedTable) Len() int {
+	var n int
+	for _, s := range t.shards {
+		n += s.Len()
+	}
+
+	return n
+}
+
+func (t *shardedTable) Drain() []*Request {
+	var reqs []*Request
+	for _, s := range t.shards {
+		reqs = append(reqs, s.Drain()...)
+	}
+
+	return reqs
+}
+
+func (t *shardedTable) Snapshot() map[int32]*Request {
+	m := make(map[int32]*Request)
+	for _, s := range t.shards {
+		for id, req := range s.Snapshot() {
+			m[id] = req
+		}
+	}
+
+	return m
+}
+
+func (t *shardedTable) Streams(outbound bool) int {
+	var n int
+	for _, s := range t.shards {
+		n += s.Streams(outbound)
+	}
+
+	return n
+}
+
+func (t *shardedTable) Requests(outbound bool) int {
+	var n int
+	for _, s := range t.shards {
+		n += s.Requests(outbound)
+	}
+
+	return n
+}
@@ -0,0 +1,120 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRequestTables(t *testing.T) {
+	for name, tbl := range map[string]reqTable{
+		"map":     newMapTable(),
+		"sharded": newShardedTable(4),
+	} {
+		req1, req2 := &Request{Type: Source}, &Request{Type: Async}
+
+		if !tbl.Add(1, req1) || !tbl.Add(-6, req2) {
+			t.Fatalf("%s: error adding requests", name)
+		}
+
+		if tbl.Add(1, req2) {
+			t.Errorf("%s: expected adding a used id to fail", name)
+		}
+
+		if req, ok := tbl.Get(1); !ok || req != req1 {
+			t.Errorf("%s: got wrong request", name)
+		}
+
+		if n := tbl.Len(); n != 2 {
+			t.Errorf("%s: expected 2 requests, got %d", name, n)
+		}
+
+		if out, in := tbl.Streams(true), tbl.Streams(false); out != 1 || in != 0 {
+			t.Errorf("%s: expected 1 outbound stream, got %d out and %d in", name, out, in)
+		}
+
+		if out, in := tbl.Requests(true), tbl.Requests(false); out != 1 || in != 1 {
+			t.Errorf("%s: expected 1 request each way, got %d out and %d in", name, out, in)
+		}
+
+		if m := tbl.Snapshot(); len(m) != 2 || m[1] != req1 || m[-6] != req2 {
+			t.Errorf("%s: unexpected snapshot %v", name, m)
+		}
+
+		tbl.Delete(1)
+		if _, ok := tbl.Get(1); ok {
+			t.Errorf("%s: request not deleted", name)
+		}
+		if n := tbl.Streams(true); n != 0 {
+			t.Errorf("%s: expected deleted stream not to be counted, got %d", name, n)
+		}
+
+		if reqs := tbl.Drain(); len(reqs) != 1 || reqs[0] != req2 {
+			t.Errorf("%s: unexpected drained requests %v", name, reqs)
+		}
+
+		if n := tbl.Len(); n != 0 {
+			t.Errorf("%s: expected empty table, got %d", name, n)
+		}
+		if n := tbl.Requests(false); n != 0 {
+			t.Errorf("%s: expected drained request not to be counted, got %d", name, n)
+		}
+	}
+}
+
+func BenchmarkRequestTable(b *testing.B) {
+	for name, mk := range map[string]func() reqTable{
+		"map":       func() reqTable { return newMapTable() },
+		"sharded16": func() reqTable { return newShardedTable(16) },
+	} {
+		b.Run(name, func(b *testing.B) {
+			tbl := mk()
+			var id int32
+
+			b.RunParallel(func(pb *testing.PB) {
+				req := &Request{}
+				for pb.Next() {
+					i := atomic.AddInt32(&id, 1)
+					tbl.Add(i, req)
+					tbl.Get(i)
+					tbl.Delete(i)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkConcurrentAsync(b *testing.B) {
+	for name, opts := range map[string][]HandleOption{
+		"map":       nil,
+		"sharded16": {WithShardedRequests(16)},
+	} {
+		b.Run(name, func(b *testing.B) {
+			h1 := &testHandler{connect: noopConnect}
+			h2 := &testHandler{
+				call: func(ctx context.Context, req *Request) {
+					err := req.Return(ctx, "ok")
+					if err != nil && errors.Cause(err) != ErrSessionTerminated {
+						b.Error(err)
+					}
+				},
+				connect: noopConnect,
+			}
+
+			rpc1, _, done := serveTestPair(b, h1, h2, opts...)
+			defer done()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, err := rpc1.Async(context.Background(), "string", []string{"bench"})
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
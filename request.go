@@ -2,6 +2,9 @@ package muxrpc // import "cryptoscope.co/go/muxrpc"
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -21,6 +24,23 @@ type Request struct {
 	// Type is the type of the call, i.e. async, sink, source or duplex
 	Type CallType `json:"type"`
 
+	// Metadata holds optional values like tracing ids that are sent along
+	// with the call in the "meta" field. Peers that don't know the field
+	// ignore it.
+	Metadata map[string]interface{} `json:"meta,omitempty"`
+
+	// RawArgs holds the arguments as received, as a JSON array. It is only
+	// set for requests that were unmarshaled from JSON. Use DecodeArgs to
+	// decode them into typed values.
+	RawArgs json.RawMessage `json:"-"`
+
+	// BufferSize is the number of received packets buffered for a call
+	// until they are read, instead of the session default set using
+	// WithBufferSize. It is used by Do if the request has no stream yet,
+	// e.g. a small buffer for latency sensitive calls and a larger one for
+	// bulk sources.
+	BufferSize int `json:"-"`
+
 	// in is the sink that incoming packets are passed to
 	in luigi.Sink
 
@@ -31,14 +51,179 @@ type Request struct {
 	// tipe is a value that has the type of data we expect to receive.
 	// This is needed for unmarshaling JSON.
 	tipe interface{}
+
+	// firstRx is when the first packet for the request arrived, if call
+	// timing is enabled. Set by the Serve loop.
+	firstRx time.Time
+
+	// started is when the request was sent or received, if metrics are
+	// enabled.
+	started time.Time
+}
+
+// wireRequest is the body of the packet that opens a call. Requests are
+// encoded as this instead of themselves, so codecs only see these fields.
+type wireRequest struct {
+	Method []string               `json:"name"`
+	Args   []interface{}          `json:"args"`
+	Type   CallType               `json:"type"`
+	Meta   map[string]interface{} `json:"meta,omitempty"`
+}
+
+func newWireRequest(req *Request) *wireRequest {
+	return &wireRequest{
+		Method: req.Method,
+		Args:   req.Args,
+		Type:   req.Type,
+		Meta:   req.Metadata,
+	}
+}
+
+// decodeWireRequest decodes the wire request in data into req. If enc is
+// JSON, the arguments are kept in RawArgs as well.
+func decodeWireRequest(enc Codec, data []byte, req *Request) error {
+	var w wireRequest
+
+	if enc.Flag() == codec.FlagJSON {
+		var raw struct {
+			wireRequest
+			Args json.RawMessage `json:"args"`
+		}
+
+		err := enc.Unmarshal(data, &raw)
+		if err != nil {
+			return err
+		}
+
+		w = raw.wireRequest
+		if len(raw.Args) > 0 {
+			err = json.Unmarshal(raw.Args, &w.Args)
+			if err != nil {
+				return err
+			}
+		}
+		req.RawArgs = raw.Args
+	} else {
+		err := enc.Unmarshal(data, &w)
+		if err != nil {
+			return err
+		}
+	}
+
+	req.Method = w.Method
+	req.Args = w.Args
+	req.Type = w.Type
+	req.Metadata = w.Meta
+
+	return nil
+}
+
+// Meta returns the metadata sent along with the call. It is nil if the
+// caller didn't send any.
+func (req *Request) Meta() map[string]interface{} {
+	return req.Metadata
+}
+
+// UnmarshalJSON unmarshals the request and keeps the raw arguments in
+// RawArgs, in addition to decoding them into Args.
+func (req *Request) UnmarshalJSON(data []byte) error {
+	// request doesn't have this method, which avoids the recursion
+	type request Request
+	aux := struct {
+		*request
+		Args json.RawMessage `json:"args"`
+	}{request: (*request)(req)}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	req.RawArgs = aux.Args
+	if len(aux.Args) > 0 {
+		return json.Unmarshal(aux.Args, &req.Args)
+	}
+
+	return nil
+}
+
+// DecodeArgs unmarshals the arguments of the call into dst, the first
+// argument into the first value and so on, like json.Unmarshal. Surplus
+// arguments are ignored. Received arguments are decoded from RawArgs, so
+// large numbers and the like don't lose precision on the way through Args.
+func (req *Request) DecodeArgs(dst ...interface{}) error {
+	var args []json.RawMessage
+	if req.RawArgs != nil {
+		err := json.Unmarshal(req.RawArgs, &args)
+		if err != nil {
+			return errors.Wrap(err, "error decoding arguments")
+		}
+	} else {
+		for i, arg := range req.Args {
+			data, err := json.Marshal(arg)
+			if err != nil {
+				return errors.Wrapf(err, "error marshaling argument %d", i)
+			}
+			args = append(args, data)
+		}
+	}
+
+	if len(args) < len(dst) {
+		return errors.Errorf("expected at least %d arguments, got %d", len(dst), len(args))
+	}
+
+	for i, v := range dst {
+		err := json.Unmarshal(args[i], v)
+		if err != nil {
+			return errors.Wrapf(err, "error decoding argument %d", i)
+		}
+	}
+
+	return nil
+}
+
+type metaKey struct{}
+
+// WithMeta returns a context that makes calls done with it send meta as
+// request metadata.
+func WithMeta(ctx context.Context, meta map[string]interface{}) context.Context {
+	return context.WithValue(ctx, metaKey{}, meta)
+}
+
+// metaFromContext returns the metadata stored in ctx by WithMeta, or nil.
+func metaFromContext(ctx context.Context) map[string]interface{} {
+	meta, _ := ctx.Value(metaKey{}).(map[string]interface{})
+	return meta
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context that makes the next call done with it use
+// id as request id instead of allocating one. This is for advanced use only,
+// e.g. conformance tests that need to match captured sessions byte-for-byte.
+// id must be positive and not be used by a pending request.
+func WithRequestID(ctx context.Context, id int32) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the request id set by WithRequestID.
+func requestIDFromContext(ctx context.Context) (int32, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(int32)
+	return id, ok
 }
 
 // Return is a helper that returns on an async call
+// v is sent as a single packet without the stream flag, after which the call
+// is ended. Returning twice fails with ErrStreamEnded.
 func (req *Request) Return(ctx context.Context, v interface{}) error {
-	if req.Type != "async" && req.Type != "sync" {
+	if req.Type != Async && req.Type != Sync {
 		return errors.Errorf("cannot return value on %q stream", req.Type)
 	}
 
+	if req.Stream == nil {
+		return errors.New("cannot return value on request without stream")
+	}
+
 	err := req.Stream.Pour(ctx, v)
 	if err != nil {
 		return errors.Wrap(err, "error pouring return value")
@@ -49,21 +234,143 @@ func (req *Request) Return(ctx context.Context, v interface{}) error {
 		return errors.Wrap(err, "error closing sink after return")
 	}
 
+	// the reply is out, so the peer hanging up before its end arrived is
+	// not an error
 	_, err = req.Stream.Next(ctx)
-	if !luigi.IsEOS(err) {
+	if !luigi.IsEOS(err) && errors.Cause(err) != ErrSessionTerminated {
+		return err
+	}
+
+	return nil
+}
+
+// CloseWithError ends the call with err, which the caller receives as a
+// *CallError. Handlers should use it to reject calls they can't answer, e.g.
+// to unknown methods, so the caller doesn't wait for a reply forever.
+func (req *Request) CloseWithError(err error) error {
+	return req.Stream.CloseWithError(err)
+}
+
+// ValidateRequest checks that req could be sent without actually sending it.
+// It verifies that a method is set, that the call type is known and that the
+// arguments can be marshaled. This allows tools to lint calls offline.
+func ValidateRequest(req *Request) error {
+	if err := req.validate(); err != nil {
 		return err
 	}
 
+	_, err := json.Marshal(req)
+	return errors.Wrap(err, "error marshaling request")
+}
+
+// validate checks the fields of the request that don't require marshaling.
+func (req *Request) validate() error {
+	if len(req.Method) == 0 {
+		return errors.New("request has no method")
+	}
+
+	for i, name := range req.Method {
+		if name == "" {
+			return errors.Errorf("method element %d is empty", i)
+		}
+	}
+
+	switch req.Type {
+	case Async, Sync, Source, Sink, Duplex:
+	default:
+		return errors.Errorf("unhandled request type: %q", req.Type)
+	}
+
 	return nil
 }
 
 // CallType is the type of a call
 type CallType string
 
+// The call types of the protocol. Sync calls are answered like async ones.
+const (
+	Async  CallType = "async"
+	Sync   CallType = "sync"
+	Source CallType = "source"
+	Sink   CallType = "sink"
+	Duplex CallType = "duplex"
+)
+
+// The default limits of the method names of incoming requests, see
+// WithMaxMethodLength.
+const (
+	defaultMaxMethodElems = 32
+	defaultMaxMethodChars = 1024
+)
+
+// String returns the name of the call type.
+func (t CallType) String() string {
+	return string(t)
+}
+
+var (
+	wireNamesLock sync.RWMutex
+
+	// wireNames maps call types to the strings used for them on the wire
+	wireNames = map[CallType]string{
+		Async:  "async",
+		Sync:   "sync",
+		Source: "source",
+		Sink:   "sink",
+		Duplex: "duplex",
+	}
+)
+
+// RegisterCallType sets the string that is used on the wire for call type t.
+// This is only needed for forks of the protocol that use different names and
+// should be called before any session is started.
+func RegisterCallType(t CallType, wire string) {
+	wireNamesLock.Lock()
+	defer wireNamesLock.Unlock()
+
+	wireNames[t] = wire
+}
+
+// MarshalJSON encodes the call type using its wire name.
+func (t CallType) MarshalJSON() ([]byte, error) {
+	wireNamesLock.RLock()
+	name, ok := wireNames[t]
+	wireNamesLock.RUnlock()
+
+	if !ok {
+		name = string(t)
+	}
+
+	return json.Marshal(name)
+}
+
+// UnmarshalJSON decodes a call type from its wire name. Unknown names are
+// rejected.
+func (t *CallType) UnmarshalJSON(data []byte) error {
+	var name string
+
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return errors.Wrap(err, "error decoding call type")
+	}
+
+	wireNamesLock.RLock()
+	defer wireNamesLock.RUnlock()
+
+	for tipe, wire := range wireNames {
+		if wire == name {
+			*t = tipe
+			return nil
+		}
+	}
+
+	return errors.Errorf("unknown call type %q", name)
+}
+
 // Flags returns the packet flags of the respective call type
 func (t CallType) Flags() codec.Flag {
 	switch t {
-	case "source", "sink", "duplex":
+	case Source, Sink, Duplex:
 		return codec.FlagStream
 	default:
 		return 0
@@ -0,0 +1,259 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+)
+
+func TestValidateRequest(t *testing.T) {
+	type testcase struct {
+		req   *Request
+		valid bool
+	}
+
+	tcs := []testcase{
+		{
+			req:   &Request{Type: "async", Method: []string{"whoami"}},
+			valid: true,
+		},
+		{
+			req:   &Request{Type: "source", Method: []string{"blobs", "get"}, Args: []interface{}{"&foo"}},
+			valid: true,
+		},
+		{
+			req: &Request{Type: "async"},
+		},
+		{
+			req: &Request{Type: "async", Method: []string{"blobs", ""}},
+		},
+		{
+			req: &Request{Type: "stream", Method: []string{"whoami"}},
+		},
+		{
+			req: &Request{Type: "async", Method: []string{"whoami"}, Args: []interface{}{make(chan int)}},
+		},
+	}
+
+	for i, tc := range tcs {
+		err := ValidateRequest(tc.req)
+		if tc.valid && err != nil {
+			t.Errorf("test %d: unexpected error: %s", i, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("test %d: expected error for request %+v", i, tc.req)
+		}
+	}
+}
+
+func TestCallTypeJSON(t *testing.T) {
+	for _, tipe := range []CallType{"async", "source", "sink", "duplex"} {
+		req := &Request{Type: tipe, Method: []string{"foo", "bar"}, Args: []interface{}{1}}
+
+		data, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := `{"name":["foo","bar"],"args":[1],"type":"` + string(tipe) + `"}`
+		if string(data) != exp {
+			t.Errorf("expected %s, got %s", exp, data)
+		}
+
+		var dec Request
+		err = json.Unmarshal(data, &dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dec.Type != tipe {
+			t.Errorf("expected type %q, got %q", tipe, dec.Type)
+		}
+	}
+}
+
+func TestCallTypeUnknown(t *testing.T) {
+	var tipe CallType
+	err := json.Unmarshal([]byte(`"teleport"`), &tipe)
+	if err == nil || !strings.Contains(err.Error(), `unknown call type "teleport"`) {
+		t.Errorf("expected unknown call type error, got %v", err)
+	}
+
+	var req Request
+	err = json.Unmarshal([]byte(`{"name":["foo"],"args":[],"type":"teleport"}`), &req)
+	if err == nil {
+		t.Error("expected request with unknown type to be rejected")
+	}
+
+	if s := Duplex.String(); s != "duplex" {
+		t.Errorf("expected duplex, got %q", s)
+	}
+}
+
+func TestRegisterCallType(t *testing.T) {
+	RegisterCallType("duplex", "both")
+	defer RegisterCallType("duplex", "duplex")
+
+	data, err := json.Marshal(CallType("duplex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != `"both"` {
+		t.Errorf("expected custom wire name, got %s", data)
+	}
+
+	var tipe CallType
+	err = json.Unmarshal(data, &tipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tipe != "duplex" {
+		t.Errorf("expected duplex, got %q", tipe)
+	}
+}
+
+func TestReturnAsync(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	returned := make(chan error, 2)
+	e := Handle(NewPacker(c1), HandlerFunc(func(ctx context.Context, req *Request) {
+		returned <- req.Return(ctx, "hi")
+		returned <- req.Return(ctx, "again")
+	}))
+	serve := ServeBackground(context.Background(), e.(Server))
+
+	pkts := make(chan *codec.Packet, 4)
+	go func() {
+		r := codec.NewReader(c2)
+		for {
+			pkt, err := r.ReadPacket()
+			if err != nil {
+				close(pkts)
+				return
+			}
+			pkts <- pkt
+		}
+	}()
+
+	// like JS muxrpc, the peer sends no end packet for async calls
+	err := codec.NewWriter(c2).WritePacket(&codec.Packet{
+		Flag: codec.FlagJSON,
+		Req:  1,
+		Body: []byte(`{"name":["hello"],"args":[],"type":"async"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("unexpected error returning: %+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Return did not return")
+	}
+
+	if err := <-returned; errors.Cause(err) != ErrStreamEnded {
+		t.Errorf("expected returning twice to fail, got %v", err)
+	}
+
+	// a single packet without the stream flag, strings are sent as such
+	pkt := <-pkts
+	if pkt.Req != -1 || pkt.Flag != codec.FlagString || string(pkt.Body) != "hi" {
+		t.Errorf("unexpected reply %+v", pkt)
+	}
+
+	c2.Close()
+	<-serve
+}
+
+func TestReturnInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	for _, req := range []*Request{
+		{Type: "source", Method: []string{"stream"}},
+		{Type: "async", Method: []string{"unparsed"}},
+	} {
+		if err := req.Return(ctx, "x"); err == nil {
+			t.Errorf("expected error returning on %s request %v", req.Type, req.Method)
+		}
+	}
+}
+
+func TestDecodeArgs(t *testing.T) {
+	type opts struct {
+		ID    int64  `json:"id"`
+		Label string `json:"label"`
+	}
+
+	// 2^53+1 can't be represented by the float64 in Args
+	var req Request
+	err := json.Unmarshal([]byte(`{"name":["get"],"type":"async","args":[{"id":9007199254740993,"label":"big"},"extra"]}`), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.Args) != 2 || req.Args[1] != "extra" {
+		t.Errorf("expected Args to be populated, got %v", req.Args)
+	}
+	if req.Type != Async || len(req.Method) != 1 {
+		t.Errorf("expected the other fields to be populated, got %+v", req)
+	}
+
+	var o opts
+	if err := req.DecodeArgs(&o); err != nil {
+		t.Fatal(err)
+	}
+	if o.ID != 9007199254740993 || o.Label != "big" {
+		t.Errorf("got wrong arguments %+v", o)
+	}
+
+	var a, b, c string
+	if err := req.DecodeArgs(&a, &b, &c); err == nil {
+		t.Error("expected error decoding more arguments than sent")
+	}
+
+	// requests that weren't unmarshaled decode Args
+	req = Request{Args: []interface{}{map[string]interface{}{"id": 23}}}
+	if err := req.DecodeArgs(&o); err != nil {
+		t.Fatal(err)
+	}
+	if o.ID != 23 {
+		t.Errorf("expected id 23, got %d", o.ID)
+	}
+}
+
+func TestWireRequest(t *testing.T) {
+	req := &Request{
+		Stream:  NewStream(nil, nil, 1, false, false),
+		Method:  []string{"foo"},
+		Args:    []interface{}{1},
+		Type:    Async,
+		RawArgs: json.RawMessage(`[2]`),
+	}
+
+	data, err := JSONCodec.Marshal(newWireRequest(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `{"name":["foo"],"args":[1],"type":"async"}`; string(data) != exp {
+		t.Errorf("expected %s, got %s", exp, data)
+	}
+
+	var dec Request
+	if err := decodeWireRequest(JSONCodec, data, &dec); err != nil {
+		t.Fatal(err)
+	}
+	if string(dec.RawArgs) != "[1]" || len(dec.Args) != 1 || dec.Type != Async {
+		t.Errorf("unexpected request %+v", dec)
+	}
+}
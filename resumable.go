@@ -0,0 +1,156 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cryptoscope.co/go/luigi"
+
+	"github.com/pkg/errors"
+)
+
+// SourceFactory opens a source that continues after the progress marker last.
+// last is nil if nothing has been received yet. Usually this re-dials the
+// connection if necessary and issues the source call with an updated start
+// argument.
+type SourceFactory func(ctx context.Context, last interface{}) (luigi.Source, error)
+
+// ResumableSource is a source that re-opens the underlying source using a
+// factory when it fails, continuing after the last value that was received.
+// Errors sent by the remote (*CallError) and the end of the stream are passed
+// on as they are, all other errors cause the source to be re-opened. A
+// factory that fails counts as a failed attempt as well.
+type ResumableSource struct {
+	l sync.Mutex
+
+	mk       SourceFactory
+	progress func(v interface{}) interface{}
+
+	src  luigi.Source
+	last interface{}
+
+	// failures counts the re-opens since the last received value
+	failures    int
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// The defaults of SetRetry.
+const (
+	defaultResumeAttempts = 5
+	defaultResumeBackoff  = 100 * time.Millisecond
+	maxResumeBackoff      = 5 * time.Second
+)
+
+// NewResumableSource returns a ResumableSource that opens sources using mk.
+// progress extracts the progress marker (e.g. the sequence number) from a
+// received value and last is the marker to start after, or nil.
+func NewResumableSource(mk SourceFactory, progress func(v interface{}) interface{}, last interface{}) *ResumableSource {
+	return &ResumableSource{
+		mk:       mk,
+		progress: progress,
+		last:     last,
+
+		maxAttempts: defaultResumeAttempts,
+		backoff:     defaultResumeBackoff,
+	}
+}
+
+// SetRetry sets how often Next re-opens a broken source, or retries a failed
+// open, before it gives up and returns the error, and how long it waits
+// between re-opens. The first
+// re-open after a value was received happens right away, the waits before
+// further ones start at backoff and double up to 5s. The default is 5
+// attempts with a backoff of 100ms.
+func (rs *ResumableSource) SetRetry(maxAttempts int, backoff time.Duration) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+
+	rs.maxAttempts = maxAttempts
+	rs.backoff = backoff
+}
+
+// Progress returns the marker of the last received value, so the application
+// can persist it and resume later.
+func (rs *ResumableSource) Progress() interface{} {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+
+	return rs.last
+}
+
+// Next returns the next value of the source, re-opening it if needed.
+func (rs *ResumableSource) Next(ctx context.Context) (interface{}, error) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+
+	for {
+		var err error
+		if rs.src == nil {
+			rs.src, err = rs.mk(ctx, rs.last)
+			if err != nil {
+				rs.src = nil
+				err = errors.Wrap(err, "error opening source")
+			}
+		}
+
+		if rs.src != nil {
+			var v interface{}
+			v, err = rs.src.Next(ctx)
+			if err == nil {
+				rs.failures = 0
+				rs.last = rs.progress(v)
+				return v, nil
+			}
+
+			if luigi.IsEOS(err) {
+				return nil, err
+			}
+
+			if _, ok := errors.Cause(err).(*CallError); ok {
+				return nil, err
+			}
+
+			// the source broke, open a new one on the next iteration
+			rs.src = nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		rs.failures++
+		if rs.failures > rs.maxAttempts {
+			return nil, errors.Wrapf(err, "giving up after %d attempts", rs.maxAttempts)
+		}
+
+		if rs.failures > 1 {
+			err = rs.wait(ctx, rs.failures-2)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// wait sleeps before the re-open after n re-opens that didn't yield a value.
+func (rs *ResumableSource) wait(ctx context.Context, n int) error {
+	d := rs.backoff
+	for i := 0; i < n && d < maxResumeBackoff; i++ {
+		d *= 2
+	}
+	if d > maxResumeBackoff {
+		d = maxResumeBackoff
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "error waiting to re-open source")
+	}
+}
@@ -0,0 +1,121 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/luigi"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumableSource(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	var starts []interface{}
+
+	mk := func(ctx context.Context, last interface{}) (luigi.Source, error) {
+		starts = append(starts, last)
+
+		src, sink := luigi.NewPipe(luigi.WithBuffer(4))
+
+		start := 0
+		if last != nil {
+			start = last.(int) + 1
+		}
+
+		if start == 0 {
+			// first connection breaks after two values
+			sink.Pour(ctx, 0)
+			sink.Pour(ctx, 1)
+			sink.(luigi.ErrorCloser).CloseWithError(errors.New("connection lost"))
+		} else {
+			for i := start; i < 4; i++ {
+				sink.Pour(ctx, i)
+			}
+			sink.Close()
+		}
+
+		return src, nil
+	}
+
+	rs := NewResumableSource(mk, func(v interface{}) interface{} { return v }, nil)
+
+	for i := 0; i < 4; i++ {
+		v, err := rs.Next(ctx)
+		r.NoError(err)
+		r.Equal(i, v)
+		r.Equal(i, rs.Progress())
+	}
+
+	_, err := rs.Next(ctx)
+	r.True(luigi.IsEOS(err), "expected end of stream")
+
+	r.Equal([]interface{}{nil, 1}, starts)
+}
+
+func TestResumableSourceGivesUp(t *testing.T) {
+	r := require.New(t)
+
+	var opens int
+	mk := func(ctx context.Context, last interface{}) (luigi.Source, error) {
+		opens++
+
+		src, sink := luigi.NewPipe()
+		sink.(luigi.ErrorCloser).CloseWithError(ErrSessionTerminated)
+		return src, nil
+	}
+
+	rs := NewResumableSource(mk, func(v interface{}) interface{} { return v }, nil)
+	rs.SetRetry(3, time.Millisecond)
+
+	start := time.Now()
+	_, err := rs.Next(context.Background())
+	r.Equal(ErrSessionTerminated, errors.Cause(err))
+	r.Equal(4, opens, "expected the first open and three re-opens")
+
+	// waits of 1ms and 2ms before the second and third re-open
+	r.True(time.Since(start) >= 3*time.Millisecond, "expected backoff between re-opens")
+}
+
+func TestResumableSourceFactoryFails(t *testing.T) {
+	r := require.New(t)
+
+	var opens int
+	mk := func(ctx context.Context, last interface{}) (luigi.Source, error) {
+		opens++
+		if opens == 1 {
+			return nil, errors.New("dial failed")
+		}
+
+		src, sink := luigi.NewPipe(luigi.WithBuffer(1))
+		sink.Pour(ctx, 1)
+		sink.Close()
+		return src, nil
+	}
+
+	rs := NewResumableSource(mk, func(v interface{}) interface{} { return v }, nil)
+	rs.SetRetry(3, time.Millisecond)
+
+	v, err := rs.Next(context.Background())
+	r.NoError(err)
+	r.Equal(1, v)
+	r.Equal(2, opens, "expected the failed open to be retried")
+
+	// a factory that keeps failing counts against the attempts
+	opens = 0
+	mk = func(ctx context.Context, last interface{}) (luigi.Source, error) {
+		opens++
+		return nil, errors.New("dial failed")
+	}
+
+	rs = NewResumableSource(mk, func(v interface{}) interface{} { return v }, nil)
+	rs.SetRetry(3, time.Millisecond)
+
+	_, err = rs.Next(context.Background())
+	r.Error(err)
+	r.Equal(4, opens, "expected the first open and three retries")
+}
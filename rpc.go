@@ -3,9 +3,15 @@ package muxrpc // import "cryptoscope.co/go/muxrpc"
 import (
 	"context"
 	"encoding/json"
+	"math"
+	"net"
+	"reflect"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 
 	"cryptoscope.co/go/luigi"
@@ -18,129 +24,458 @@ type rpc struct {
 	// pkr is the Sink and Source of the network connection
 	pkr Packer
 
-	// reqs is the map we keep, tracking all requests
-	reqs  map[int32]*Request
+	// reqs tracks all pending requests
+	reqs reqTable
+
+	// rLock guards highest, rejected and draining
 	rLock sync.Mutex
 
-	// highest is the highest request id we already allocated
+	// rejected holds the ids of inbound streams we replied to with an error
+	// and of the requests cancelled by CancelMethod. Their packets are
+	// dropped until they are ended. Guarded by rLock.
+	rejected map[int32]struct{}
+
+	// highest is the request id allocated last, see nextID
 	highest int32
 
+	// draining is set by TerminateGracefully. No new requests are accepted
+	// after that.
+	draining bool
+
 	root Handler
 
 	// terminated indicates that the rpc session is being terminated
 	terminated bool
 	tLock      sync.Mutex
+
+	// abortErr is set if the session terminated itself, because the
+	// capability exchange or a keepalive failed. Guarded by tLock.
+	abortErr error
+
+	// serving is set while Serve runs. done is closed once the session is
+	// over and doneErr is the error it ended with. Guarded by tLock.
+	serving bool
+	done    chan struct{}
+	doneErr error
+
+	// startedAt is the time Handle was called. It is not changed afterwards.
+	startedAt time.Time
+
+	// now returns the current time. It is time.Now unless set by WithClock.
+	now func() time.Time
+
+	// callTiming enables measuring the timing of async calls
+	callTiming bool
+
+	// connectOnce makes sure HandleConnect is only called once
+	connectOnce sync.Once
+
+	// connectTimeout bounds the context passed to HandleConnect if non-zero
+	connectTimeout time.Duration
+
+	// maxMethodElems and maxMethodChars limit the number of method elements
+	// and the total length of the method names of incoming requests.
+	// Not enforced if zero.
+	maxMethodElems, maxMethodChars int
+
+	// negotiateStreams enables the exchange of stream limits with the peer.
+	// maxStreams is the limit we advertise, peerMaxStreams the one the peer
+	// advertised. The latter is accessed atomically, as is peerNegotiated,
+	// which is set to 1 once the peer answered. Zero means unlimited.
+	negotiateStreams bool
+	maxStreams       int
+	peerMaxStreams   int32
+	peerNegotiated   int32
+
+	// seqNumbers enables numbering the packets of each request
+	seqNumbers bool
+
+	// bufSize is the number of received packets buffered per request
+	bufSize int
+
+	// enc encodes requests and the values sent on streams
+	enc Codec
+
+	// manifest is checked before sending calls if not nil
+	manifest Manifest
+
+	// rxPolicy decides what happens if a handler doesn't keep up reading,
+	// after waiting for rxTimeout. A rxTimeout <= 0 waits indefinitely.
+	rxPolicy  ReceiveOverflowPolicy
+	rxTimeout time.Duration
+
+	// logger gets the problems that can't be returned to a caller.
+	// panicStacks makes the errors of panicking handlers include the stack.
+	logger      log.Logger
+	panicStacks bool
+
+	// authz are checked before calls are passed to the handler
+	authz []Authorizer
+
+	// metrics is told about requests and errors if not nil
+	metrics Metrics
+
+	// inbound and outbound count the requests started by the peer and by us.
+	// They are accessed atomically.
+	inbound, outbound uint64
+
+	// highWater is the highest buffer occupancy of any stream of the session.
+	// It is accessed atomically.
+	highWater int32
+
+	// handshakeTimeout bounds the capability exchange if non-zero
+	handshakeTimeout time.Duration
+
+	// maxRequests limits the number of pending requests started by the peer.
+	// Not enforced if zero.
+	maxRequests int
+
+	// requestTTL is how long a request may be idle before it is ended.
+	// Not enforced if zero.
+	requestTTL time.Duration
+
+	// keepaliveInterval is the time between keepalive pings if non-zero.
+	// keepaliveTimeout is how long to wait for the reply.
+	keepaliveInterval, keepaliveTimeout time.Duration
+
+	// events receives the events of the session, see Events.
+	// droppedEvents counts the ones that didn't fit and is accessed atomically.
+	events        chan Event
+	droppedEvents uint64
+
+	// defaultArgs holds the arguments set using WithDefaultArgs, keyed by
+	// methodKey. It is not changed after Handle returns.
+	defaultArgs map[string][]interface{}
 }
 
 // Handler allows handling connections.
-// When a connection is established, HandleConnect is called.
-// When we are being called, HandleCall is called.
+// When the connection is being served, HandleConnect is called.
+// When we are being called, HandleCall is called. It has to answer or end
+// every call, otherwise the caller waits forever; calls to methods it doesn't
+// know should be ended using req.CloseWithError. See ErrorHandler for handlers
+// that return their errors instead.
 type Handler interface {
 	HandleCall(ctx context.Context, req *Request)
 	HandleConnect(ctx context.Context, e Endpoint)
 }
 
-const bufSize = 5
-const rxTimeout time.Duration = time.Millisecond
+// defaultBufSize is the number of received packets buffered per request
+// unless set using WithBufferSize.
+const defaultBufSize = 5
+
+// defaultRxTimeout is how long Serve waits for a reader to make room in its
+// receive buffer before the receive overflow policy applies. It is long
+// enough that only readers that are stuck lose their request, not those that
+// were scheduled late.
+const defaultRxTimeout time.Duration = time.Second
+
+// ErrSessionTerminated is returned by the streams of requests that were still
+// pending when the RPC session ended.
+var ErrSessionTerminated = errors.New("muxrpc: session terminated")
+
+// ErrShuttingDown is returned for calls made after TerminateGracefully was
+// called. The peer gets it as CallError.
+var ErrShuttingDown = errors.New("muxrpc: session is shutting down")
 
 // Handle handles the connection of the packer using the specified handler.
-func Handle(pkr Packer, handler Handler) Endpoint {
+// The handler's HandleConnect is called in a new goroutine once Serve is
+// called, so calls made from HandleConnect can be answered. The context passed
+// to it is cancelled when Serve returns.
+func Handle(pkr Packer, handler Handler, opts ...HandleOption) Endpoint {
 	r := &rpc{
 		pkr:  pkr,
-		reqs: make(map[int32]*Request),
+		reqs: newMapTable(),
 		root: handler,
+
+		rejected: make(map[int32]struct{}),
+
+		now:       time.Now,
+		rxTimeout: defaultRxTimeout,
+		bufSize:   defaultBufSize,
+		enc:       JSONCodec,
+		logger:    log.NewNopLogger(),
+
+		events: make(chan Event, eventBufSize),
+		done:   make(chan struct{}),
+
+		maxMethodElems: defaultMaxMethodElems,
+		maxMethodChars: defaultMaxMethodChars,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.startedAt = r.now()
+
+	if pkr, ok := pkr.(*packer); ok && r.metrics != nil && pkr.metrics == nil {
+		pkr.metrics = r.metrics
 	}
 
-	go handler.HandleConnect(context.Background(), r)
 	return r
 }
 
+// connect calls the handler's HandleConnect in a new goroutine.
+// The returned function cancels the context passed to it.
+func (r *rpc) connect(ctx context.Context) context.CancelFunc {
+	var cancel context.CancelFunc
+	if r.connectTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, r.connectTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	r.emit(Event{Type: EventConnect})
+
+	go func() {
+		defer cancel()
+		r.root.HandleConnect(ctx, r)
+	}()
+
+	return cancel
+}
+
 // Async does an aync call on the remote.
 func (r *rpc) Async(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (interface{}, error) {
-	inSrc, inSink := luigi.NewPipe(luigi.WithBuffer(bufSize))
+	v, _, err := r.AsyncWithMeta(ctx, tipe, method, args...)
+	return v, err
+}
 
-	req := &Request{
-		Type:   "async",
-		Stream: NewStream(inSrc, r.pkr, 0, false, false),
-		in:     inSink,
+// ResponseMeta holds information about how the remote replied to a call.
+type ResponseMeta struct {
+	// Flag are the packet flags of the reply
+	Flag codec.Flag
 
-		Method: method,
-		Args:   args,
+	// Stream is true if the remote replied using a stream packet instead of
+	// a single async packet.
+	Stream bool
 
-		tipe: tipe,
+	// Timing holds how long the phases of the call took. It is only set if
+	// enabled using WithCallTiming.
+	Timing *CallTiming
+}
+
+// CallTiming is the timing breakdown of a call. All durations are measured
+// from the start of the call.
+type CallTiming struct {
+	// Sent is when the request was written to the connection.
+	Sent time.Duration
+
+	// FirstByte is when the first reply packet was received.
+	FirstByte time.Duration
+
+	// Done is when the reply was returned to the caller.
+	Done time.Duration
+}
+
+// AsyncWithMeta does an async call on the remote and also returns
+// information about the reply.
+func (r *rpc) AsyncWithMeta(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (interface{}, *ResponseMeta, error) {
+	var start, sent time.Time
+	if r.callTiming {
+		start = r.now()
 	}
 
+	req := r.asyncRequest(tipe, method, args)
+
 	err := r.Do(ctx, req)
 	if err != nil {
-		return nil, errors.Wrap(err, "error sending request")
+		return nil, nil, errors.Wrap(err, "error sending request")
+	}
+
+	if r.callTiming {
+		sent = r.now()
 	}
 
 	v, err := req.Stream.Next(ctx)
-	return v, errors.Wrap(err, "error reading response from request source")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error reading response from request source")
+	}
+
+	flag := req.Stream.(*stream).lastFlag()
+	meta := &ResponseMeta{
+		Flag:   flag,
+		Stream: flag.Get(codec.FlagStream),
+	}
+
+	if r.callTiming {
+		meta.Timing = &CallTiming{
+			Sent:      sent.Sub(start),
+			FirstByte: req.firstRx.Sub(start),
+			Done:      r.now().Sub(start),
+		}
+	}
+
+	return v, meta, nil
 }
 
-// Source does a source call on the remote.
-func (r *rpc) Source(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (luigi.Source, error) {
-	inSrc, inSink := luigi.NewPipe(luigi.WithBuffer(bufSize))
+// AsyncInto does an async call on the remote and unmarshals the reply into
+// dst using the session's codec, like json.Unmarshal. String and binary replies can be stored in
+// a *string or *[]byte. If the remote replies with an error, the *CallError
+// is returned as is. dst must be a non-nil pointer, otherwise the call is not
+// sent at all.
+func (r *rpc) AsyncInto(ctx context.Context, dst interface{}, method []string, args ...interface{}) error {
+	if v := reflect.ValueOf(dst); v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.Errorf("AsyncInto needs a non-nil pointer, got %T", dst)
+	}
 
-	req := &Request{
-		Type:   "source",
-		Stream: NewStream(inSrc, r.pkr, 0, true, false),
-		in:     inSink,
+	pkt, err := r.asyncPacket(ctx, method, args)
+	if err != nil {
+		return err
+	}
 
-		Method: method,
-		Args:   args,
+	if typeFlag(pkt.Flag) == codecFlag(r.enc) {
+		err = r.enc.Unmarshal(pkt.Body, dst)
+		return errors.Wrap(err, "error unmarshaling response")
+	}
 
-		tipe: tipe,
+	switch dst := dst.(type) {
+	case *string:
+		*dst = string(pkt.Body)
+	case *[]byte:
+		*dst = []byte(pkt.Body)
+	default:
+		return errors.Errorf("can't store %v response in %T", typeFlag(pkt.Flag), dst)
 	}
 
+	return nil
+}
+
+// AsyncBytes does an async call on the remote and returns the body of the
+// reply as is, without decoding it. This is meant for binary replies like
+// blob chunks, but works for string and JSON replies as well. The request
+// itself is encoded by the session's codec as usual. If the remote
+// replies with an error, the *CallError is returned as is.
+func (r *rpc) AsyncBytes(ctx context.Context, method []string, args ...interface{}) ([]byte, error) {
+	pkt, err := r.asyncPacket(ctx, method, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(pkt.Body), nil
+}
+
+// asyncPacket does an async call and returns the undecoded reply packet. A
+// *CallError sent by the remote is returned as is.
+func (r *rpc) asyncPacket(ctx context.Context, method []string, args []interface{}) (*codec.Packet, error) {
+	req := r.asyncRequest(nil, method, args)
+
 	err := r.Do(ctx, req)
 	if err != nil {
 		return nil, errors.Wrap(err, "error sending request")
 	}
 
-	return req.Stream, nil
+	pkt, err := req.Stream.(*stream).readPacket(ctx)
+	if err != nil {
+		if callErr, ok := errors.Cause(err).(*CallError); ok {
+			return nil, callErr
+		}
+
+		return nil, errors.Wrap(err, "error reading response from request source")
+	}
+
+	return pkt, nil
 }
 
-// Sink does a sink call on the remote.
-func (r *rpc) Sink(ctx context.Context, method []string, args ...interface{}) (luigi.Sink, error) {
-	inSrc, inSink := luigi.NewPipe(luigi.WithBuffer(bufSize))
+// asyncRequest returns a new async request that isn't sent yet.
+func (r *rpc) asyncRequest(tipe interface{}, method []string, args []interface{}) *Request {
+	req, _ := r.newRequest(Async, tipe, method, args)
+	return req
+}
 
+// newRequest returns a new request of type typ that isn't sent yet. Its
+// stream reads and writes according to the type.
+func (r *rpc) newRequest(typ CallType, tipe interface{}, method []string, args []interface{}) (*Request, error) {
 	req := &Request{
-		Type:   "sink",
-		Stream: NewStream(inSrc, r.pkr, 0, false, true),
-		in:     inSink,
-
+		Type:   typ,
 		Method: method,
 		Args:   args,
+
+		tipe: tipe,
 	}
 
-	err := r.Do(ctx, req)
+	err := r.initStream(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "error sending request")
+		return nil, err
 	}
 
-	return req.Stream, nil
+	return req, nil
 }
 
-// Duplex does a duplex call on the remote.
-func (r *rpc) Duplex(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (luigi.Source, luigi.Sink, error) {
-	inSrc, inSink := luigi.NewPipe(luigi.WithBuffer(bufSize))
+// initStream sets up the stream of the outbound request req according to its
+// type, buffering req.BufferSize received packets or the session default.
+func (r *rpc) initStream(req *Request) error {
+	var inStream, outStream bool
+	switch req.Type {
+	case Async, Sync:
+	case Source:
+		inStream = true
+	case Sink:
+		outStream = true
+	case Duplex:
+		inStream, outStream = true, true
+	default:
+		return errors.Errorf("unknown call type %q", req.Type)
+	}
 
-	req := &Request{
-		Type:   "duplex",
-		Stream: NewStream(inSrc, r.pkr, 0, true, true),
-		in:     inSink,
+	size := r.bufSize
+	if req.BufferSize > 0 {
+		size = req.BufferSize
+	}
 
-		Method: method,
-		Args:   args,
+	inSrc, inSink := luigi.NewPipe(luigi.WithBuffer(size))
+	req.Stream = r.newStream(inSrc, 0, inStream, outStream)
+	req.Stream.(*stream).bufSize = int32(size)
+	req.in = inSink
 
-		tipe: tipe,
+	return nil
+}
+
+// Call does a call of type typ on the remote and returns the request. Use
+// its Stream to read the reply, or the values of a source or duplex call, and
+// to write the values of a sink or duplex call. tipe is like in Source.
+// This is for code that decides the call type at runtime; Async, Source, Sink
+// and Duplex are more convenient otherwise.
+func (r *rpc) Call(ctx context.Context, typ CallType, tipe interface{}, method []string, args ...interface{}) (*Request, error) {
+	req, err := r.newRequest(typ, tipe, method, args)
+	if err != nil {
+		return nil, err
 	}
 
-	err := r.Do(ctx, req)
+	err = r.Do(ctx, req)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error sending request")
+		return nil, errors.Wrap(err, "error sending request")
+	}
+
+	return req, nil
+}
+
+// Source does a source call on the remote.
+func (r *rpc) Source(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (luigi.Source, error) {
+	req, err := r.Call(ctx, Source, tipe, method, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return req.Stream, nil
+}
+
+// Sink does a sink call on the remote.
+// The returned sink is a luigi.ErrorCloser. To abort the upload, close it
+// using CloseWithError, which sends the error to the remote as CallError.
+func (r *rpc) Sink(ctx context.Context, method []string, args ...interface{}) (luigi.Sink, error) {
+	req, err := r.Call(ctx, Sink, nil, method, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return req.Stream, nil
+}
+
+// Duplex does a duplex call on the remote.
+func (r *rpc) Duplex(ctx context.Context, tipe interface{}, method []string, args ...interface{}) (luigi.Source, luigi.Sink, error) {
+	req, err := r.Call(ctx, Duplex, tipe, method, args...)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return req.Stream, req.Stream, nil
@@ -151,58 +486,393 @@ func (r *rpc) Terminate() error {
 	r.tLock.Lock()
 	defer r.tLock.Unlock()
 
+	return r.terminate()
+}
+
+// drainInterval is how often TerminateGracefully checks whether all requests
+// are done.
+const drainInterval = 10 * time.Millisecond
+
+// TerminateGracefully stops accepting new requests, waits until the pending
+// ones are done and then terminates the session. New calls are rejected with
+// ErrShuttingDown, on both sides. If ctx is done before all requests are,
+// the session is terminated anyway and the error of ctx is returned.
+func (r *rpc) TerminateGracefully(ctx context.Context) error {
+	r.rLock.Lock()
+	r.draining = true
+	r.rLock.Unlock()
+
+	tick := time.NewTicker(drainInterval)
+	defer tick.Stop()
+
+	for r.reqs.Len() > 0 {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			r.Terminate()
+			return errors.Wrap(ctx.Err(), "pending requests did not finish")
+		}
+	}
+
+	return r.Terminate()
+}
+
+// terminate closes the packer unless that happened already. Must be called
+// with r.tLock held.
+func (r *rpc) terminate() error {
+	if r.terminated {
+		return nil
+	}
+
 	r.terminated = true
-	return r.pkr.Close()
+	err := r.pkr.Close()
+
+	// otherwise Serve reports how the session ended
+	if !r.serving {
+		r.markDone(nil)
+	}
+
+	return err
 }
 
-func (r *rpc) finish(ctx context.Context, req int32) error {
-	delete(r.reqs, req)
+// markDone closes the channel returned by Done unless that happened already.
+// Must be called with r.tLock held.
+func (r *rpc) markDone(err error) {
+	select {
+	case <-r.done:
+	default:
+		r.doneErr = err
+		close(r.done)
+	}
+}
 
-	err := r.pkr.Pour(ctx, newEndOkayPacket(req))
-	return errors.Wrap(err, "error pouring done message")
+// Done returns a channel that is closed once the session is over, i.e. when
+// Serve returned or, if it is not running, when the session was terminated.
+func (r *rpc) Done() <-chan struct{} {
+	return r.done
 }
 
-// Do executes a generic call
+// Err returns the error the session ended with. It is nil while the session
+// is running and if it ended cleanly, e.g. because the peer closed the
+// connection or the session was terminated locally.
+func (r *rpc) Err() error {
+	r.tLock.Lock()
+	defer r.tLock.Unlock()
+
+	return r.doneErr
+}
+
+// closeAllRequests closes the inbound pipes of all pending requests with err
+// and removes them.
+func (r *rpc) closeAllRequests(err error) {
+	for _, req := range r.reqs.Drain() {
+		if ec, ok := req.in.(luigi.ErrorCloser); ok {
+			ec.CloseWithError(err)
+		} else {
+			req.in.Close()
+		}
+
+		remoteClosed(req)
+	}
+}
+
+// CancelMethod ends all pending requests, inbound and outbound, that call
+// method. The remote is sent err and so are the local readers of the streams.
+// Packets the remote still sends for these requests are dropped.
+// It returns the number of cancelled requests.
+func (r *rpc) CancelMethod(method []string, err error) int {
+	r.rLock.Lock()
+	defer r.rLock.Unlock()
+
+	var n int
+	for id, req := range r.reqs.Snapshot() {
+		if !methodEqual(req.Method, method) {
+			continue
+		}
+
+		if r.cancelRequest(id, req, err) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// cancelRequest ends the pending request req with err on both sides and
+// drops the packets the remote still sends for it. It returns false if the
+// request already ended. Must be called with r.rLock held.
+func (r *rpc) cancelRequest(id int32, req *Request, err error) bool {
+	// it might have ended in the meantime
+	if _, ok := r.reqs.Get(id); !ok {
+		return false
+	}
+	r.reqs.Delete(id)
+
+	// the remote doesn't send anything more on inbound async calls
+	if id > 0 || req.Type.Flags().Get(codec.FlagStream) {
+		r.rejected[id] = struct{}{}
+	}
+
+	if ec, ok := req.in.(luigi.ErrorCloser); ok {
+		ec.CloseWithError(err)
+	} else {
+		req.in.Close()
+	}
+	req.Stream.CloseWithError(err)
+	remoteClosed(req)
+
+	r.observeEnd(req, err)
+	r.emit(Event{Type: EventCallEnd, Req: id, Method: req.Method, Outbound: id > 0, Err: err})
+	return true
+}
+
+func methodEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// numberPackets enables numbering the packets sent on the stream of req if
+// sequence numbers are enabled.
+func (r *rpc) numberPackets(req *Request) {
+	if str, ok := req.Stream.(*stream); ok && r.seqNumbers {
+		str.seq = true
+	}
+}
+
+// remoteClosed signals that no more packets will arrive for req.
+func remoteClosed(req *Request) {
+	if str, ok := req.Stream.(*stream); ok {
+		str.markRemoteClosed()
+	}
+}
+
+// StartedAt returns the time the session was started.
+func (r *rpc) StartedAt() time.Time {
+	return r.startedAt
+}
+
+// Uptime returns for how long the session has been running.
+func (r *rpc) Uptime() time.Duration {
+	return r.now().Sub(r.startedAt)
+}
+
+// RemoteAddr returns the address of the peer, or nil if the packer doesn't
+// know it. Packers created by NewPacker know it if the connection they wrap
+// is a net.Conn.
+func (r *rpc) RemoteAddr() net.Addr {
+	if pkr, ok := r.pkr.(remoteAddrer); ok {
+		return pkr.RemoteAddr()
+	}
+
+	return nil
+}
+
+// Do executes a generic call.
+// If req has no stream, one is set up according to req.Type and
+// req.BufferSize. Read or write the values of the call using req.Stream.
+// If ctx is done before the call finished, the call is cancelled with
+// ctx.Err(): the remote is sent the error, so is the local reader, and the
+// request is forgotten. This bounds the whole lifetime of streams, not just
+// sending the request.
 func (r *rpc) Do(ctx context.Context, req *Request) error {
 	var (
 		pkt codec.Packet
 		err error
 	)
 
+	if req.Stream == nil && req.in == nil {
+		err = r.initStream(req)
+		if err != nil {
+			return errors.Wrap(err, "invalid request")
+		}
+	}
+
+	if req.Stream == nil {
+		return errors.New("request has no stream")
+	}
+
+	if req.in == nil {
+		return errors.New("request has no inbound sink, use Async, Source, Sink or Duplex to construct it")
+	}
+
 	if req.Args == nil {
 		req.Args = []interface{}{}
 	}
 
-	func() {
+	req.Args = r.withDefaultArgs(req.Method, req.Args)
+
+	if req.Metadata == nil {
+		req.Metadata = metaFromContext(ctx)
+	}
+
+	err = req.validate()
+	if err != nil {
+		return errors.Wrap(err, "invalid request")
+	}
+
+	err = r.checkManifest(req)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
 		r.rLock.Lock()
 		defer r.rLock.Unlock()
 
-		pkt.Flag = pkt.Flag.Set(codec.FlagJSON)
+		if r.draining {
+			return ErrShuttingDown
+		}
+
+		if r.metrics != nil {
+			req.started = r.now()
+		}
+
+		if req.Type.Flags().Get(codec.FlagStream) {
+			max := atomic.LoadInt32(&r.peerMaxStreams)
+			if max > 0 && r.reqs.Streams(true) >= int(max) {
+				return ErrStreamLimit
+			}
+		}
+
+		pkt.Flag = pkt.Flag.Set(codecFlag(r.enc))
 		pkt.Flag = pkt.Flag.Set(req.Type.Flags())
 
-		pkt.Body, err = json.Marshal(req)
+		var err error
+		pkt.Body, err = r.enc.Marshal(newWireRequest(req))
+		if err != nil {
+			return errors.Wrap(err, "error marshaling request")
+		}
+
+		if id, ok := requestIDFromContext(ctx); ok {
+			if id <= 0 {
+				return errors.Errorf("explicit request id must be positive, got %d", id)
+			}
+
+			if !r.reqs.Add(id, req) {
+				return errors.Errorf("request id %d is already in use", id)
+			}
+
+			pkt.Req = id
+			if id > r.highest {
+				r.highest = id
+			}
+		} else {
+			id, err := r.nextID()
+			if err != nil {
+				return err
+			}
+
+			pkt.Req = id
+			r.reqs.Add(pkt.Req, req)
+		}
 
-		pkt.Req = r.highest + 1
-		r.highest = pkt.Req
-		r.reqs[pkt.Req] = req
 		req.Stream.WithReq(pkt.Req)
 		req.Stream.WithType(req.tipe)
+		r.numberPackets(req)
+		r.trackActivity(req)
 
 		req.pkt = &pkt
+		return nil
 	}()
 	if err != nil {
 		return err
 	}
 
-	return r.pkr.Pour(ctx, &pkt)
+	err = r.pkr.Pour(ctx, &pkt)
+	if err != nil {
+		// the request didn't make it out, so nothing will answer it
+		r.rLock.Lock()
+		r.reqs.Delete(pkt.Req)
+		r.rLock.Unlock()
+		return err
+	}
+
+	atomic.AddUint64(&r.outbound, 1)
+	r.emit(Event{Type: EventCallStart, Req: pkt.Req, Method: req.Method, Outbound: true})
+	if r.metrics != nil {
+		r.metrics.IncRequests(req.Type)
+	}
+
+	if ctx.Done() != nil {
+		go r.cancelOnDone(ctx, req)
+	}
+
+	return nil
 }
 
-// ParseRequest parses the first packet of a stream and parses the contained request
+// nextID returns an unused id for an outbound request. After math.MaxInt32
+// the ids wrap around to 1, skipping the ones still in use, so they never
+// turn negative like the ids of inbound requests. Must be called with r.rLock
+// held.
+func (r *rpc) nextID() (int32, error) {
+	// every id in use is skipped at most once
+	tries := r.reqs.Len() + len(r.rejected) + 1
+
+	for i := 0; i < tries; i++ {
+		if r.highest == math.MaxInt32 {
+			r.highest = 0
+		}
+		r.highest++
+
+		if _, ok := r.reqs.Get(r.highest); ok {
+			continue
+		}
+		if _, ok := r.rejected[r.highest]; ok {
+			continue
+		}
+
+		return r.highest, nil
+	}
+
+	return 0, errors.New("no free request id")
+}
+
+// cancelOnDone cancels the outbound request req once ctx is done, unless the
+// remote ended it before.
+func (r *rpc) cancelOnDone(ctx context.Context, req *Request) {
+	// streams passed in by the caller may not tell us, then only ctx counts
+	var remoteClosed <-chan struct{}
+	if sw, ok := req.Stream.(StreamWaiter); ok {
+		remoteClosed = sw.RemoteClosed()
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-remoteClosed:
+		return
+	}
+
+	// both may be ready, the remote's end wins
+	select {
+	case <-remoteClosed:
+		return
+	default:
+	}
+
+	r.rLock.Lock()
+	defer r.rLock.Unlock()
+
+	r.cancelRequest(req.pkt.Req, req, ctx.Err())
+}
+
+// ParseRequest parses the first packet of a stream and parses the contained request.
+// Packets without the stream flag open async calls. Their stream is neither
+// readable nor writable as a stream; the handler answers them with a single
+// value using Request.Return, or with an error using Request.CloseWithError.
 func (r *rpc) ParseRequest(pkt *codec.Packet) (*Request, error) {
 	var req Request
 
-	if !pkt.Flag.Get(codec.FlagJSON) {
-		return nil, errors.New("expected JSON flag")
+	if typeFlag(pkt.Flag) != codecFlag(r.enc) {
+		return nil, errTypeFlag
 	}
 
 	if pkt.Req >= 0 {
@@ -210,33 +880,59 @@ func (r *rpc) ParseRequest(pkt *codec.Packet) (*Request, error) {
 		return nil, errors.New("expected negative request id")
 	}
 
-	err := json.Unmarshal(pkt.Body, &req)
+	err := decodeWireRequest(r.enc, pkt.Body, &req)
 	if err != nil {
 		return nil, errors.Wrap(err, "error decoding packet")
 	}
 	req.pkt = pkt
 
-	inSrc, inSink := luigi.NewPipe(luigi.WithBuffer(bufSize))
+	err = r.checkMethodLength(req.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	inSrc, inSink := luigi.NewPipe(luigi.WithBuffer(r.bufSize))
 
 	var inStream, outStream bool
 	if pkt.Flag.Get(codec.FlagStream) {
 		switch req.Type {
-		case "duplex":
+		case Duplex:
 			inStream, outStream = true, true
-		case "source":
+		case Source:
 			inStream, outStream = false, true
-		case "sink":
+		case Sink:
 			inStream, outStream = true, false
 		default:
 			return nil, errors.Errorf("unhandled request type: %q", req.Type)
 		}
 	}
-	req.Stream = NewStream(inSrc, r.pkr, pkt.Req, inStream, outStream)
+	req.Stream = r.newStream(inSrc, pkt.Req, inStream, outStream)
+	req.Stream.(*stream).bufSize = int32(r.bufSize)
 	req.in = inSink
 
 	return &req, nil
 }
 
+// checkMethodLength returns an error if method exceeds the configured limits.
+func (r *rpc) checkMethodLength(method []string) error {
+	if r.maxMethodElems > 0 && len(method) > r.maxMethodElems {
+		return errors.Errorf("method has %d elements, at most %d allowed", len(method), r.maxMethodElems)
+	}
+
+	if r.maxMethodChars > 0 {
+		var n int
+		for _, name := range method {
+			n += len(name)
+		}
+
+		if n > r.maxMethodChars {
+			return errors.Errorf("method name has %d characters, at most %d allowed", n, r.maxMethodChars)
+		}
+	}
+
+	return nil
+}
+
 func isTrue(data []byte) bool {
 	return len(data) == 4 &&
 		data[0] == 't' &&
@@ -245,34 +941,229 @@ func isTrue(data []byte) bool {
 		data[3] == 'e'
 }
 
+// errTypeFlag is returned by ParseRequest if the packet was not encoded by the
+// session's codec.
+var errTypeFlag = errors.New("unexpected type flag")
+
+// newStream returns a stream for a request of the session that encodes values
+// using the session's codec.
+func (r *rpc) newStream(src luigi.Source, req int32, ins, outs bool) Stream {
+	str := NewStream(src, r.pkr, req, ins, outs).(*stream)
+	str.enc = r.enc
+	str.sessionDone = r.done
+
+	return str
+}
+
+// dropRequest ignores the request opened by pkt without replying. This is
+// for openers that are too broken to be answered. If pkt opened a stream,
+// the following packets of that stream are dropped as well. Must be called
+// with r.rLock held.
+func (r *rpc) dropRequest(pkt *codec.Packet, reason error) {
+	r.logger.Log("event", "packet dropped", "req", pkt.Req, "flag", pkt.Flag, "err", reason)
+	r.emit(Event{Type: EventError, Req: pkt.Req, Err: reason})
+
+	if pkt.Flag.Get(codec.FlagStream) && !pkt.Flag.Get(codec.FlagEndErr) {
+		r.rejected[pkt.Req] = struct{}{}
+	}
+}
+
+// rejectRequest replies to the request opened by pkt with an error instead
+// of handling it. If pkt opened a stream, the following packets of that
+// stream are dropped. Must be called with r.rLock held.
+func (r *rpc) rejectRequest(pkt *codec.Packet, reason error) {
+	r.logger.Log("event", "request rejected", "req", pkt.Req, "err", reason)
+	r.emit(Event{Type: EventError, Req: pkt.Req, Err: reason})
+	if r.metrics != nil {
+		r.metrics.IncErrors()
+	}
+
+	if pkt.Flag.Get(codec.FlagStream) && !pkt.Flag.Get(codec.FlagEndErr) {
+		r.rejected[pkt.Req] = struct{}{}
+	}
+
+	errPkt, err := newEndErrPacket(pkt.Req, reason)
+	if err != nil {
+		return
+	}
+
+	// we are called from the Serve loop, so don't block on the write.
+	// see stream.Close for details.
+	go r.pkr.Pour(context.TODO(), errPkt)
+}
+
 // fetchRequest returns the request from the reqs map or, if it's not there yet, builds a new one.
+// If the packet was handled already, the returned request is nil.
 func (r *rpc) fetchRequest(ctx context.Context, pkt *codec.Packet) (*Request, bool, error) {
 	var err error
 
 	r.rLock.Lock()
 	defer r.rLock.Unlock()
 
+	// drop packets of streams we rejected or cancelled
+	if _, ok := r.rejected[pkt.Req]; ok {
+		// cancelled async calls are answered with a single packet
+		if pkt.Flag.Get(codec.FlagEndErr) || !pkt.Flag.Get(codec.FlagStream) {
+			delete(r.rejected, pkt.Req)
+		}
+
+		return nil, true, nil
+	}
+
 	// get request from map, otherwise make new one
-	req, ok := r.reqs[pkt.Req]
+	req, ok := r.reqs.Get(pkt.Req)
 	if !ok {
+		// check the limit first, so refused requests cost next to nothing
+		if r.maxRequests > 0 && r.reqs.Requests(false) >= r.maxRequests {
+			r.rejectRequest(pkt, errors.New("too many requests"))
+			return nil, true, nil
+		}
+
 		req, err = r.ParseRequest(pkt)
-		if err != nil {
-			return nil, false, errors.Wrap(err, "error parsing request")
+		if err == errTypeFlag {
+			r.dropRequest(pkt, errors.Wrap(err, "error parsing request"))
+			return nil, true, nil
+		} else if err != nil {
+			r.rejectRequest(pkt, errors.Wrap(err, "error parsing request"))
+			return nil, true, nil
+		}
+		if r.draining {
+			r.rejectRequest(pkt, ErrShuttingDown)
+			return nil, true, nil
+		}
+		if r.maxStreams > 0 && req.Type.Flags().Get(codec.FlagStream) && r.reqs.Streams(false) >= r.maxStreams {
+			r.rejectRequest(pkt, errors.New("too many concurrent streams"))
+			return nil, true, nil
 		}
-		r.reqs[pkt.Req] = req
 
-		go r.root.HandleCall(ctx, req)
+		if r.metrics != nil {
+			req.started = r.now()
+			r.metrics.IncRequests(req.Type)
+		}
+
+		r.reqs.Add(pkt.Req, req)
+		r.numberPackets(req)
+		r.trackActivity(req)
+		atomic.AddUint64(&r.inbound, 1)
+		r.emit(Event{Type: EventCallStart, Req: pkt.Req, Method: req.Method})
+
+		switch {
+		case r.negotiateStreams && methodEqual(req.Method, capsMethod):
+			go r.replyCapabilities(ctx, req)
+		case methodEqual(req.Method, goodbyeMethod):
+			go r.replyGoodbye(ctx, req)
+		case r.keepaliveInterval > 0 && methodEqual(req.Method, keepaliveMethod) && req.Type == Async:
+			go r.replyKeepalive(ctx, req)
+		default:
+			go r.handleCall(ctx, req)
+		}
+	} else if str, isStream := req.Stream.(*stream); isStream {
+		str.touch()
 	}
 
 	return req, !ok, nil
 }
 
+// handleCall passes req to the handler if the authorizers allow it. If the
+// handler panics, the call is ended with an error instead of crashing the
+// process.
+func (r *rpc) handleCall(ctx context.Context, req *Request) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		stack := debug.Stack()
+		err := errors.Errorf("handler panicked: %v", v)
+
+		r.logger.Log("event", "handler panicked", "method", methodString(req.Method), "panic", v, "stack", string(stack))
+		r.emit(Event{Type: EventError, Req: req.pkt.Req, Method: req.Method, Err: err})
+
+		callErr := &CallError{Name: "Error", Message: err.Error()}
+		if r.panicStacks {
+			callErr.Stack = string(stack)
+		}
+		req.CloseWithError(callErr)
+	}()
+
+	if authorize(ctx, req, r.authz) {
+		r.root.HandleCall(ctx, req)
+	}
+}
+
 type Server interface {
 	Serve(context.Context) error
 }
 
-// Serve handles the RPC session
+// ResultServer is a Server that can also report why serving ended, see
+// ServeResult. The sessions returned by Handle implement it.
+type ResultServer interface {
+	Server
+	ServeWithResult(context.Context) ServeResult
+}
+
+// Serve handles the RPC session. It returns nil when the session is
+// terminated or the peer closes the connection. If ctx is cancelled or its
+// deadline passes, the connection is closed and ctx.Err() is returned.
 func (r *rpc) Serve(ctx context.Context) (err error) {
+	r.tLock.Lock()
+	r.serving = true
+	r.tLock.Unlock()
+
+	defer func() {
+		r.tLock.Lock()
+		defer r.tLock.Unlock()
+
+		r.serving = false
+		r.markDone(err)
+	}()
+
+	defer func() {
+		r.logger.Log("event", "serve done", "err", err)
+
+		if err != nil {
+			r.emit(Event{Type: EventError, Err: err})
+		}
+		r.emit(Event{Type: EventTerminate})
+	}()
+
+	// once we stop reading, pending requests won't get any more packets
+	defer r.closeAllRequests(ErrSessionTerminated)
+
+	// let handlers like HealthHandler find the session
+	ctx = context.WithValue(ctx, sessionKey{}, r)
+
+	cancelConnect := func() {}
+	r.connectOnce.Do(func() {
+		cancelConnect = r.connect(ctx)
+		if r.negotiateStreams {
+			go r.negotiate(ctx)
+		}
+	})
+	defer cancelConnect()
+
+	// the packer may block in Next regardless of ctx, so close it to unblock
+	serveDone := make(chan struct{})
+	defer close(serveDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.tLock.Lock()
+			defer r.tLock.Unlock()
+
+			r.terminate()
+		case <-serveDone:
+		}
+	}()
+
+	if r.keepaliveInterval > 0 {
+		go r.keepalive(ctx, serveDone)
+	}
+	if r.requestTTL > 0 {
+		go r.reapIdle(ctx, serveDone)
+	}
+
 	for {
 		var vpkt interface{}
 
@@ -283,6 +1174,14 @@ func (r *rpc) Serve(ctx context.Context) (err error) {
 			r.tLock.Lock()
 			defer r.tLock.Unlock()
 
+			if err != nil && ctx.Err() != nil {
+				err = ctx.Err()
+				return true
+			}
+			if err != nil && r.abortErr != nil {
+				err = r.abortErr
+				return true
+			}
 			if luigi.IsEOS(err) {
 				err = nil
 				return true
@@ -292,6 +1191,10 @@ func (r *rpc) Serve(ctx context.Context) (err error) {
 					err = nil
 					return true
 				}
+				if errors.Cause(err) == codec.ErrBodyTooLarge {
+					// we can't find the next header, so the connection is useless
+					r.terminate()
+				}
 				err = errors.Wrap(err, "error reading from packer source")
 				return true
 			}
@@ -305,40 +1208,11 @@ func (r *rpc) Serve(ctx context.Context) (err error) {
 		pkt := vpkt.(*codec.Packet)
 
 		if pkt.Flag.Get(codec.FlagEndErr) {
-			if req, ok := r.reqs[pkt.Req]; ok {
-				err := func() error {
-					r.rLock.Lock()
-					defer r.rLock.Unlock()
-
-					if isTrue(pkt.Body) {
-						err = req.in.Close()
-						if err != nil {
-							return errors.Wrap(err, "error closing pipe sink")
-						}
-
-						err = req.Stream.Close()
-						if err != nil {
-							return errors.Wrap(err, "error closing stream")
-						}
-					} else {
-						e, err := parseError(pkt.Body)
-						if err != nil {
-							return errors.Wrap(err, "error parsing error packet")
-						}
-
-						err = req.in.(luigi.ErrorCloser).CloseWithError(e)
-						if err != nil {
-							return errors.Wrap(err, "error closing pipe sink with error")
-						}
-					}
-
-					delete(r.reqs, pkt.Req)
-					return nil
-				}()
-				if err != nil {
-					return err
-				}
-
+			handled, err := r.handleEnd(pkt)
+			if err != nil {
+				return err
+			}
+			if handled {
 				continue
 			}
 		}
@@ -347,28 +1221,89 @@ func (r *rpc) Serve(ctx context.Context) (err error) {
 		if err != nil {
 			return errors.Wrap(err, "error getting request")
 		}
-		if isNew {
+		if isNew || req == nil {
 			continue
 		}
 
-		// localize defer
-		err = func() error {
-			// pour may block so we need to time out.
-			// note that you can use buffers make this less probable
-			ctx, cancel := context.WithTimeout(ctx, rxTimeout)
-			defer cancel()
+		if r.callTiming && req.firstRx.IsZero() {
+			req.firstRx = r.now()
+		}
 
-			//err := req.in.Pour(ctx, v)
-			err := req.in.Pour(ctx, pkt)
-			return errors.Wrap(err, "error pouring data to handler")
-		}()
+		// the reply to an async call ends it, even if an end packet follows.
+		// mark that before the caller sees the reply, see cancelOnDone.
+		if pkt.Req > 0 && !req.Type.Flags().Get(codec.FlagStream) {
+			remoteClosed(req)
+		}
 
+		err = r.deliver(ctx, req, pkt)
 		if err != nil {
 			return err
 		}
 	}
 }
 
+// handleEnd ends the pending request the end packet pkt is for. It returns
+// false if there is no such request, e.g. because the packet opens a new one.
+func (r *rpc) handleEnd(pkt *codec.Packet) (bool, error) {
+	r.rLock.Lock()
+	defer r.rLock.Unlock()
+
+	// look the request up under the lock, it may be cancelled concurrently
+	req, ok := r.reqs.Get(pkt.Req)
+	if !ok {
+		return false, nil
+	}
+
+	ev := Event{Type: EventCallEnd, Req: pkt.Req, Method: req.Method, Outbound: pkt.Req > 0}
+	defer func() {
+		r.observeEnd(req, ev.Err)
+		r.emit(ev)
+	}()
+
+	if isTrue(pkt.Body) {
+		err := req.in.Close()
+		if err != nil {
+			return true, errors.Wrap(err, "error closing pipe sink")
+		}
+
+		if str, ok := req.Stream.(*stream); ok {
+			// the remote only ended its direction. if we still send, our
+			// end is up to whoever closes the stream.
+			if !str.outStream {
+				str.endAfterRemote()
+			}
+		} else {
+			err = req.Stream.Close()
+			if err != nil {
+				return true, errors.Wrap(err, "error closing stream")
+			}
+		}
+	} else {
+		e, err := parseError(pkt.Body)
+		if err != nil {
+			// a broken error packet still ends the request, but not the session
+			r.logger.Log("event", "malformed end packet", "req", pkt.Req, "err", err)
+			e = &CallError{Name: "Error", Message: "malformed error packet: " + err.Error()}
+		}
+
+		ev.Err = e
+
+		err = req.in.(luigi.ErrorCloser).CloseWithError(e)
+		if err != nil {
+			return true, errors.Wrap(err, "error closing pipe sink with error")
+		}
+
+		// acknowledge aborted streams, so the remote can clean up
+		if str, ok := req.Stream.(*stream); ok && req.Type.Flags().Get(codec.FlagStream) {
+			str.endAfterRemote()
+		}
+	}
+
+	remoteClosed(req)
+	r.reqs.Delete(pkt.Req)
+	return true, nil
+}
+
 type CallError struct {
 	Name    string `json:"name"`
 	Message string `json:"message"`
@@ -384,11 +1319,18 @@ func parseError(data []byte) (*CallError, error) {
 
 	err := json.Unmarshal(data, &e)
 	if err != nil {
-		return nil, errors.Wrap(err, "error unmarshaling error packet")
+		// not an error object. be lenient and use the body as message.
+		var msg string
+		if json.Unmarshal(data, &msg) != nil {
+			msg = string(data)
+		}
+
+		return &CallError{Name: "Error", Message: msg}, nil
 	}
 
-	if e.Name != "Error" {
-		return nil, errors.New(`name is not "Error"`)
+	// js peers send subclasses like TypeError or their own error names
+	if e.Name == "" {
+		return nil, errors.New("error has no name")
 	}
 
 	return &e, nil
@@ -1,14 +1,21 @@
 package muxrpc // import "cryptoscope.co/go/muxrpc"
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"cryptoscope.co/go/luigi"
+	"cryptoscope.co/go/muxrpc/codec"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
@@ -25,6 +32,55 @@ func (h *testHandler) HandleConnect(ctx context.Context, e Endpoint) {
 	h.connect(ctx, e)
 }
 
+// callerHandler returns a handler for the side of a test pair that only makes
+// calls. It fails the test if it is called.
+func callerHandler(t testing.TB) Handler {
+	return &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			t.Errorf("unexpected call to rpc1: %#v", req)
+		},
+		connect: noopConnect,
+	}
+}
+
+// serveTestPair connects two endpoints using loopback packers and serves both.
+// The returned function terminates both sessions and waits for Serve to return.
+func serveTestPair(t testing.TB, h1, h2 Handler, opts ...HandleOption) (Endpoint, Endpoint, func()) {
+	pkr1, pkr2 := NewLoopbackPackers()
+
+	rpc1 := Handle(pkr1, h1, opts...)
+	rpc2 := Handle(pkr2, h2, opts...)
+
+	ctx := context.Background()
+	serve1 := make(chan struct{})
+	serve2 := make(chan struct{})
+
+	go func() {
+		err := rpc1.(*rpc).Serve(ctx)
+		if err != nil {
+			t.Errorf("rpc1: %+v", err)
+		}
+		close(serve1)
+	}()
+
+	go func() {
+		err := rpc2.(*rpc).Serve(ctx)
+		if err != nil {
+			t.Errorf("rpc2: %+v", err)
+		}
+		close(serve2)
+	}()
+
+	return rpc1, rpc2, func() {
+		rpc1.Terminate()
+		rpc2.Terminate()
+		<-serve1
+		<-serve2
+	}
+}
+
+func noopConnect(context.Context, Endpoint) {}
+
 func TestAsync(t *testing.T) {
 	c1, c2 := net.Pipe()
 
@@ -235,6 +291,55 @@ func TestSource(t *testing.T) {
 	}
 }
 
+func TestSourceEnd(t *testing.T) {
+	const n = 25
+
+	h1 := &testHandler{connect: noopConnect}
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			for i := 0; i < n; i++ {
+				if err := req.Stream.Pour(ctx, i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			// sends the end packet
+			if err := req.Stream.Close(); err != nil {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	src, err := rpc1.Source(ctx, 0, []string{"count"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		v, err := src.Next(ctx)
+		if luigi.IsEOS(err) {
+			if i != n {
+				t.Errorf("expected %d values before the end, got %d", n, i)
+			}
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error after %d values: %v", i, err)
+		}
+
+		if v != i {
+			t.Errorf("expected %d, got %v", i, v)
+		}
+	}
+}
+
 func TestSink(t *testing.T) {
 	expRx := []string{
 		"you are a test",
@@ -481,6 +586,63 @@ func TestDuplex(t *testing.T) {
 		t.Errorf("error closing stream: %+v", err)
 	}
 }
+
+func TestCallType(t *testing.T) {
+	h1 := &testHandler{connect: noopConnect}
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			switch req.Type {
+			case "async":
+				req.Return(ctx, "pong")
+			case "duplex":
+				for {
+					v, err := req.Stream.Next(ctx)
+					if err != nil {
+						break
+					}
+					req.Stream.Pour(ctx, v)
+				}
+				req.Stream.Close()
+			default:
+				req.CloseWithError(errors.Errorf("unexpected call type %q", req.Type))
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+
+	req, err := rpc1.(Caller).Call(ctx, "async", "string", []string{"ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := req.Stream.Next(ctx); err != nil || v != "pong" {
+		t.Errorf("expected pong, got %v, %v", v, err)
+	}
+
+	req, err = rpc1.(Caller).Call(ctx, "duplex", "string", []string{"echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.Type.Flags().Get(codec.FlagStream) || !req.pkt.Flag.Get(codec.FlagStream) {
+		t.Error("expected duplex call to be sent as stream")
+	}
+	if err := req.Stream.Pour(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := req.Stream.Next(ctx); err != nil || v != "hello" {
+		t.Errorf("expected echo, got %v, %v", v, err)
+	}
+	req.Stream.Close()
+
+	if _, err := rpc1.(Caller).Call(ctx, "bogus", nil, []string{"nope"}); err == nil {
+		t.Error("expected unknown call type to be rejected")
+	}
+}
+
 func TestErrorAsync(t *testing.T) {
 	c1, c2 := net.Pipe()
 
@@ -585,3 +747,1995 @@ func TestErrorAsync(t *testing.T) {
 	}
 	t.Log("done")
 }
+
+func TestDoIncompleteRequest(t *testing.T) {
+	c1, _ := net.Pipe()
+
+	h := &testHandler{
+		call:    func(context.Context, *Request) {},
+		connect: func(context.Context, Endpoint) {},
+	}
+
+	e := Handle(NewPacker(c1), h)
+	defer e.Terminate()
+
+	// requests without a stream get one, if the type is known
+	err := e.Do(context.Background(), &Request{Type: "bogus", Method: []string{"whoami"}})
+	if err == nil {
+		t.Fatal("expected error for request of unknown type")
+	}
+
+	inSrc, _ := luigi.NewPipe()
+	err = e.Do(context.Background(), &Request{
+		Type:   "async",
+		Method: []string{"whoami"},
+		Stream: NewStream(inSrc, NewPacker(c1), 0, false, false),
+	})
+	if err == nil {
+		t.Fatal("expected error for request without inbound sink")
+	}
+}
+
+func TestAsyncConnectionLost(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	called := make(chan struct{})
+	serve1 := make(chan struct{})
+
+	h1 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			t.Errorf("unexpected call to rpc1: %#v", req)
+		},
+		connect: func(ctx context.Context, e Endpoint) {},
+	}
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			// never reply
+			close(called)
+		},
+		connect: func(ctx context.Context, e Endpoint) {},
+	}
+
+	rpc1 := Handle(NewPacker(c1), h1)
+	rpc2 := Handle(NewPacker(c2), h2)
+
+	ctx := context.Background()
+
+	go func() {
+		err := rpc1.(*rpc).Serve(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		close(serve1)
+	}()
+
+	go rpc2.(*rpc).Serve(ctx)
+
+	go func() {
+		<-called
+		c2.Close()
+	}()
+
+	_, err := rpc1.Async(ctx, "string", []string{"whoami"})
+	if errors.Cause(err) != ErrSessionTerminated {
+		t.Errorf("expected ErrSessionTerminated, got %+v", err)
+	}
+
+	<-serve1
+}
+
+func TestPourAfterTerminate(t *testing.T) {
+	poured := make(chan error, 1)
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			for {
+				if err := req.Stream.Pour(ctx, "tick"); err != nil {
+					poured <- err
+					return
+				}
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, rpc2, done := serveTestPair(t, callerHandler(t), h2)
+	defer done()
+
+	src, err := rpc1.Source(context.Background(), "string", []string{"ticks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Next(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rpc2.Terminate()
+
+	select {
+	case err := <-poured:
+		if errors.Cause(err) != ErrSessionTerminated {
+			t.Errorf("expected ErrSessionTerminated, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler kept pouring to the terminated session")
+	}
+}
+
+func TestStartedAt(t *testing.T) {
+	c1, _ := net.Pipe()
+
+	before := time.Now()
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect})
+	defer e.Terminate()
+
+	sl := e.(SessionLifetime)
+	if sl.StartedAt().Before(before) || sl.StartedAt().After(time.Now()) {
+		t.Errorf("unexpected start time %v", sl.StartedAt())
+	}
+
+	if up := sl.Uptime(); up < 0 || up > time.Since(before) {
+		t.Errorf("unexpected uptime %v", up)
+	}
+}
+
+func TestParseErrorPlain(t *testing.T) {
+	for _, body := range []string{`omg an error!`, `"omg an error!"`, `{"name":"Error","message":"omg an error!"}`} {
+		e, err := parseError([]byte(body))
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", body, err)
+			continue
+		}
+
+		if e.Name != "Error" || e.Message != "omg an error!" {
+			t.Errorf("unexpected error %#v parsed from %q", e, body)
+		}
+	}
+}
+
+func TestParseErrorName(t *testing.T) {
+	e, err := parseError([]byte(`{"name":"TypeError","message":"not a function","stack":"at foo.js:1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := CallError{Name: "TypeError", Message: "not a function", Stack: "at foo.js:1"}
+	if *e != want {
+		t.Errorf("unexpected error %#v", e)
+	}
+
+	if _, err := parseError([]byte(`{"message":"no name"}`)); err == nil {
+		t.Error("expected an error without a name to be rejected")
+	}
+}
+
+func TestRequestMeta(t *testing.T) {
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			trace, _ := req.Meta()["trace"].(string)
+			err := req.Return(ctx, trace)
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := WithMeta(context.Background(), map[string]interface{}{"trace": "abc"})
+	v, err := rpc1.Async(ctx, "string", []string{"whoami"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "abc" {
+		t.Errorf("expected handler to see trace id, got %q", v)
+	}
+}
+
+func TestCallFromConnect(t *testing.T) {
+	connected := make(chan interface{})
+
+	h1 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			t.Errorf("unexpected call to rpc1: %#v", req)
+		},
+		connect: func(ctx context.Context, e Endpoint) {
+			v, err := e.Async(ctx, "string", []string{"whoami"})
+			if err != nil {
+				t.Error(err)
+			}
+			connected <- v
+		},
+	}
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Return(ctx, "you are a test")
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	_, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	if v := <-connected; v != "you are a test" {
+		t.Errorf("unexpected response %q", v)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	connCtxDone := make(chan struct{})
+	h := &testHandler{
+		connect: func(ctx context.Context, e Endpoint) {
+			<-ctx.Done()
+			close(connCtxDone)
+		},
+	}
+
+	e := Handle(NewPacker(c1), h, WithConnectTimeout(10*time.Millisecond))
+	defer e.Terminate()
+
+	go e.(*rpc).Serve(context.Background())
+
+	select {
+	case <-connCtxDone:
+	case <-time.After(time.Second):
+		t.Fatal("HandleConnect context was not cancelled")
+	}
+}
+
+func TestExplicitRequestID(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect})
+	defer e.Terminate()
+
+	pkts := make(chan *codec.Packet)
+	go func() {
+		r := codec.NewReader(c2)
+		for {
+			pkt, err := r.ReadPacket()
+			if err != nil {
+				close(pkts)
+				return
+			}
+			pkts <- pkt
+		}
+	}()
+
+	ctx := context.Background()
+
+	_, err := e.Sink(WithRequestID(ctx, 42), []string{"upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pkt := <-pkts; pkt.Req != 42 {
+		t.Errorf("expected request id 42, got %d", pkt.Req)
+	}
+
+	_, err = e.Sink(WithRequestID(ctx, 42), []string{"upload"})
+	if err == nil {
+		t.Error("expected error reusing a pending request id")
+	}
+
+	_, err = e.Sink(ctx, []string{"upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pkt := <-pkts; pkt.Req != 43 {
+		t.Errorf("expected allocated request id 43, got %d", pkt.Req)
+	}
+}
+
+func TestMalformedRequest(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Return(ctx, "ok")
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	e := Handle(NewPacker(c1), h)
+
+	serve := make(chan struct{})
+	go func() {
+		err := e.(*rpc).Serve(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		close(serve)
+	}()
+
+	pkts := make(chan *codec.Packet, 4)
+	go func() {
+		r := codec.NewReader(c2)
+		for {
+			pkt, err := r.ReadPacket()
+			if err != nil {
+				close(pkts)
+				return
+			}
+			pkts <- pkt
+		}
+	}()
+
+	w := codec.NewWriter(c2)
+	for _, pkt := range []*codec.Packet{
+		// sink call with broken args, followed by data
+		{Flag: codec.FlagJSON | codec.FlagStream, Req: 1, Body: []byte(`{"name":["upload"],"args":[`)},
+		{Flag: codec.FlagString | codec.FlagStream, Req: 1, Body: []byte("data")},
+		newEndOkayPacket(1),
+		// valid async call
+		{Flag: codec.FlagJSON, Req: 2, Body: []byte(`{"name":["whoami"],"args":[],"type":"async"}`)},
+	} {
+		err := w.WritePacket(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the replies may arrive in any order
+	replies := make(map[int32]*codec.Packet)
+	for i := 0; i < 2; i++ {
+		pkt := <-pkts
+		replies[pkt.Req] = pkt
+	}
+
+	if pkt := replies[-1]; pkt == nil || !pkt.Flag.Get(codec.FlagEndErr) {
+		t.Errorf("expected error reply for request 1, got %+v", pkt)
+	} else if _, err := parseError(pkt.Body); err != nil {
+		t.Errorf("expected call error, got %s: %s", err, pkt.Body)
+	}
+
+	if pkt := replies[-2]; pkt == nil || string(pkt.Body) != "ok" {
+		t.Errorf("expected reply to request 2, got %+v", pkt)
+	}
+
+	e.Terminate()
+	<-serve
+}
+
+func TestMalformedEndPacket(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect})
+	serve := ServeBackground(context.Background(), e.(Server))
+
+	// a peer that ends the first call with a broken error and answers the
+	// second one
+	go func() {
+		r := codec.NewReader(c2)
+		w := codec.NewWriter(c2)
+
+		for _, reply := range []*codec.Packet{
+			{Flag: codec.FlagJSON | codec.FlagEndErr, Body: []byte(`{"name":"TypeError","message":"nope"}`)},
+			{Flag: codec.FlagString, Body: []byte("ok")},
+		} {
+			pkt, err := r.ReadPacket()
+			if err != nil {
+				return
+			}
+
+			reply.Req = -pkt.Req
+			w.WritePacket(reply)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := e.Async(ctx, "string", []string{"broken"})
+	if _, ok := errors.Cause(err).(*CallError); !ok {
+		t.Errorf("expected call error, got %v", err)
+	}
+
+	v, err := e.Async(ctx, "string", []string{"fine"})
+	if err != nil || v != "ok" {
+		t.Errorf("expected session to survive, got %v, %v", v, err)
+	}
+
+	c2.Close()
+	if err := <-serve; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Method[0] == "slow" {
+				// never reply
+				return
+			}
+
+			err := req.Return(ctx, 42)
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	c := NewClient(rpc1,
+		WithCallTimeout(10*time.Millisecond),
+		WithResponseType([]string{"answer"}, 0))
+
+	v, err := c.Async(context.Background(), []string{"answer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != 42 {
+		t.Errorf("expected int 42, got %#v", v)
+	}
+
+	_, err = c.Async(context.Background(), []string{"slow"})
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+
+	if !strings.Contains(err.Error(), "async call slow failed") {
+		t.Errorf("expected error to mention the method, got %q", err)
+	}
+}
+
+func TestDuplexStreamArgs(t *testing.T) {
+	type bigArgs struct {
+		Name string
+		Data []int
+	}
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			var args bigArgs
+			err := req.StreamArgs(ctx, &args)
+			if err != nil {
+				t.Error(err)
+			}
+
+			err = req.Stream.Pour(ctx, fmt.Sprintf("%s:%d", args.Name, len(args.Data)))
+			if err != nil {
+				t.Error(err)
+			}
+
+			req.Stream.Close()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	args := bigArgs{Name: "big", Data: make([]int, 1000)}
+
+	src, sink, err := DuplexWithStreamArgs(ctx, rpc1, "string", []string{"init"}, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	v, err := src.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "big:1000" {
+		t.Errorf("unexpected reply %q", v)
+	}
+}
+
+func TestRequestIDInversion(t *testing.T) {
+	type call struct {
+		id   int32
+		tipe CallType
+	}
+
+	calls := []call{
+		{10, "async"},
+		{11, "source"},
+		{12, "sink"},
+		{13, "duplex"},
+	}
+
+	seen := make(chan call, len(calls))
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			seen <- call{req.pkt.Req, req.Type}
+
+			if req.Type == "async" {
+				err := req.Return(ctx, "ok")
+				if err != nil && errors.Cause(err) != ErrSessionTerminated {
+					t.Error(err)
+				}
+				return
+			}
+
+			req.Stream.Close()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	for _, c := range calls {
+		var err error
+		idCtx := WithRequestID(ctx, c.id)
+
+		switch c.tipe {
+		case "async":
+			_, err = rpc1.Async(idCtx, "string", []string{"call"})
+		case "source":
+			_, err = rpc1.Source(idCtx, "string", []string{"call"})
+		case "sink":
+			_, err = rpc1.Sink(idCtx, []string{"call"})
+		case "duplex":
+			_, _, err = rpc1.Duplex(idCtx, "string", []string{"call"})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := <-seen
+		if got.tipe != c.tipe {
+			t.Errorf("expected type %q, got %q", c.tipe, got.tipe)
+		}
+
+		// the packer negates incoming ids, so the server sees the negative id
+		if got.id != -c.id {
+			t.Errorf("%s: client used id %d, server parsed %d", c.tipe, c.id, got.id)
+		}
+	}
+}
+
+func TestDefaultArgs(t *testing.T) {
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Return(ctx, fmt.Sprint(req.Args...))
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2, WithDefaultArgs([]string{"whoami"}, "scope", "-x"))
+	defer done()
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		method []string
+		args   []interface{}
+		exp    string
+	}{
+		{[]string{"whoami"}, nil, "scope-x"},
+		{[]string{"whoami"}, []interface{}{"mine"}, "mine-x"},
+		{[]string{"whoami"}, []interface{}{"a", "b", "c"}, "abc"},
+		{[]string{"other"}, nil, ""},
+	} {
+		v, err := rpc1.Async(ctx, "string", tc.method, tc.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v != tc.exp {
+			t.Errorf("expected args %q, got %q", tc.exp, v)
+		}
+	}
+}
+
+func TestRemoteClosed(t *testing.T) {
+	h1 := callerHandler(t)
+
+	handled := make(chan struct{})
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			defer close(handled)
+
+			select {
+			case <-req.Stream.(StreamWaiter).RemoteClosed():
+			case <-time.After(time.Second):
+				t.Error("remote close was not signaled")
+			}
+
+			// only the remote's direction is ended, ours is still open
+			err := req.Stream.Pour(ctx, "after")
+			if err != nil {
+				t.Errorf("error pouring after remote end: %s", err)
+			}
+
+			req.Stream.Close()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	_, sink, err := rpc1.Duplex(context.Background(), "string", []string{"half"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-handled
+}
+
+func TestMaxMethodLength(t *testing.T) {
+	mkPkt := func(method []string) *codec.Packet {
+		body, err := json.Marshal(Request{Type: "async", Method: method, Args: []interface{}{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &codec.Packet{Flag: codec.FlagJSON, Req: -1, Body: body}
+	}
+
+	long := make([]string, 100)
+	for i := range long {
+		long[i] = "x"
+	}
+
+	c1, _ := net.Pipe()
+	r := Handle(NewPacker(c1), &testHandler{}).(*rpc)
+
+	_, err := r.ParseRequest(mkPkt([]string{"blobs", "get"}))
+	if err != nil {
+		t.Errorf("unexpected error parsing request: %s", err)
+	}
+
+	_, err = r.ParseRequest(mkPkt(long))
+	if err == nil {
+		t.Error("expected error for oversized method array")
+	}
+
+	_, err = r.ParseRequest(mkPkt([]string{strings.Repeat("x", 2000)}))
+	if err == nil {
+		t.Error("expected error for oversized method name")
+	}
+
+	r = Handle(NewPacker(c1), &testHandler{}, WithMaxMethodLength(0, 0)).(*rpc)
+	_, err = r.ParseRequest(mkPkt(long))
+	if err != nil {
+		t.Errorf("unexpected error with disabled limit: %s", err)
+	}
+
+	// the caller gets the rejection as the reply to its call
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			t.Errorf("unexpected call: %#v", req)
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h, h)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = rpc1.Async(ctx, "string", long)
+	if _, ok := errors.Cause(err).(*CallError); !ok {
+		t.Errorf("expected call error, got %v", err)
+	}
+}
+
+func TestServeDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	errc := ServeBackground(ctx, e.(*rpc))
+
+	select {
+	case err := <-errc:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected deadline error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after the deadline")
+	}
+
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("Serve returned too early, after %v", d)
+	}
+
+	// the session is already closed, this must not fail
+	if err := e.Terminate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancelMethod(t *testing.T) {
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			// stream until cancelled
+			<-req.Stream.(StreamWaiter).RemoteClosed()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, rpc2, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	var srcs []luigi.Source
+	for _, m := range []string{"history", "history", "other"} {
+		src, err := rpc1.Source(ctx, "string", []string{m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, src)
+	}
+
+	for i := 0; i < 3; i++ {
+		nextEvent(t, rpc2, EventCallStart)
+	}
+
+	if n := rpc2.(Shutdowner).CancelMethod([]string{"history"}, errors.New("shedding load")); n != 2 {
+		t.Fatalf("expected 2 cancelled requests, got %d", n)
+	}
+
+	for _, src := range srcs[:2] {
+		_, err := src.Next(ctx)
+		if err == nil || !strings.Contains(err.Error(), "shedding load") {
+			t.Errorf("expected cancellation error, got %v", err)
+		}
+	}
+
+	if n := rpc2.(Shutdowner).CancelMethod([]string{"history"}, errors.New("again")); n != 0 {
+		t.Errorf("expected no more history requests, got %d", n)
+	}
+
+	if n := rpc2.(Shutdowner).CancelMethod([]string{"other"}, errors.New("shedding load")); n != 1 {
+		t.Errorf("expected 1 cancelled request, got %d", n)
+	}
+}
+
+func TestStreamNegotiation(t *testing.T) {
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Type == "async" {
+				req.Return(ctx, "ok")
+				return
+			}
+
+			<-req.Stream.(StreamWaiter).RemoteClosed()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h, h, WithStreamNegotiation(1))
+	defer done()
+
+	if info := rpc1.(ConnInspector).ConnInfo(); !info.StreamNegotiation || info.MaxStreams != 1 {
+		t.Errorf("unexpected conn info %+v", info)
+	}
+
+	// wait for the exchange to finish
+	for i := 0; !rpc1.(ConnInspector).ConnInfo().PeerNegotiated; i++ {
+		if i > 100 {
+			t.Fatal("peer limit was not negotiated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := rpc1.(ConnInspector).ConnInfo().PeerMaxStreams; n != 1 {
+		t.Errorf("expected peer to accept 1 stream, got %d", n)
+	}
+
+	ctx := context.Background()
+	_, err := rpc1.Source(ctx, "string", []string{"first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = rpc1.Source(ctx, "string", []string{"second"})
+	if errors.Cause(err) != ErrStreamLimit {
+		t.Errorf("expected stream limit error, got %v", err)
+	}
+
+	_, err = rpc1.Async(ctx, "string", []string{"whoami"})
+	if err != nil {
+		t.Errorf("async calls should not be limited: %v", err)
+	}
+}
+
+func TestCapabilitiesWithoutNegotiation(t *testing.T) {
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			req.Return(ctx, "handled")
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h, h)
+	defer done()
+
+	// without WithStreamNegotiation the method belongs to the handler
+	v, err := rpc1.Async(context.Background(), "string", capsMethod)
+	if err != nil || v != "handled" {
+		t.Errorf("expected handler to answer, got %v, %v", v, err)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	const n = 2
+
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			<-req.Stream.(StreamWaiter).RemoteClosed()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, rpc2, done := serveTestPair(t, h, h, WithMaxConcurrentRequests(n))
+	defer done()
+
+	ctx := context.Background()
+
+	// requests rpc2 started don't count against its inbound limit
+	for i := 0; i < n; i++ {
+		_, err := rpc2.Source(ctx, "string", []string{"outbound"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		_, err := rpc1.Source(ctx, "string", []string{"inbound"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, err := rpc1.Source(ctx, "string", []string{"one", "too", "many"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = src.Next(ctx)
+	if err == nil || !strings.Contains(err.Error(), "too many requests") {
+		t.Errorf("expected too many requests error, got %v", err)
+	}
+}
+
+func TestDrainClose(t *testing.T) {
+	h1 := callerHandler(t)
+
+	drained := make(chan error, 1)
+	var left BufferStats
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Stream.Pour(ctx, "a")
+			if err != nil {
+				t.Error(err)
+			}
+
+			// wait for the caller's values, so the drain has to read them
+			for i := 0; req.Stream.(StreamFlow).BufferStats().Buffered < 3; i++ {
+				if i > 1000 {
+					t.Error("values did not arrive")
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			err = req.Stream.(StreamWaiter).DrainClose(ctx)
+			left = req.Stream.(StreamFlow).BufferStats()
+			drained <- err
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	src, sink, err := rpc1.Duplex(ctx, "string", []string{"drain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// in flight while the handler ends its side
+	for _, v := range []string{"x", "y", "z"} {
+		err = sink.Pour(ctx, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v, err := src.Next(ctx)
+	if err != nil || v != "a" {
+		t.Fatalf("expected a, got %v, %v", v, err)
+	}
+
+	_, err = src.Next(ctx)
+	if !luigi.IsEOS(errors.Cause(err)) {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+
+	// the handler drains until we end our side as well
+	err = sink.Pour(ctx, "w")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-drained:
+		t.Fatalf("drain finished before we ended our side: %v", err)
+	default:
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("error draining: %+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain did not finish")
+	}
+
+	// the values we sent were read and discarded, not left in the buffer
+	if left.Buffered != 0 {
+		t.Errorf("expected drained stream to be empty, %d packets left", left.Buffered)
+	}
+}
+
+func TestCancelAndWait(t *testing.T) {
+	h1 := callerHandler(t)
+
+	ended := make(chan error, 1)
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Stream.Pour(ctx, "a")
+			if err != nil {
+				t.Error(err)
+			}
+
+			<-req.Stream.(StreamWaiter).RemoteClosed()
+			ended <- req.Stream.Pour(ctx, "b")
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	src, err := rpc1.Source(ctx, "string", []string{"feed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := src.Next(ctx)
+	if err != nil || v != "a" {
+		t.Fatalf("expected a, got %v, %v", v, err)
+	}
+
+	str := src.(Stream)
+	err = str.(StreamWaiter).CancelAndWait(ctx, errors.New("enough"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// we aborted the call, so the handler's side is ended as well
+	if err := <-ended; err != ErrStreamEnded {
+		t.Errorf("expected handler's stream to be ended, got %v", err)
+	}
+
+	// the remote ended already, so this returns right away
+	err = str.(StreamWaiter).CancelAndWait(ctx, nil)
+	if err != nil {
+		t.Errorf("expected no error cancelling again, got %v", err)
+	}
+}
+
+func TestDoDeadline(t *testing.T) {
+	release := make(chan struct{})
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Method[0] == "slow" {
+				<-release
+			}
+			req.Return(ctx, "done")
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+	defer close(release)
+
+	reqs := rpc1.(*rpc).reqs
+
+	v, err := rpc1.Async(context.Background(), "string", []string{"fast"})
+	if err != nil || v != "done" {
+		t.Fatalf("expected reply, got %v, %v", v, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = rpc1.Async(ctx, "string", []string{"slow"})
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+
+	// sending the request may already fail because the packer honors ctx
+	src, err := rpc1.Source(ctx, "string", []string{"slow"})
+	if err == nil {
+		_, err = src.Next(context.Background())
+	}
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("expected deadline error from source, got %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for reqs.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no pending requests, got %d", reqs.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	h1 := callerHandler(t)
+
+	release := make(chan struct{})
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Method[0] == "boom" {
+				panic("boom")
+			}
+
+			<-release
+			req.Return(ctx, "fine")
+		},
+		connect: noopConnect,
+	}
+
+	logged := make(chan []interface{}, 1)
+	logger := log.LoggerFunc(func(kv ...interface{}) error {
+		if kv[1] == "handler panicked" {
+			logged <- kv
+		}
+		return nil
+	})
+
+	rpc1, _, done := serveTestPair(t, h1, h2, WithLogger(logger), WithPanicStackTraces())
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// a call that is pending while the other handler panics
+	fine := make(chan interface{}, 1)
+	go func() {
+		v, err := rpc1.Async(ctx, "string", []string{"fine"})
+		if err != nil {
+			t.Error(err)
+		}
+		fine <- v
+	}()
+
+	_, err := rpc1.Async(ctx, "string", []string{"boom"})
+	callErr, ok := errors.Cause(err).(*CallError)
+	if !ok {
+		t.Fatalf("expected call error, got %v", err)
+	}
+	if callErr.Message != "handler panicked: boom" || !strings.Contains(callErr.Stack, "TestHandlerPanic") {
+		t.Errorf("unexpected call error %#v", callErr)
+	}
+
+	select {
+	case kv := <-logged:
+		if fmt.Sprint(kv[:2]) != "[event handler panicked]" {
+			t.Errorf("unexpected log message %v", kv)
+		}
+	default:
+		t.Error("expected panic to be logged")
+	}
+
+	close(release)
+	if v := <-fine; v != "fine" {
+		t.Errorf("expected concurrent call to succeed, got %v", v)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	var (
+		l      sync.Mutex
+		events []interface{}
+	)
+	logger := log.LoggerFunc(func(kv ...interface{}) error {
+		l.Lock()
+		defer l.Unlock()
+		events = append(events, kv[1])
+		return nil
+	})
+
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect}, WithLogger(logger))
+	serve := ServeBackground(context.Background(), e.(Server))
+
+	// a request without the JSON flag is malformed
+	err := codec.NewWriter(c2).WritePacket(&codec.Packet{Flag: codec.FlagString, Req: 1, Body: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Close()
+
+	select {
+	case err := <-serve:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	expected := []interface{}{"packet dropped", "serve done"}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("expected log events %v, got %v", expected, events)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	// a peer that reads everything but never answers
+	go func() {
+		r := codec.NewReader(c2)
+		for {
+			_, err := r.ReadPacket()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect},
+		WithStreamNegotiation(0), WithHandshakeTimeout(20*time.Millisecond))
+
+	select {
+	case err := <-ServeBackground(context.Background(), e.(Server)):
+		if errors.Cause(err) != ErrHandshakeTimeout {
+			t.Errorf("expected handshake timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session was not terminated")
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	h1 := callerHandler(t)
+
+	seqs := make(chan [2]uint32, 3)
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			defer close(seqs)
+
+			for {
+				_, err := req.Stream.Next(ctx)
+				if err != nil {
+					break
+				}
+
+				err = req.Stream.Pour(ctx, "ack")
+				if err != nil {
+					t.Error(err)
+				}
+
+				rx, tx := req.Stream.(StreamSeq).Seq()
+				seqs <- [2]uint32{rx, tx}
+			}
+			req.Stream.Close()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2, WithSequenceNumbers())
+	defer done()
+
+	ctx := context.Background()
+	src, sink, err := rpc1.Duplex(ctx, "string", []string{"echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = sink.Pour(ctx, "ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = src.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	var i uint32
+	for seq := range seqs {
+		i++
+		if seq != [2]uint32{i, i} {
+			t.Errorf("expected sequence numbers %d, got %v", i, seq)
+		}
+	}
+
+	if i != 3 {
+		t.Errorf("expected 3 packets, got %d", i)
+	}
+}
+
+func TestRequestWithoutJSONFlag(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Return(ctx, "ok")
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	e := Handle(NewPacker(c1), h)
+	errc := ServeBackground(context.Background(), e.(Server))
+
+	pkts := make(chan *codec.Packet, 4)
+	go func() {
+		r := codec.NewReader(c2)
+		for {
+			pkt, err := r.ReadPacket()
+			if err != nil {
+				close(pkts)
+				return
+			}
+			pkts <- pkt
+		}
+	}()
+
+	w := codec.NewWriter(c2)
+	for _, pkt := range []*codec.Packet{
+		// stream opened with a string packet, followed by data
+		{Flag: codec.FlagString | codec.FlagStream, Req: 1, Body: []byte("upload")},
+		{Flag: codec.FlagString | codec.FlagStream, Req: 1, Body: []byte("data")},
+		newEndOkayPacket(1),
+		// valid async call
+		{Flag: codec.FlagJSON, Req: 2, Body: []byte(`{"name":["whoami"],"args":[],"type":"async"}`)},
+	} {
+		err := w.WritePacket(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case pkt := <-pkts:
+		if pkt.Req != -2 || string(pkt.Body) != "ok" {
+			t.Errorf("expected reply to request 2, got %+v", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reply to valid request")
+	}
+
+	// the end packet of the reply
+	<-pkts
+
+	select {
+	case pkt := <-pkts:
+		t.Errorf("unexpected packet %+v", pkt)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	e.Terminate()
+	if err := <-errc; err != nil {
+		t.Errorf("session failed: %+v", err)
+	}
+}
+
+func TestCallTiming(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	// every reading of the clock advances it by a second
+	var (
+		clockLock sync.Mutex
+		clock     = time.Unix(0, 0)
+	)
+	now := func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	rpc1 := Handle(NewPacker(c1), &testHandler{connect: noopConnect}, WithClock(now), WithCallTiming())
+	rpc2 := Handle(NewPacker(c2), &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			req.Return(ctx, "ok")
+		},
+		connect: noopConnect,
+	})
+
+	ctx := context.Background()
+	errc1 := ServeBackground(ctx, rpc1.(Server))
+	errc2 := ServeBackground(ctx, rpc2.(Server))
+
+	_, meta, err := rpc1.(AsyncCaller).AsyncWithMeta(ctx, "string", []string{"whoami"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Timing == nil {
+		t.Fatal("expected timing to be set")
+	}
+
+	// events read the clock as well, concurrently, so only whole seconds
+	// and the order are known. The reply may arrive before Do returns, so
+	// the order of the first two is not known, but both happen before the
+	// call is done.
+	timing := *meta.Timing
+	for _, d := range []time.Duration{timing.Sent, timing.FirstByte, timing.Done} {
+		if d <= 0 || d%time.Second != 0 {
+			t.Errorf("unexpected timing %+v", timing)
+		}
+	}
+	if timing.Sent >= timing.Done || timing.FirstByte >= timing.Done {
+		t.Errorf("unexpected timing %+v", timing)
+	}
+
+	if up := rpc1.(SessionLifetime).Uptime(); up <= timing.Done || up%time.Second != 0 {
+		t.Errorf("expected uptime to use the clock, got %v", up)
+	}
+
+	rpc1.Terminate()
+	rpc2.Terminate()
+	<-errc1
+	<-errc2
+}
+
+// TestEndRace ends many calls while their end packets arrive, by cancelling
+// their context and the method concurrently. Run it with -race.
+func TestEndRace(t *testing.T) {
+	const n = 100
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			req.Return(ctx, "ok")
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	stop := make(chan struct{})
+	cancelled := make(chan struct{})
+	go func() {
+		defer close(cancelled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				rpc1.(Shutdowner).CancelMethod([]string{"race"}, errors.New("cancelled"))
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			rpc1.Async(ctx, "string", []string{"race"})
+			cancel()
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-cancelled
+
+	// the session survived
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := rpc1.Async(ctx, "string", []string{"after"})
+	if err != nil || v != "ok" {
+		t.Fatalf("expected session to survive, got %v, %v", v, err)
+	}
+
+	reqs := rpc1.(*rpc).reqs
+	deadline := time.Now().Add(time.Second)
+	for reqs.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no pending requests, got %d", reqs.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequestIDWraparound(t *testing.T) {
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			req.Return(ctx, "ok")
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	// pretend the session is old and id 1 is still in use
+	r1 := rpc1.(*rpc)
+	r1.rLock.Lock()
+	r1.highest = math.MaxInt32 - 1
+	src, sink := luigi.NewPipe()
+	r1.reqs.Add(1, &Request{
+		Type:   "async",
+		Method: []string{"old"},
+		Stream: NewStream(src, r1.pkr, 1, false, false),
+		in:     sink,
+	})
+	r1.rLock.Unlock()
+
+	ctx := context.Background()
+	var ids []int32
+	for i := 0; i < 3; i++ {
+		v, err := rpc1.Async(ctx, "string", []string{"whoami"})
+		if err != nil || v != "ok" {
+			t.Fatalf("call %d: got %v, %v", i, v, err)
+		}
+
+		ids = append(ids, nextEvent(t, rpc1, EventCallStart).Req)
+	}
+
+	exp := []int32{math.MaxInt32, 2, 3}
+	if fmt.Sprint(ids) != fmt.Sprint(exp) {
+		t.Errorf("expected ids %v, got %v", exp, ids)
+	}
+}
+
+func TestTerminateGracefully(t *testing.T) {
+	const n = 5
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			if req.Method[0] == "hang" {
+				<-ctx.Done()
+				return
+			}
+			if req.Type == "async" {
+				req.Return(ctx, "ok")
+				return
+			}
+
+			for i := 0; i < n; i++ {
+				time.Sleep(5 * time.Millisecond)
+				err := req.Stream.Pour(ctx, fmt.Sprint(i))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			req.Stream.Close()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, rpc2, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	src, err := rpc1.Source(ctx, "string", []string{"feed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = src.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	terminated := make(chan error, 1)
+	go func() {
+		terminated <- rpc2.(Shutdowner).TerminateGracefully(ctx)
+	}()
+
+	// wait until new calls are rejected
+	for {
+		_, err := rpc1.Async(ctx, "string", []string{"late"})
+		if err != nil {
+			if !strings.Contains(err.Error(), ErrShuttingDown.Error()) {
+				t.Fatalf("expected shutting down error, got %v", err)
+			}
+			break
+		}
+	}
+
+	var count int
+	for {
+		_, err := src.Next(ctx)
+		if luigi.IsEOS(errors.Cause(err)) {
+			break
+		} else if err != nil {
+			t.Fatalf("expected clean end of stream, got %v", err)
+		}
+		count++
+	}
+	if count != n-1 {
+		t.Errorf("expected %d more values, got %d", n-1, count)
+	}
+
+	if err := <-terminated; err != nil {
+		t.Errorf("expected graceful termination, got %v", err)
+	}
+
+	// requests that don't finish in time
+	rpc1, rpc2, done2 := serveTestPair(t, h1, h2)
+	defer done2()
+
+	_, err = rpc1.Source(ctx, "string", []string{"hang"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rpc2.(*rpc).reqs.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	tctx, tcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer tcancel()
+	if err := rpc2.(Shutdowner).TerminateGracefully(tctx); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+}
+
+func TestDone(t *testing.T) {
+	h := &testHandler{connect: noopConnect}
+
+	rpc1, rpc2, done := serveTestPair(t, h, h)
+	defer done()
+
+	select {
+	case <-rpc1.(SessionLifetime).Done():
+		t.Fatal("expected session to be running")
+	default:
+	}
+
+	// terminate concurrently with the read error it causes
+	go rpc1.Terminate()
+	rpc1.Terminate()
+
+	for _, e := range []Endpoint{rpc1, rpc2} {
+		select {
+		case <-e.(SessionLifetime).Done():
+		case <-time.After(time.Second):
+			t.Fatal("expected session to be done")
+		}
+		if err := e.(SessionLifetime).Err(); err != nil {
+			t.Errorf("expected clean end, got %v", err)
+		}
+	}
+
+	// never served
+	c1, _ := net.Pipe()
+	e := Handle(NewPacker(c1), h)
+	e.Terminate()
+	<-e.(SessionLifetime).Done()
+
+	// broken connection
+	c1, c2 := net.Pipe()
+	e = Handle(NewPacker(c1), h)
+	go e.(*rpc).Serve(context.Background())
+	// half a header
+	c2.Write([]byte{0, 1, 2})
+	c2.Close()
+
+	select {
+	case <-e.(SessionLifetime).Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected session to be done")
+	}
+	if e.(SessionLifetime).Err() == nil {
+		t.Error("expected error for broken connection")
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	const n = 200
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			switch req.Type {
+			case "async":
+				err := req.Return(ctx, req.Method[0])
+				if err != nil && errors.Cause(err) != ErrSessionTerminated {
+					t.Error(err)
+				}
+			case "source":
+				for i := 0; i < 3; i++ {
+					err := req.Stream.Pour(ctx, req.Method[0])
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				req.Stream.Close()
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			method := fmt.Sprint("call", i)
+			if i%2 == 0 {
+				v, err := rpc1.Async(ctx, "string", []string{method})
+				if err != nil || v != method {
+					t.Errorf("async %d: got %v, %v", i, v, err)
+				}
+				return
+			}
+
+			src, err := rpc1.Source(ctx, "string", []string{method})
+			if err != nil {
+				t.Errorf("source %d: %v", i, err)
+				return
+			}
+
+			var count int
+			for {
+				v, err := src.Next(ctx)
+				if luigi.IsEOS(errors.Cause(err)) {
+					break
+				} else if err != nil {
+					t.Errorf("source %d: %v", i, err)
+					return
+				}
+
+				if v != method {
+					t.Errorf("source %d: got reply for %v", i, v)
+				}
+				count++
+			}
+
+			if count != 3 {
+				t.Errorf("source %d: expected 3 values, got %d", i, count)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestAsyncInto(t *testing.T) {
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			var err error
+			switch req.Method[0] {
+			case "whoami":
+				err = req.Return(ctx, map[string]interface{}{"id": "@foo", "seq": 3})
+			case "name":
+				err = req.Return(ctx, "foo")
+			default:
+				err = req.Stream.CloseWithError(errors.New("no such method"))
+			}
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+
+	var whoami struct {
+		ID  string `json:"id"`
+		Seq int    `json:"seq"`
+	}
+	err := rpc1.(AsyncCaller).AsyncInto(ctx, &whoami, []string{"whoami"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whoami.ID != "@foo" || whoami.Seq != 3 {
+		t.Errorf("unexpected reply %+v", whoami)
+	}
+
+	var name string
+	err = rpc1.(AsyncCaller).AsyncInto(ctx, &name, []string{"name"})
+	if err != nil || name != "foo" {
+		t.Errorf("expected string reply, got %q, %v", name, err)
+	}
+
+	err = rpc1.(AsyncCaller).AsyncInto(ctx, &name, []string{"fail"})
+	if callErr, ok := err.(*CallError); !ok || callErr.Message != "no such method" {
+		t.Errorf("expected call error, got %#v", err)
+	}
+
+	err = rpc1.(AsyncCaller).AsyncInto(ctx, whoami, []string{"whoami"})
+	if err == nil {
+		t.Error("expected error for non-pointer destination")
+	}
+}
+
+func TestAsyncBytes(t *testing.T) {
+	blob := []byte{0, 1, 2, 0xff, 'a'}
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			var err error
+			switch req.Method[1] {
+			case "get":
+				err = req.Return(ctx, codec.Body(blob))
+			case "meta":
+				err = req.Return(ctx, map[string]int{"size": len(blob)})
+			default:
+				err = req.CloseWithError(errors.New("no such blob"))
+			}
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+
+	data, err := rpc1.(AsyncCaller).AsyncBytes(ctx, []string{"blobs", "get"}, "&abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Errorf("expected %x, got %x", blob, data)
+	}
+
+	data, err = rpc1.(AsyncCaller).AsyncBytes(ctx, []string{"blobs", "meta"}, "&abc")
+	if err != nil || string(data) != `{"size":5}` {
+		t.Errorf("expected raw JSON, got %q, %v", data, err)
+	}
+
+	_, err = rpc1.(AsyncCaller).AsyncBytes(ctx, []string{"blobs", "missing"}, "&abc")
+	if callErr, ok := err.(*CallError); !ok || callErr.Message != "no such blob" {
+		t.Errorf("expected call error, got %#v", err)
+	}
+}
+
+func TestSinkAbort(t *testing.T) {
+	h1 := callerHandler(t)
+
+	received := make(chan error, 1)
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			v, err := req.Stream.Next(ctx)
+			if err != nil || v != "a" {
+				t.Errorf("expected a, got %v, %v", v, err)
+			}
+
+			_, err = req.Stream.Next(ctx)
+			received <- err
+			req.Stream.Close()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, _, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	sink, err := rpc1.Sink(ctx, []string{"upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sink.Pour(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sink.(luigi.ErrorCloser).CloseWithError(errors.New("disk full"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-received:
+		callErr, ok := errors.Cause(err).(*CallError)
+		if !ok || callErr.Message != "disk full" {
+			t.Errorf("expected call error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler did not see the abort")
+	}
+
+	if err := sink.Pour(ctx, "b"); err != ErrStreamEnded {
+		t.Errorf("expected pouring after abort to fail, got %v", err)
+	}
+}
+
+func TestCallBuffer(t *testing.T) {
+	ctx := context.Background()
+	pkr, _ := NewLoopbackPackers()
+
+	sess := Handle(pkr, &testHandler{connect: noopConnect}, WithBufferSize(0)).(*rpc)
+	if sess.bufSize != defaultBufSize {
+		t.Errorf("expected default buffer size, got %d", sess.bufSize)
+	}
+
+	sess = Handle(pkr, &testHandler{connect: noopConnect}, WithBufferSize(16)).(*rpc)
+	if sess.bufSize != 16 {
+		t.Errorf("expected session buffer size 16, got %d", sess.bufSize)
+	}
+
+	h1 := callerHandler(t)
+
+	release := make(chan struct{})
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			for i := 0; i < 20; i++ {
+				err := req.Stream.Pour(ctx, fmt.Sprint(i))
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			<-release
+			req.Stream.Close()
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, rpc2, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	// the default buffer would overflow before we start reading
+	req := &Request{Type: Source, Method: []string{"bulk"}, BufferSize: 32}
+	err := rpc1.Do(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := req.Stream
+
+	nextEvent(t, rpc2, EventCallStart)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 20; i++ {
+		v, err := src.Next(ctx)
+		if err != nil || v != fmt.Sprint(i) {
+			t.Fatalf("expected %d, got %v, %v", i, v, err)
+		}
+	}
+}
+
+func BenchmarkSourceBufferSize(b *testing.B) {
+	for _, n := range []int{1, 5, 25, 100} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			h1 := &testHandler{connect: noopConnect}
+			h2 := &testHandler{
+				call: func(ctx context.Context, req *Request) {
+					for i := 0; i < b.N; i++ {
+						err := req.Stream.Pour(ctx, "ok")
+						if err != nil {
+							b.Error(err)
+							return
+						}
+					}
+					req.Stream.Close()
+				},
+				connect: noopConnect,
+			}
+
+			rpc1, _, done := serveTestPair(b, h1, h2, WithBufferSize(n))
+			defer done()
+
+			ctx := context.Background()
+			b.ResetTimer()
+
+			src, err := rpc1.Source(ctx, "string", []string{"bench"})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for {
+				_, err := src.Next(ctx)
+				if luigi.IsEOS(err) {
+					break
+				} else if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ServeBackground runs s.Serve(ctx) in a new goroutine. The returned channel
+// receives exactly one value, the result of Serve, and is closed afterwards.
+// If Serve panics, the panic is recovered and delivered as an error.
+func ServeBackground(ctx context.Context, s Server) <-chan error {
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+
+		errc <- serveRecover(ctx, s)
+	}()
+
+	return errc
+}
+
+func serveRecover(ctx context.Context, s Server) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = errors.Errorf("muxrpc: panic in Serve: %v", v)
+		}
+	}()
+
+	return s.Serve(ctx)
+}
+
+// ServeReason tells why Serve returned.
+type ServeReason int
+
+const (
+	// ServePeerClosed means the peer closed the connection.
+	ServePeerClosed ServeReason = iota
+
+	// ServeTerminated means the session was ended locally using Terminate
+	// or Goodbye.
+	ServeTerminated
+
+	// ServeContextDone means the context passed to Serve was cancelled or
+	// its deadline passed.
+	ServeContextDone
+
+	// ServeError means the session failed, e.g. because the connection broke
+	// or the peer sent garbage. The error is in ServeResult.Err.
+	ServeError
+
+	// ServeIdleTimeout means the peer stopped answering keepalive pings.
+	// ServeResult.Err is ErrKeepaliveTimeout.
+	ServeIdleTimeout
+)
+
+func (r ServeReason) String() string {
+	switch r {
+	case ServePeerClosed:
+		return "peer closed"
+	case ServeTerminated:
+		return "terminated"
+	case ServeContextDone:
+		return "context done"
+	case ServeError:
+		return "error"
+	case ServeIdleTimeout:
+		return "idle timeout"
+	default:
+		return fmt.Sprintf("ServeReason(%d)", int(r))
+	}
+}
+
+// ServeResult summarizes a session after Serve returned.
+type ServeResult struct {
+	// Reason tells why Serve returned.
+	Reason ServeReason
+
+	// Err is what Serve returned.
+	Err error
+
+	// Inbound and Outbound count the requests started by the peer and by
+	// us during the session.
+	Inbound, Outbound uint64
+
+	// Duration is how long Serve ran.
+	Duration time.Duration
+}
+
+// String returns a one-line summary suitable for logging.
+func (res ServeResult) String() string {
+	s := fmt.Sprintf("%s after %s, %d inbound and %d outbound requests", res.Reason, res.Duration, res.Inbound, res.Outbound)
+	if res.Err != nil {
+		s += ": " + res.Err.Error()
+	}
+
+	return s
+}
+
+// ServeWithResult is like Serve but tells why it returned.
+func (r *rpc) ServeWithResult(ctx context.Context) ServeResult {
+	start := r.now()
+	err := r.Serve(ctx)
+
+	res := ServeResult{
+		Err:      err,
+		Inbound:  atomic.LoadUint64(&r.inbound),
+		Outbound: atomic.LoadUint64(&r.outbound),
+		Duration: r.now().Sub(start),
+	}
+
+	r.tLock.Lock()
+	terminated := r.terminated
+	r.tLock.Unlock()
+
+	switch {
+	case err != nil && ctx.Err() != nil && errors.Cause(err) == ctx.Err():
+		res.Reason = ServeContextDone
+	case errors.Cause(err) == ErrKeepaliveTimeout:
+		res.Reason = ServeIdleTimeout
+	case err != nil:
+		res.Reason = ServeError
+	case terminated:
+		res.Reason = ServeTerminated
+	default:
+		res.Reason = ServePeerClosed
+	}
+
+	return res
+}
@@ -0,0 +1,114 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type serverFunc func(context.Context) error
+
+func (f serverFunc) Serve(ctx context.Context) error { return f(ctx) }
+
+func TestServeBackground(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	testErr := errors.New("test")
+	errc := ServeBackground(ctx, serverFunc(func(context.Context) error { return testErr }))
+	r.Equal(testErr, <-errc)
+	_, ok := <-errc
+	r.False(ok, "expected channel to be closed")
+
+	errc = ServeBackground(ctx, serverFunc(func(context.Context) error { panic("boom") }))
+	err := <-errc
+	r.Error(err)
+	r.Contains(err.Error(), "boom")
+	_, ok = <-errc
+	r.False(ok, "expected channel to be closed")
+
+	errc = ServeBackground(ctx, serverFunc(func(context.Context) error { return nil }))
+	err, ok = <-errc
+	r.True(ok, "expected a value even if Serve succeeded")
+	r.NoError(err)
+}
+
+func TestServeWithResult(t *testing.T) {
+	r := require.New(t)
+
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			req.Return(ctx, "hi")
+		},
+		connect: noopConnect,
+	}
+
+	c1, c2 := net.Pipe()
+	rpc1 := Handle(NewPacker(c1), h)
+	rpc2 := Handle(NewPacker(c2), h)
+
+	ctx := context.Background()
+	res1, res2 := make(chan ServeResult, 1), make(chan ServeResult, 1)
+	go func() { res1 <- rpc1.(ResultServer).ServeWithResult(ctx) }()
+	go func() { res2 <- rpc2.(ResultServer).ServeWithResult(ctx) }()
+
+	v, err := rpc1.Async(ctx, "string", []string{"hello"})
+	r.NoError(err)
+	r.Equal("hi", v)
+
+	r.NoError(rpc2.Terminate())
+
+	res := <-res2
+	r.Equal(ServeTerminated, res.Reason, "unexpected result %s", res)
+	r.Equal(uint64(1), res.Inbound)
+	r.Equal(uint64(0), res.Outbound)
+
+	res = <-res1
+	r.Equal(ServePeerClosed, res.Reason, "unexpected result %s", res)
+	r.Equal(uint64(0), res.Inbound)
+	r.Equal(uint64(1), res.Outbound)
+	r.NoError(res.Err)
+
+	// cancelled context
+	c1, c2 = net.Pipe()
+	defer c2.Close()
+	rpc1 = Handle(NewPacker(c1), h)
+
+	cctx, cancel := context.WithCancel(ctx)
+	go cancel()
+	res = rpc1.(ResultServer).ServeWithResult(cctx)
+	r.Equal(ServeContextDone, res.Reason, "unexpected result %s", res)
+	r.Equal(context.Canceled, res.Err)
+	r.Contains(res.String(), "context done after")
+}
+
+func TestServeWithResultIdleTimeout(t *testing.T) {
+	r := require.New(t)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// a peer that reads everything but never answers
+	go func() {
+		rd := codec.NewReader(c2)
+		for {
+			if _, err := rd.ReadPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	e := Handle(NewPacker(c1), &testHandler{connect: noopConnect},
+		WithKeepalive(10*time.Millisecond, 20*time.Millisecond))
+
+	res := e.(ResultServer).ServeWithResult(context.Background())
+	r.Equal(ServeIdleTimeout, res.Reason, "unexpected result %s", res)
+	r.Equal(ErrKeepaliveTimeout, errors.Cause(res.Err))
+	r.Contains(res.String(), "idle timeout after")
+}
@@ -0,0 +1,293 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// ErrServerClosed is returned by SessionServer.Serve after Shutdown was called.
+var ErrServerClosed = errors.New("muxrpc: server closed")
+
+// ErrTooManySessions is returned by SessionServer.ServeConn if the maximum
+// number of sessions set using WithMaxSessions is reached.
+var ErrTooManySessions = errors.New("muxrpc: too many sessions")
+
+// ErrAcceptRate is returned by SessionServer.ServeConn if the peer connects
+// more often than allowed using WithAcceptRate.
+var ErrAcceptRate = errors.New("muxrpc: accept rate exceeded")
+
+// Acceptor is a listener-like source of connections.
+type Acceptor interface {
+	// Accept waits for and returns the next connection.
+	Accept() (io.ReadWriteCloser, error)
+
+	// Close makes blocked and future calls of Accept fail.
+	Close() error
+}
+
+// NetAcceptor returns an Acceptor that accepts the connections of l.
+func NetAcceptor(l net.Listener) Acceptor {
+	return netAcceptor{l}
+}
+
+type netAcceptor struct {
+	l net.Listener
+}
+
+func (a netAcceptor) Accept() (io.ReadWriteCloser, error) {
+	return a.l.Accept()
+}
+
+func (a netAcceptor) Close() error {
+	return a.l.Close()
+}
+
+// SessionServer accepts connections from one or more Acceptors, e.g. a TCP
+// and a WebSocket listener, and serves an RPC session with the same handler
+// and configuration on each of them.
+type SessionServer struct {
+	handler    Handler
+	handleOpts []HandleOption
+	packerOpts []PackerOption
+	logger     log.Logger
+
+	// maxSessions caps the number of concurrent sessions if non-zero.
+	// acceptInterval is the minimum time between two connections from the
+	// same host.
+	maxSessions    int
+	acceptInterval time.Duration
+
+	l         sync.Mutex
+	closed    bool
+	acceptors map[Acceptor]struct{}
+	sessions  map[Endpoint]struct{}
+	wg        sync.WaitGroup
+
+	// lastAccept holds when a connection from a host was last accepted, if
+	// the accept rate is limited. Guarded by l.
+	lastAccept map[string]time.Time
+}
+
+// ServerOption configures a SessionServer.
+type ServerOption func(*SessionServer)
+
+// WithHandleOptions sets the options passed to Handle for every session.
+func WithHandleOptions(opts ...HandleOption) ServerOption {
+	return func(s *SessionServer) {
+		s.handleOpts = opts
+	}
+}
+
+// WithPackerOptions sets the options passed to NewPacker for every connection.
+func WithPackerOptions(opts ...PackerOption) ServerOption {
+	return func(s *SessionServer) {
+		s.packerOpts = opts
+	}
+}
+
+// WithServerLogger sets the logger errors of sessions are logged to.
+func WithServerLogger(l log.Logger) ServerOption {
+	return func(s *SessionServer) {
+		s.logger = l
+	}
+}
+
+// WithMaxSessions limits the number of concurrent sessions to n. Connections
+// accepted beyond that are closed right away.
+func WithMaxSessions(n int) ServerOption {
+	return func(s *SessionServer) {
+		s.maxSessions = n
+	}
+}
+
+// WithAcceptRate limits how many connections are accepted per second from
+// each remote host, so a single peer can't crowd out the others. Connections
+// over the limit are closed right away. Connections without a remote
+// address, like pipes, are not limited.
+func WithAcceptRate(perSecond int) ServerOption {
+	return func(s *SessionServer) {
+		if perSecond > 0 {
+			s.acceptInterval = time.Second / time.Duration(perSecond)
+		}
+	}
+}
+
+// NewSessionServer returns a SessionServer that handles calls using h.
+func NewSessionServer(h Handler, opts ...ServerOption) *SessionServer {
+	s := &SessionServer{
+		handler:    h,
+		logger:     log.NewNopLogger(),
+		acceptors:  make(map[Acceptor]struct{}),
+		sessions:   make(map[Endpoint]struct{}),
+		lastAccept: make(map[string]time.Time),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Serve accepts connections from a and serves a session on each of them
+// until accepting fails. It can be called concurrently for several
+// Acceptors. After Shutdown it returns ErrServerClosed.
+//
+// Connections beyond the limits set using WithMaxSessions and WithAcceptRate
+// are closed.
+func (s *SessionServer) Serve(ctx context.Context, a Acceptor) error {
+	s.l.Lock()
+	if s.closed {
+		s.l.Unlock()
+		return ErrServerClosed
+	}
+	s.acceptors[a] = struct{}{}
+	s.l.Unlock()
+
+	defer func() {
+		s.l.Lock()
+		delete(s.acceptors, a)
+		s.l.Unlock()
+	}()
+
+	for {
+		conn, err := a.Accept()
+		if err != nil {
+			s.l.Lock()
+			closed := s.closed
+			s.l.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+
+			return errors.Wrap(err, "error accepting connection")
+		}
+
+		err = s.ServeConn(ctx, conn)
+		if err == ErrTooManySessions || err == ErrAcceptRate {
+			s.logger.Log("event", "connection rejected", "error", err)
+			conn.Close()
+		} else if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+}
+
+// ServeConn starts serving a session on conn in a new goroutine.
+func (s *SessionServer) ServeConn(ctx context.Context, conn io.ReadWriteCloser) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	if s.maxSessions > 0 && len(s.sessions) >= s.maxSessions {
+		return ErrTooManySessions
+	}
+
+	if !s.allowAccept(conn) {
+		return ErrAcceptRate
+	}
+
+	e := Handle(NewPacker(conn, s.packerOpts...), s.handler, s.handleOpts...)
+	s.sessions[e] = struct{}{}
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		err := e.(Server).Serve(ctx)
+		if err != nil {
+			s.logger.Log("event", "session ended", "error", err)
+		}
+
+		s.l.Lock()
+		delete(s.sessions, e)
+		s.l.Unlock()
+	}()
+
+	return nil
+}
+
+// allowAccept reports whether conn may be served under the accept rate limit
+// and records the accept. Must be called with s.l held.
+func (s *SessionServer) allowAccept(conn io.ReadWriteCloser) bool {
+	if s.acceptInterval <= 0 {
+		return true
+	}
+
+	ra, ok := conn.(remoteAddrer)
+	if !ok || ra.RemoteAddr() == nil {
+		return true
+	}
+
+	host := ra.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	now := time.Now()
+	if last, ok := s.lastAccept[host]; ok && now.Sub(last) < s.acceptInterval {
+		return false
+	}
+	s.lastAccept[host] = now
+
+	// forget hosts that may connect again anyway, so the map doesn't grow
+	if len(s.lastAccept) > maxTrackedHosts {
+		for h, last := range s.lastAccept {
+			if now.Sub(last) >= s.acceptInterval {
+				delete(s.lastAccept, h)
+			}
+		}
+	}
+
+	return true
+}
+
+// maxTrackedHosts is the number of hosts the accept rate limit tracks before
+// it forgets those whose interval has passed.
+const maxTrackedHosts = 1024
+
+// Sessions returns the number of active sessions.
+func (s *SessionServer) Sessions() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return len(s.sessions)
+}
+
+// Shutdown stops accepting connections, terminates all sessions and waits
+// until they ended or ctx is done.
+func (s *SessionServer) Shutdown(ctx context.Context) error {
+	s.l.Lock()
+	s.closed = true
+	for a := range s.acceptors {
+		a.Close()
+	}
+	for e := range s.sessions {
+		e.Terminate()
+	}
+	s.l.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "error waiting for sessions to end")
+	}
+}
@@ -0,0 +1,164 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// chanAcceptor is an Acceptor for connections sent on a channel.
+type chanAcceptor struct {
+	conns  chan io.ReadWriteCloser
+	closed chan struct{}
+}
+
+func newChanAcceptor() *chanAcceptor {
+	return &chanAcceptor{
+		conns:  make(chan io.ReadWriteCloser),
+		closed: make(chan struct{}),
+	}
+}
+
+func (a *chanAcceptor) Accept() (io.ReadWriteCloser, error) {
+	select {
+	case conn := <-a.conns:
+		return conn, nil
+	case <-a.closed:
+		return nil, errors.New("acceptor closed")
+	}
+}
+
+func (a *chanAcceptor) Close() error {
+	close(a.closed)
+	return nil
+}
+
+func TestSessionServer(t *testing.T) {
+	r := require.New(t)
+
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			err := req.Return(ctx, "hello")
+			if err != nil && errors.Cause(err) != ErrSessionTerminated {
+				t.Error(err)
+			}
+		},
+		connect: noopConnect,
+	}
+
+	srv := NewSessionServer(h)
+	ctx := context.Background()
+
+	// two transports
+	tcp, ws := newChanAcceptor(), newChanAcceptor()
+	served := make(chan error, 2)
+	for _, a := range []Acceptor{tcp, ws} {
+		go func(a Acceptor) { served <- srv.Serve(ctx, a) }(a)
+	}
+
+	var clients []Endpoint
+	for _, a := range []*chanAcceptor{tcp, ws} {
+		c1, c2 := net.Pipe()
+		a.conns <- c1
+
+		client := Handle(NewPacker(c2), &testHandler{connect: noopConnect})
+		go client.(Server).Serve(ctx)
+		clients = append(clients, client)
+
+		v, err := client.Async(ctx, "string", []string{"hello"})
+		r.NoError(err)
+		r.Equal("hello", v)
+	}
+
+	r.Equal(2, srv.Sessions())
+
+	sctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	r.NoError(srv.Shutdown(sctx))
+	r.Equal(0, srv.Sessions())
+
+	for i := 0; i < 2; i++ {
+		r.Equal(ErrServerClosed, <-served)
+	}
+
+	for _, client := range clients {
+		_, err := client.Async(ctx, "string", []string{"hello"})
+		r.Error(err, "expected call on terminated session to fail")
+	}
+}
+
+func TestSessionServerLimits(t *testing.T) {
+	r := require.New(t)
+
+	srv := NewSessionServer(&testHandler{connect: noopConnect}, WithMaxSessions(1))
+	ctx := context.Background()
+
+	a := newChanAcceptor()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, a) }()
+
+	var peers []net.Conn
+	for i := 0; i < 3; i++ {
+		c1, c2 := net.Pipe()
+		a.conns <- c1
+		peers = append(peers, c2)
+	}
+
+	r.Equal(1, srv.Sessions())
+
+	// the connections over the limit were closed
+	for _, c := range peers[1:] {
+		_, err := c.Read(make([]byte, 1))
+		r.Error(err)
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	r.NoError(srv.Shutdown(sctx))
+	r.Equal(ErrServerClosed, <-served)
+}
+
+// hostConn is a connection that claims to come from addr.
+type hostConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c hostConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestSessionServerAcceptRate(t *testing.T) {
+	r := require.New(t)
+
+	srv := NewSessionServer(&testHandler{connect: noopConnect}, WithAcceptRate(1))
+	ctx := context.Background()
+
+	dial := func(ip string, port int) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+		return c2, srv.ServeConn(ctx, hostConn{c1, addr})
+	}
+
+	_, err := dial("10.0.0.1", 1000)
+	r.NoError(err)
+
+	// the same host again, from another port
+	c, err := dial("10.0.0.1", 1001)
+	r.Equal(ErrAcceptRate, err)
+	c.Close()
+
+	// other hosts are not affected
+	_, err = dial("10.0.0.2", 1000)
+	r.NoError(err)
+	r.Equal(2, srv.Sessions())
+
+	sctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	r.NoError(srv.Shutdown(sctx))
+}
@@ -0,0 +1,92 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"sync/atomic"
+)
+
+// BufferStats describes the receive buffer of a stream, i.e. the packets that
+// arrived but were not read yet.
+//
+// A packet that waits for room in a full buffer already counts as buffered,
+// so a HighWater above the buffer size means the reader didn't keep up and
+// the receive overflow policy applied.
+type BufferStats struct {
+	// Buffered is the number of packets waiting right now.
+	Buffered int
+
+	// HighWater is the highest number of packets that waited at once.
+	HighWater int
+}
+
+// Stats is a snapshot of the receive buffer occupancy of a session. It helps
+// choosing buffer sizes, see Request.BufferSize.
+type Stats struct {
+	// Streams holds the buffer stats of the pending requests by request id.
+	Streams map[int32]BufferStats
+
+	// Buffered is the number of packets waiting in all buffers right now.
+	Buffered int
+
+	// HighWater is the highest HighWater reached by any stream of the
+	// session, including the ones that ended already.
+	HighWater int
+}
+
+// Stats returns the receive buffer occupancy of the pending requests.
+func (r *rpc) Stats() Stats {
+	reqs := r.reqs.Snapshot()
+	st := Stats{
+		Streams:   make(map[int32]BufferStats, len(reqs)),
+		HighWater: int(atomic.LoadInt32(&r.highWater)),
+	}
+
+	for id, req := range reqs {
+		sf, ok := req.Stream.(StreamFlow)
+		if !ok {
+			continue
+		}
+
+		bs := sf.BufferStats()
+		st.Streams[id] = bs
+		st.Buffered += bs.Buffered
+	}
+
+	return st
+}
+
+// BufferStats returns the receive buffer occupancy of the stream.
+func (str *stream) BufferStats() BufferStats {
+	return BufferStats{
+		Buffered:  int(atomic.LoadInt32(&str.buffered)),
+		HighWater: int(atomic.LoadInt32(&str.highWater)),
+	}
+}
+
+// addBuffered counts a packet that is passed to the receive buffer and
+// returns the new number of buffered packets.
+func (str *stream) addBuffered() int32 {
+	n := atomic.AddInt32(&str.buffered, 1)
+	storeMax(&str.highWater, n)
+	return n
+}
+
+// unbuffer counts a packet that left the receive buffer. Packets that were
+// not counted, e.g. because they were poured in by hand, are ignored.
+func (str *stream) unbuffer() {
+	for {
+		n := atomic.LoadInt32(&str.buffered)
+		if n <= 0 || atomic.CompareAndSwapInt32(&str.buffered, n, n-1) {
+			return
+		}
+	}
+}
+
+// storeMax atomically sets *addr to v if v is larger.
+func storeMax(addr *int32, v int32) {
+	for {
+		old := atomic.LoadInt32(addr)
+		if v <= old || atomic.CompareAndSwapInt32(addr, old, v) {
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	r := require.New(t)
+
+	const n = 3
+	release := make(chan struct{})
+	read := make(chan error, 1)
+
+	h1 := callerHandler(t)
+
+	h2 := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			<-release
+
+			var err error
+			for i := 0; i < n && err == nil; i++ {
+				_, err = req.Stream.Next(ctx)
+			}
+			read <- err
+		},
+		connect: noopConnect,
+	}
+
+	rpc1, rpc2, done := serveTestPair(t, h1, h2)
+	defer done()
+
+	ctx := context.Background()
+	sink, err := rpc1.Sink(ctx, []string{"upload"})
+	r.NoError(err)
+
+	for i := 0; i < n; i++ {
+		r.NoError(sink.Pour(ctx, "foo"))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for rpc2.(ConnInspector).Stats().Buffered < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("packets not buffered, stats: %+v", rpc2.(ConnInspector).Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	st := rpc2.(ConnInspector).Stats()
+	r.Len(st.Streams, 1)
+	for _, bs := range st.Streams {
+		r.Equal(BufferStats{Buffered: n, HighWater: n}, bs)
+	}
+
+	close(release)
+	r.NoError(<-read)
+
+	st = rpc2.(ConnInspector).Stats()
+	r.Equal(0, st.Buffered)
+	r.Equal(n, st.HighWater)
+	for _, bs := range st.Streams {
+		r.Equal(BufferStats{Buffered: 0, HighWater: n}, bs)
+	}
+
+	r.NoError(sink.Close())
+}
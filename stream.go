@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"cryptoscope.co/go/luigi"
 	"cryptoscope.co/go/muxrpc/codec"
@@ -12,6 +14,10 @@ import (
 	"github.com/pkg/errors"
 )
 
+// ErrStreamEnded is returned when pouring into or closing a stream that has
+// already been ended.
+var ErrStreamEnded = errors.New("muxrpc: stream already ended")
+
 // Stream is a muxrpc stream for the general duplex case.
 type Stream interface {
 	luigi.Source
@@ -25,16 +31,71 @@ type Stream interface {
 	WithReq(req int32)
 }
 
+// The streams created by this package implement the optional interfaces
+// below in addition to Stream. Use a type assertion to reach them.
+
+// StreamSeq is implemented by streams that track sequence numbers.
+type StreamSeq interface {
+	// Seq returns the sequence numbers of the packet last received by Next
+	// and of the packet last sent. They are zero unless enabled using
+	// WithSequenceNumbers.
+	Seq() (rx, tx uint32)
+}
+
+// StreamWaiter is implemented by streams that can wait for the remote to end
+// its side.
+type StreamWaiter interface {
+	// RemoteClosed returns a channel that is closed once the remote ended
+	// its sending direction, or the session ended.
+	RemoteClosed() <-chan struct{}
+
+	// DrainClose ends the sending side and discards incoming data until the
+	// remote ended its side as well or ctx is done.
+	DrainClose(ctx context.Context) error
+
+	// CancelAndWait ends the stream with err, or normally if err is nil, and
+	// waits until the remote ended its side as well or ctx is done. If the
+	// stream was ended before, it only waits.
+	CancelAndWait(ctx context.Context, err error) error
+}
+
+// StreamFlow is implemented by streams that report on their buffers.
+type StreamFlow interface {
+	// Writable returns a channel that is closed once Pour can hand a packet
+	// to the connection without waiting for room in the outbound queue, see
+	// WithMaxOutboundQueue. Producers can select on it to do other work
+	// instead of blocking in Pour. It is only a hint: other streams of the
+	// session share the queue and may take the room first.
+	//
+	// If the outbound queue is unbounded, which is the default, the channel
+	// is always closed and Pour blocks until the packet is written to the
+	// connection. After the stream was ended it is closed as well, since Pour
+	// returns right away.
+	Writable() <-chan struct{}
+
+	// BufferStats returns how many received packets wait to be read.
+	BufferStats() BufferStats
+}
+
+var (
+	_ StreamSeq    = (*stream)(nil)
+	_ StreamWaiter = (*stream)(nil)
+	_ StreamFlow   = (*stream)(nil)
+)
+
 // NewStram creates a new Stream.
 func NewStream(src luigi.Source, sink luigi.Sink, req int32, ins, outs bool) Stream {
 	return &stream{
-		pktSrc:    src,
-		pktSink:   sink,
-		req:       req,
-		closeCh:   make(chan struct{}),
-		closeOnce: &sync.Once{},
-		inStream:  ins,
-		outStream: outs,
+		pktSrc:     src,
+		pktSink:    sink,
+		req:        req,
+		closeCh:    make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		remoteCh:   make(chan struct{}),
+		remoteOnce: &sync.Once{},
+		inStream:   ins,
+		outStream:  outs,
+		enc:        JSONCodec,
 	}
 }
 
@@ -50,10 +111,54 @@ type stream struct {
 	closeCh   chan struct{}
 	closeOnce *sync.Once
 
+	// flag holds the flags of the last packet returned by Next
+	flag codec.Flag
+
+	// enc encodes the values poured into the stream and decodes those
+	// returned by Next, JSONCodec unless set by the session
+	enc Codec
+
+	// seq enables numbering packets. rxSeq and txSeq hold the sequence
+	// numbers of the last packets returned by Next and sent, and are
+	// accessed atomically.
+	seq          bool
+	rxSeq, txSeq uint32
+
+	// buffered is the number of received packets that were not read yet and
+	// highWater the most there ever were. Both are accessed atomically.
+	buffered, highWater int32
+
+	// bufSize is the capacity of the receive buffer, zero if it is unknown
+	bufSize int32
+
+	// now is set if the session tracks activity, see WithRequestTTL.
+	// lastActive is the time a packet was last sent or received in unix
+	// nanoseconds and is accessed atomically.
+	now        func() time.Time
+	lastActive int64
+
+	// remoteCh is closed when the remote's end packet arrived
+	remoteCh   chan struct{}
+	remoteOnce *sync.Once
+
+	// sessionDone is closed once the session of the stream is over, after
+	// which Pour fails. It is nil for streams without a session.
+	sessionDone <-chan struct{}
+
+	// draining is set by DrainClose, which keeps reading after closeCh was
+	// closed. Accessed atomically.
+	draining int32
+
+	// ended is set once we sent the end packet, userEnded if that happened
+	// through Close or CloseWithError.
+	endL      sync.Mutex
+	ended     bool
+	userEnded bool
+
 	inStream, outStream bool
 }
 
-// WithType makes the stream unmarshal JSON into values of type tipe
+// WithType makes the stream unmarshal values into type tipe
 func (str *stream) WithType(tipe interface{}) {
 	str.l.Lock()
 	defer str.l.Unlock()
@@ -74,25 +179,12 @@ func (str *stream) Next(ctx context.Context) (interface{}, error) {
 	str.l.Lock()
 	defer str.l.Unlock()
 
-	// cancellation
-	ctx, cancel := withCloseCtx(ctx)
-	defer cancel()
-	go func() {
-		select {
-		case <-str.closeCh:
-			cancel()
-		case <-ctx.Done():
-		}
-	}()
-
-	vpkt, err := str.pktSrc.Next(ctx)
+	pkt, err := str.nextPacket(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "error reading from packet source")
+		return nil, err
 	}
 
-	pkt := vpkt.(*codec.Packet)
-
-	if pkt.Flag.Get(codec.FlagJSON) {
+	if typeFlag(pkt.Flag) == codecFlag(str.enc) {
 		var (
 			dst     interface{}
 			ptrType bool
@@ -111,9 +203,9 @@ func (str *stream) Next(ctx context.Context) (interface{}, error) {
 			ptrType = true
 		}
 
-		err := json.Unmarshal(pkt.Body, dst)
+		err := str.enc.Unmarshal(pkt.Body, dst)
 		if err != nil {
-			return nil, errors.Wrap(err, "error unmarshaling json")
+			return nil, errors.Wrap(err, "error unmarshaling value")
 		}
 
 		if !ptrType {
@@ -130,6 +222,101 @@ func (str *stream) Next(ctx context.Context) (interface{}, error) {
 	return pkt.Body, nil
 }
 
+// readPacket returns the next incoming packet on the stream without decoding it.
+func (str *stream) readPacket(ctx context.Context) (*codec.Packet, error) {
+	str.l.Lock()
+	defer str.l.Unlock()
+
+	return str.nextPacket(ctx)
+}
+
+// nextPacket returns the next incoming packet. Must be called with str.l held.
+func (str *stream) nextPacket(ctx context.Context) (*codec.Packet, error) {
+	// cancellation. Only closing the stream ourselves cancels reading: if
+	// the remote ended it, the packets it sent before are still returned.
+	ctx, cancel := withCloseCtx(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-str.closeCh:
+			if atomic.LoadInt32(&str.draining) == 0 && str.isUserEnded() {
+				cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	vpkt, err := str.pktSrc.Next(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading from packet source")
+	}
+
+	str.unbuffer()
+
+	pkt := vpkt.(*codec.Packet)
+	str.flag = pkt.Flag
+	if str.seq {
+		atomic.AddUint32(&str.rxSeq, 1)
+	}
+
+	return pkt, nil
+}
+
+// lastFlag returns the flags of the packet last returned by Next.
+func (str *stream) lastFlag() codec.Flag {
+	str.l.Lock()
+	defer str.l.Unlock()
+
+	return str.flag
+}
+
+// Seq returns the sequence numbers of the last received and sent packets.
+func (str *stream) Seq() (rx, tx uint32) {
+	return atomic.LoadUint32(&str.rxSeq), atomic.LoadUint32(&str.txSeq)
+}
+
+// RemoteClosed returns a channel that is closed once the remote ended its side.
+func (str *stream) RemoteClosed() <-chan struct{} {
+	return str.remoteCh
+}
+
+// markRemoteClosed closes the channel returned by RemoteClosed.
+func (str *stream) markRemoteClosed() {
+	str.remoteOnce.Do(func() { close(str.remoteCh) })
+}
+
+// markEnded marks the stream as ended. It returns ErrStreamEnded if byUser
+// is set and the user already ended the stream before.
+func (str *stream) markEnded(byUser bool) error {
+	str.endL.Lock()
+	defer str.endL.Unlock()
+
+	if byUser && str.userEnded {
+		return ErrStreamEnded
+	}
+
+	str.ended = true
+	str.userEnded = str.userEnded || byUser
+	return nil
+}
+
+// isEnded returns whether the end packet has been sent.
+func (str *stream) isEnded() bool {
+	str.endL.Lock()
+	defer str.endL.Unlock()
+
+	return str.ended
+}
+
+// isUserEnded returns whether the stream was ended using Close or
+// CloseWithError.
+func (str *stream) isUserEnded() bool {
+	str.endL.Lock()
+	defer str.endL.Unlock()
+
+	return str.userEnded
+}
+
 // Pour sends a message on the stream
 func (str *stream) Pour(ctx context.Context, v interface{}) error {
 	var (
@@ -137,23 +324,73 @@ func (str *stream) Pour(ctx context.Context, v interface{}) error {
 		err error
 	)
 
+	if str.isEnded() {
+		return ErrStreamEnded
+	}
+
+	// the packer drops writes after it was closed, so don't let producers
+	// spin on a dead session
+	select {
+	case <-str.sessionDone:
+		return ErrSessionTerminated
+	default:
+	}
+
 	if body, ok := v.(codec.Body); ok {
 		pkt = newRawPacket(str.outStream, str.req, body)
 	} else if body, ok := v.(string); ok {
 		pkt = newStringPacket(str.outStream, str.req, body)
 	} else {
-		pkt, err = newJSONPacket(str.outStream, str.req, v)
+		pkt, err = newEncodedPacket(str.enc, str.outStream, str.req, v)
 		if err != nil {
-			return errors.Wrap(err, "error building json packet")
+			return errors.Wrap(err, "error building packet")
 		}
 	}
 
+	if str.seq {
+		atomic.AddUint32(&str.txSeq, 1)
+	}
+
 	err = str.pktSink.Pour(ctx, pkt)
+	if err == nil {
+		str.touch()
+	}
+
 	return errors.Wrap(err, "error pouring to packet sink")
 }
 
+// touch records activity on the stream if the session tracks it.
+func (str *stream) touch() {
+	if str.now != nil {
+		atomic.StoreInt64(&str.lastActive, str.now().UnixNano())
+	}
+}
+
+// idleSince returns the time of the last activity on the stream.
+func (str *stream) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&str.lastActive))
+}
+
 // Close closes the stream and sends the EndErr message.
+// It returns ErrStreamEnded if it was closed before.
 func (str *stream) Close() error {
+	if err := str.markEnded(true); err != nil {
+		return err
+	}
+
+	str.sendEnd()
+	return nil
+}
+
+// endAfterRemote sends our end packet after the remote ended its side. Other
+// than Close this leaves it to the handler to still call Close once.
+func (str *stream) endAfterRemote() {
+	str.markEnded(false)
+	str.sendEnd()
+}
+
+// sendEnd sends the EndErr message once.
+func (str *stream) sendEnd() {
 	str.closeOnce.Do(func() {
 		pkt := newEndOkayPacket(str.req)
 		close(str.closeCh)
@@ -165,17 +402,74 @@ func (str *stream) Close() error {
 		// occurs, which at some point will happen.
 		go str.pktSink.Pour(context.TODO(), pkt)
 	})
+}
 
-	return nil
+// DrainClose ends our side of the stream, then reads and discards incoming
+// packets until the remote ends its side or ctx is done. Other than Close,
+// this doesn't cancel reading, so the remote can finish sending. It returns
+// the error the remote ended the stream with, or the error of ctx.
+func (str *stream) DrainClose(ctx context.Context) error {
+	if err := str.markEnded(true); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&str.draining, 1)
+	str.sendEnd()
+
+	for {
+		_, err := str.readPacket(ctx)
+		if luigi.IsEOS(errors.Cause(err)) {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "error draining stream")
+		}
+	}
 }
 
-// Close closes the stream and sends the EndErr message.
+// CancelAndWait ends the stream and waits for the remote's end.
+func (str *stream) CancelAndWait(ctx context.Context, err error) error {
+	if err == nil {
+		err = str.Close()
+	} else {
+		err = str.CloseWithError(err)
+	}
+	if err != nil && err != ErrStreamEnded {
+		return err
+	}
+
+	select {
+	case <-str.remoteCh:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "error waiting for remote to end")
+	}
+}
+
+// Writable returns a channel that is closed once there is room to send.
+func (str *stream) Writable() <-chan struct{} {
+	if str.isEnded() {
+		return closedCh
+	}
+
+	if w, ok := str.pktSink.(interface{ Writable() <-chan struct{} }); ok {
+		return w.Writable()
+	}
+
+	return closedCh
+}
+
+// CloseWithError closes the stream and sends the EndErr message with closeErr.
+// It returns ErrStreamEnded if it was closed before.
 func (str *stream) CloseWithError(closeErr error) error {
 	pkt, err := newEndErrPacket(str.req, closeErr)
 	if err != nil {
 		return errors.Wrap(err, "error building error packet")
 	}
 
+	if err := str.markEnded(true); err != nil {
+		return err
+	}
+
 	str.closeOnce.Do(func() {
 		// don't close the stream itself, otherwise the error will be dropped!
 
@@ -222,17 +516,17 @@ func newStringPacket(stream bool, req int32, body string) *codec.Packet {
 	}
 }
 
-// newJSONPacket crafts a new packets with JSON payload
-func newJSONPacket(stream bool, req int32, v interface{}) (*codec.Packet, error) {
+// newEncodedPacket crafts a new packet with v encoded by enc as payload
+func newEncodedPacket(enc Codec, stream bool, req int32, v interface{}) (*codec.Packet, error) {
 	var flag codec.Flag
 
 	if stream {
 		flag = codec.FlagStream
 	}
 
-	flag |= codec.FlagJSON
+	flag |= codecFlag(enc)
 
-	body, err := json.Marshal(v)
+	body, err := enc.Marshal(v)
 	if err != nil {
 		return nil, errors.Wrap(err, "error marshaling value")
 	}
@@ -255,10 +549,17 @@ func newEndOkayPacket(req int32) *codec.Packet {
 }
 
 func newEndErrPacket(req int32, err error) (*codec.Packet, error) {
-	body, err := json.Marshal(CallError{
+	callErr := CallError{
 		Message: err.Error(),
 		Name:    "Error",
-	})
+	}
+
+	// pass on the stack of call errors
+	if ce, ok := err.(*CallError); ok {
+		callErr.Stack = ce.Stack
+	}
+
+	body, err := json.Marshal(callErr)
 	if err != nil {
 		return nil, errors.Wrap(err, "error marshaling value")
 	}
@@ -2,13 +2,15 @@ package muxrpc // import "cryptoscope.co/go/muxrpc"
 
 import (
 	"context"
+	"net"
 	"testing"
+	"time"
 
 	"cryptoscope.co/go/luigi"
 	"cryptoscope.co/go/muxrpc/codec"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
-	//"github.com/pkg/errors"
 )
 
 func TestStream(t *testing.T) {
@@ -57,3 +59,146 @@ func TestStream(t *testing.T) {
 	r.NoError(err, "error reading packet from oSrc")
 	r.Equal(codec.FlagEndErr|codec.FlagStream|codec.FlagJSON, v.(*codec.Packet).Flag, "wrong value")
 }
+
+func TestStreamLastFlag(t *testing.T) {
+	r := require.New(t)
+	iSrc, iSink := luigi.NewPipe(luigi.WithBuffer(2))
+	_, oSink := luigi.NewPipe(luigi.WithBuffer(2))
+
+	str := NewStream(iSrc, oSink, 23, false, false).(*stream)
+
+	ctx := context.Background()
+
+	err := iSink.Pour(ctx, &codec.Packet{Req: 23, Flag: codec.FlagString, Body: []byte("single")})
+	r.NoError(err, "error pouring packet to iSink")
+	err = iSink.Pour(ctx, &codec.Packet{Req: 23, Flag: codec.FlagStream | codec.FlagString, Body: []byte("streamed")})
+	r.NoError(err, "error pouring packet to iSink")
+
+	_, err = str.Next(ctx)
+	r.NoError(err, "error reading from stream")
+	r.False(str.lastFlag().Get(codec.FlagStream), "expected single packet")
+
+	_, err = str.Next(ctx)
+	r.NoError(err, "error reading from stream")
+	r.True(str.lastFlag().Get(codec.FlagStream), "expected stream packet")
+}
+
+func TestStreamWriteAfterEnd(t *testing.T) {
+	r := require.New(t)
+	iSrc, _ := luigi.NewPipe(luigi.WithBuffer(2))
+	_, oSink := luigi.NewPipe(luigi.WithBuffer(4))
+
+	str := NewStream(iSrc, oSink, 23, true, true)
+	ctx := context.Background()
+
+	r.NoError(str.Pour(ctx, "foo"))
+	r.NoError(str.Close())
+
+	r.Equal(ErrStreamEnded, str.Pour(ctx, "bar"), "expected error pouring after end")
+	r.Equal(ErrStreamEnded, str.Close(), "expected error ending twice")
+	r.Equal(ErrStreamEnded, str.CloseWithError(errors.New("test")), "expected error ending twice")
+}
+
+func TestStreamCloseAfterRemoteEnd(t *testing.T) {
+	r := require.New(t)
+	iSrc, _ := luigi.NewPipe(luigi.WithBuffer(2))
+	oSrc, oSink := luigi.NewPipe(luigi.WithBuffer(4))
+
+	str := NewStream(iSrc, oSink, 23, true, true).(*stream)
+	ctx := context.Background()
+
+	str.endAfterRemote()
+	r.Equal(ErrStreamEnded, str.Pour(ctx, "foo"), "expected error pouring after end")
+	r.NoError(str.Close(), "handler should still be able to close once")
+	r.Equal(ErrStreamEnded, str.Close(), "expected error ending twice")
+
+	v, err := oSrc.Next(ctx)
+	r.NoError(err, "error reading packet from oSrc")
+	r.True(v.(*codec.Packet).Flag.Get(codec.FlagEndErr), "expected end packet")
+}
+
+func TestStreamReadAfterRemoteEnd(t *testing.T) {
+	r := require.New(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	// a packet source that only has a packet once released
+	iSrc := luigi.FuncSource(func(ctx context.Context) (interface{}, error) {
+		close(started)
+		select {
+		case <-release:
+			return &codec.Packet{Req: 23, Flag: codec.FlagStream | codec.FlagString, Body: []byte("late")}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+	_, oSink := luigi.NewPipe(luigi.WithBuffer(1))
+
+	str := NewStream(iSrc, oSink, 23, true, true).(*stream)
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		v, err := str.Next(context.Background())
+		res <- result{v, err}
+	}()
+
+	// the remote ends while we wait for a packet it sent before
+	<-started
+	str.endAfterRemote()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	got := <-res
+	r.NoError(got.err, "reading was cancelled by the remote's end")
+	r.Equal("late", got.v)
+}
+
+func TestStreamWritable(t *testing.T) {
+	r := require.New(t)
+	c1, c2 := net.Pipe()
+	pkr := NewPacker(c1, WithMaxOutboundQueue(1, QueueBlock))
+	defer pkr.(*packer).Close()
+
+	iSrc, _ := luigi.NewPipe(luigi.WithBuffer(2))
+	str := NewStream(iSrc, pkr, 23, true, true)
+	ctx := context.Background()
+
+	select {
+	case <-str.(StreamFlow).Writable():
+	default:
+		t.Fatal("expected empty queue to be writable")
+	}
+
+	// nobody reads from the other end yet, so this fills the queue
+	go str.Pour(ctx, "foo")
+	for len(pkr.(*packer).queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	writable := str.(StreamFlow).Writable()
+	select {
+	case <-writable:
+		t.Fatal("expected full queue not to be writable")
+	default:
+	}
+
+	_, err := codec.NewReader(c2).ReadPacket()
+	r.NoError(err, "error reading packet")
+
+	select {
+	case <-writable:
+	case <-time.After(time.Second):
+		t.Fatal("expected stream to become writable")
+	}
+
+	r.NoError(str.Close())
+	select {
+	case <-str.(StreamFlow).Writable():
+	default:
+		t.Fatal("expected ended stream to be writable")
+	}
+}
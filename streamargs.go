@@ -0,0 +1,54 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+
+	"cryptoscope.co/go/luigi"
+
+	"github.com/pkg/errors"
+)
+
+// DuplexWithStreamArgs opens a duplex call whose arguments are too large to be
+// sent in the opening packet. The opening packet only carries the method and
+// type, and args is sent as the first packet of the stream. The remote
+// handler reads it using Request.StreamArgs before using the stream.
+//
+// This is a convention on top of muxrpc, not part of the protocol. JS muxrpc
+// peers see args as the first element of the duplex' source, so both sides
+// need to agree on using it for a method.
+func DuplexWithStreamArgs(ctx context.Context, e Endpoint, tipe interface{}, method []string, args interface{}) (luigi.Source, luigi.Sink, error) {
+	src, sink, err := e.Duplex(ctx, tipe, method)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = sink.Pour(ctx, args)
+	if err != nil {
+		sink.Close()
+		return nil, nil, errors.Wrap(err, "error sending stream arguments")
+	}
+
+	return src, sink, nil
+}
+
+// StreamArgs reads the arguments sent by DuplexWithStreamArgs from the stream
+// and unmarshals them into dst. It must be called before reading any other
+// values from the stream.
+func (req *Request) StreamArgs(ctx context.Context, dst interface{}) error {
+	str, ok := req.Stream.(*stream)
+	if !ok {
+		return errors.Errorf("unsupported stream type %T", req.Stream)
+	}
+
+	pkt, err := str.readPacket(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error reading stream arguments")
+	}
+
+	if typeFlag(pkt.Flag) != codecFlag(str.enc) {
+		return errors.Errorf("expected stream arguments to be encoded with flags %v", codecFlag(str.enc))
+	}
+
+	err = str.enc.Unmarshal(pkt.Body, dst)
+	return errors.Wrap(err, "error decoding stream arguments")
+}
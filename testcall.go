@@ -0,0 +1,88 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"encoding/json"
+
+	"cryptoscope.co/go/luigi"
+	"cryptoscope.co/go/muxrpc/codec"
+
+	"github.com/pkg/errors"
+)
+
+// TestResult holds what a handler sent in reply to a call made by TestCall.
+type TestResult struct {
+	// Values holds the values the handler sent, in order: strings for
+	// string packets, json.RawMessage for JSON packets and []byte otherwise.
+	Values []interface{}
+
+	// Err is the error the handler ended the call with, if any.
+	Err *CallError
+}
+
+// TestCall passes req to h.HandleCall without a network connection and
+// collects the reply. req only needs Type, Method and Args set. For sink and
+// duplex calls, the values in input are sent to the handler before the
+// inbound stream is ended. TestCall returns once the handler ended the call
+// or ctx is done.
+func TestCall(ctx context.Context, h Handler, req *Request, input ...interface{}) (*TestResult, error) {
+	if req.Args == nil {
+		req.Args = []interface{}{}
+	}
+
+	err := req.validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid request")
+	}
+
+	// inbound request ids are negative
+	const id = -1
+
+	ins := req.Type == Sink || req.Type == Duplex
+	outs := req.Type == Source || req.Type == Duplex
+
+	inSrc, inSink := luigi.NewPipe(luigi.WithBuffer(len(input) + 1))
+	if ins {
+		feeder := NewStream(nil, inSink, id, false, true)
+		for _, v := range input {
+			err := feeder.Pour(ctx, v)
+			if err != nil {
+				return nil, errors.Wrap(err, "error pouring input")
+			}
+		}
+	}
+	inSink.Close()
+
+	outSrc, outSink := luigi.NewPipe(luigi.WithBuffer(defaultBufSize))
+	req.Stream = NewStream(inSrc, outSink, id, ins, outs)
+	req.in = inSink
+
+	go h.HandleCall(ctx, req)
+
+	res := &TestResult{}
+	for {
+		v, err := outSrc.Next(ctx)
+		if err != nil {
+			return res, errors.Wrap(err, "error reading reply")
+		}
+
+		pkt := v.(*codec.Packet)
+		switch {
+		case pkt.Flag.Get(codec.FlagEndErr):
+			if !isTrue(pkt.Body) {
+				res.Err, err = parseError(pkt.Body)
+				if err != nil {
+					return res, errors.Wrap(err, "error parsing error packet")
+				}
+			}
+
+			return res, nil
+		case pkt.Flag.Get(codec.FlagJSON):
+			res.Values = append(res.Values, json.RawMessage(pkt.Body))
+		case pkt.Flag.Get(codec.FlagString):
+			res.Values = append(res.Values, string(pkt.Body))
+		default:
+			res.Values = append(res.Values, []byte(pkt.Body))
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package muxrpc // import "cryptoscope.co/go/muxrpc"
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cryptoscope.co/go/luigi"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestCall(t *testing.T) {
+	r := require.New(t)
+
+	h := &testHandler{
+		call: func(ctx context.Context, req *Request) {
+			switch req.Type {
+			case "async":
+				if req.Method[0] == "fail" {
+					req.Stream.CloseWithError(errors.New("failed on purpose"))
+					return
+				}
+				req.Return(ctx, "pong")
+			case "source":
+				for i := 0; i < 3; i++ {
+					req.Stream.Pour(ctx, i)
+				}
+				req.Stream.Close()
+			case "sink", "duplex":
+				for {
+					v, err := req.Stream.Next(ctx)
+					if luigi.IsEOS(errors.Cause(err)) {
+						break
+					} else if err != nil {
+						req.Stream.CloseWithError(err)
+						return
+					}
+
+					if req.Type == "duplex" {
+						req.Stream.Pour(ctx, v)
+					}
+				}
+				req.Stream.Close()
+			}
+		},
+		connect: noopConnect,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := TestCall(ctx, h, &Request{Type: "async", Method: []string{"ping"}})
+	r.NoError(err)
+	r.Nil(res.Err)
+	r.Equal([]interface{}{"pong"}, res.Values)
+
+	res, err = TestCall(ctx, h, &Request{Type: "async", Method: []string{"fail"}})
+	r.NoError(err)
+	r.NotNil(res.Err)
+	r.Equal("failed on purpose", res.Err.Message)
+
+	res, err = TestCall(ctx, h, &Request{Type: "source", Method: []string{"count"}})
+	r.NoError(err)
+	r.Equal([]interface{}{json.RawMessage("0"), json.RawMessage("1"), json.RawMessage("2")}, res.Values)
+
+	res, err = TestCall(ctx, h, &Request{Type: "sink", Method: []string{"upload"}}, "a", "b")
+	r.NoError(err)
+	r.Nil(res.Err)
+	r.Len(res.Values, 0)
+
+	res, err = TestCall(ctx, h, &Request{Type: "duplex", Method: []string{"echo"}}, "a", "b")
+	r.NoError(err)
+	r.Nil(res.Err)
+	r.Equal([]interface{}{"a", "b"}, res.Values)
+
+	_, err = TestCall(ctx, h, &Request{Type: "stream", Method: []string{"echo"}})
+	r.Error(err, "expected invalid call type to fail")
+}